@@ -0,0 +1,44 @@
+package scoredb
+
+import ()
+
+// Produces every document id in a range (skipping deleted ones), each with a score of zero.
+// Backends whose ids are dense use this to implement AllDocsItr().
+type AllDocsItr struct {
+	docId     int64
+	minDocId  int64
+	maxDocId  int64
+	isDeleted func(docId int64) bool
+}
+
+func NewAllDocsItr(minDocId, maxDocId int64, isDeleted func(docId int64) bool) *AllDocsItr {
+	return &AllDocsItr{docId: -1, minDocId: minDocId, maxDocId: maxDocId, isDeleted: isDeleted}
+}
+
+func (op *AllDocsItr) Name() string { return "AllDocsItr" }
+func (op *AllDocsItr) Cur() (int64, float32) {
+	return op.docId, 0.0
+}
+func (op *AllDocsItr) GetBounds() (min, max float32) { return 0.0, 0.0 }
+func (op *AllDocsItr) SetBounds(min, max float32) bool {
+	return min <= 0.0 && 0.0 <= max
+}
+func (op *AllDocsItr) Close()     {}
+func (op *AllDocsItr) Err() error { return nil }
+func (op *AllDocsItr) Next(minId int64) bool {
+	docId := op.docId + 1
+	if docId < minId {
+		docId = minId
+	}
+	if docId < op.minDocId {
+		docId = op.minDocId
+	}
+	for ; docId <= op.maxDocId; docId++ {
+		if !op.isDeleted(docId) {
+			op.docId = docId
+			return true
+		}
+	}
+	op.docId = op.maxDocId
+	return false
+}
@@ -2,6 +2,7 @@ package scoredb
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"github.com/edsrzf/mmap-go"
 	"io"
@@ -108,24 +109,36 @@ type BitReader struct {
 	CurBitsLeft     uint
 }
 
+const MAX_MAPPED_WORDS = 10000000 // the largest file (in 8 byte words) that a BitReader can map
+
 func NewBitReader(file *os.File) (*BitReader, error) {
-	mapSlice, err := mmap.Map(file, mmap.RDONLY, 0)
+	curPos, err := file.Seek(0, 1)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	curPos, err := file.Seek(0, 1)
 	if curPos%8 != 0 {
-		panic(fmt.Sprintf("BitReader started at byte %v; must be 8 byte aligned", curPos))
+		return nil, fmt.Errorf("BitReader started at byte %v; must be 8 byte aligned", curPos)
+	}
+	mapSlice, err := mmap.Map(file, mmap.RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	numWords := len(mapSlice) / 8
+	if numWords <= int(curPos/8) || numWords > MAX_MAPPED_WORDS {
+		mapSlice.Unmap()
+		return nil, fmt.Errorf("Unexpected file size (%v bytes) for BitReader starting at byte %v", len(mapSlice), curPos)
 	}
 	return &BitReader{
 		File:            file,
 		OrigMmap:        &mapSlice,
-		Mmap:            (*((*[10000000]uint64)(unsafe.Pointer(&mapSlice[0]))))[:],
+		Mmap:            (*((*[MAX_MAPPED_WORDS]uint64)(unsafe.Pointer(&mapSlice[0]))))[:numWords:numWords],
 		MmapPtr:         uint(curPos / 8),
 		MmapPtrBitsLeft: 64,
 	}, nil
 }
 
+var ErrUnexpectedEnd = errors.New("Unexpected end of bit stream")
+
 func (reader *BitReader) Close() error {
 	reader.Mmap = []uint64{}
 	err := reader.OrigMmap.Unmap()
@@ -137,6 +150,9 @@ func (reader *BitReader) Close() error {
 
 func (reader *BitReader) Refill(cur uint64, bitsLeft uint, numNeeded uint) (uint64, uint, error) {
 	wanted := 64 - bitsLeft
+	if reader.MmapPtr >= uint(len(reader.Mmap)) {
+		return cur, bitsLeft, ErrUnexpectedEnd
+	}
 	if wanted >= reader.MmapPtrBitsLeft {
 		bits := reader.Mmap[reader.MmapPtr] << (64 - reader.MmapPtrBitsLeft)
 		cur = cur | (bits >> bitsLeft)
@@ -147,6 +163,12 @@ func (reader *BitReader) Refill(cur uint64, bitsLeft uint, numNeeded uint) (uint
 		if wanted == 0 {
 			return cur, bitsLeft, nil
 		}
+		if reader.MmapPtr >= uint(len(reader.Mmap)) {
+			if bitsLeft >= numNeeded { // (the remaining bits are enough for this read)
+				return cur, bitsLeft, nil
+			}
+			return cur, bitsLeft, ErrUnexpectedEnd
+		}
 	}
 	bits := reader.Mmap[reader.MmapPtr] << (64 - reader.MmapPtrBitsLeft)
 	cur = cur | (bits >> bitsLeft)
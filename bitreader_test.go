@@ -148,3 +148,51 @@ func TestBitReaderVolume(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 }
+
+func TestBitReaderTruncated(t *testing.T) {
+	filename := RmAllTestData()("bitreader.truncated")
+	defer RmAllTestData()
+
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	wtr, err := NewBitWriter(file)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	wtr.WriteBits(42, 21)
+	err = wtr.Close()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	fd, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	rdr, err := NewBitReader(fd)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for i := 0; i < 100; i++ { // reads past the end of the file fail, rather than panicking
+		_, err = rdr.ReadBits(30)
+		if err != nil {
+			break
+		}
+	}
+	if err != ErrUnexpectedEnd {
+		t.Fatalf("Expected ErrUnexpectedEnd; found %v", err)
+	}
+	rdr.Close()
+
+	fd, err = os.Create(filename)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	_, err = NewBitReader(fd)
+	if err == nil {
+		t.Fatalf("Expected an error for an empty file")
+	}
+	fd.Close()
+}
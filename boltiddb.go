@@ -2,7 +2,6 @@ package scoredb
 
 import (
 	"encoding/binary"
-	"fmt"
 	"github.com/boltdb/bolt"
 )
 
@@ -18,6 +17,17 @@ type BoltIdDb struct {
 	Db *bolt.DB
 }
 
+func (db *BoltIdDb) Close() error {
+	return db.Db.Close()
+}
+
+// Copies the database (as of a read transaction, so writes may continue) to the file dest
+func (db *BoltIdDb) Snapshot(dest string) error {
+	return db.Db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(dest, 0600)
+	})
+}
+
 func encodeScoreId(id int64) []byte {
 	var buf [9]byte
 	slice := buf[:]
@@ -25,7 +35,13 @@ func encodeScoreId(id int64) []byte {
 	return slice[:sz]
 }
 
+func decodeScoreId(buf []byte) int64 {
+	id, _ := binary.Varint(buf)
+	return id
+}
+
 var boltBucketName []byte = []byte("ScoreDbIds")
+var boltReverseBucketName []byte = []byte("ScoreDbClientIds")
 
 func (db *BoltIdDb) Put(scoreIds []int64, clientIds []string) error {
 	return db.Db.Update(func(tx *bolt.Tx) error {
@@ -33,11 +49,70 @@ func (db *BoltIdDb) Put(scoreIds []int64, clientIds []string) error {
 		if err != nil {
 			return err
 		}
+		rb, err := tx.CreateBucketIfNotExists([]byte(boltReverseBucketName))
+		if err != nil {
+			return err
+		}
 		for idx, scoreId := range scoreIds {
+			oldIdBytes := rb.Get([]byte(clientIds[idx]))
+			if oldIdBytes != nil && decodeScoreId(oldIdBytes) != scoreId {
+				err = b.Delete(append([]byte{}, oldIdBytes...))
+				if err != nil {
+					return err
+				}
+			}
 			err = b.Put(encodeScoreId(scoreId), []byte(clientIds[idx]))
 			if err != nil {
 				return err
 			}
+			err = rb.Put([]byte(clientIds[idx]), encodeScoreId(scoreId))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (db *BoltIdDb) Lookup(clientIds []string) ([]int64, error) {
+	result := make([]int64, len(clientIds))
+	err := db.Db.View(func(tx *bolt.Tx) error {
+		rb := tx.Bucket([]byte(boltReverseBucketName))
+		for idx, clientId := range clientIds {
+			result[idx] = -1
+			if rb == nil {
+				continue
+			}
+			scoreIdBytes := rb.Get([]byte(clientId))
+			if scoreIdBytes != nil {
+				result[idx] = decodeScoreId(scoreIdBytes)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (db *BoltIdDb) Delete(clientIds []string) error {
+	return db.Db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(boltBucketName))
+		rb := tx.Bucket([]byte(boltReverseBucketName))
+		if b == nil || rb == nil {
+			return nil
+		}
+		for _, clientId := range clientIds {
+			scoreIdBytes := rb.Get([]byte(clientId))
+			if scoreIdBytes == nil {
+				continue
+			}
+			err := b.Delete(append([]byte{}, scoreIdBytes...))
+			if err != nil {
+				return err
+			}
+			err = rb.Delete([]byte(clientId))
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
@@ -48,11 +123,11 @@ func (db *BoltIdDb) Get(scoreIds []int64) ([]string, error) {
 
 	err := db.Db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(boltBucketName))
+		if b == nil {
+			return nil
+		}
 		for idx, scoreId := range scoreIds {
 			clientIdBytes := b.Get(encodeScoreId(scoreId))
-			if clientIdBytes == nil {
-				return fmt.Errorf("Unable to find client id for internal id %d", scoreId)
-			}
 			result[idx] = string(clientIdBytes[:])
 			//fmt.Printf(" ID %v %v %v %v\n", idx, scoreId, clientIdBytes, result[idx])
 		}
@@ -61,3 +136,18 @@ func (db *BoltIdDb) Get(scoreIds []int64) ([]string, error) {
 
 	return result, err
 }
+
+// Returns the given score ids that have no client id
+func (db *BoltIdDb) FindMissing(scoreIds []int64) ([]int64, error) {
+	missing := make([]int64, 0)
+	err := db.Db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(boltBucketName))
+		for _, scoreId := range scoreIds {
+			if b == nil || b.Get(encodeScoreId(scoreId)) == nil {
+				missing = append(missing, scoreId)
+			}
+		}
+		return nil
+	})
+	return missing, err
+}
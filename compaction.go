@@ -0,0 +1,311 @@
+package scoredb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Compaction rewrites the posting lists of a field into a new generation with no overlapping buckets.
+// Over time, as buckets fill up and get split into narrower ones, a field accumulates many small files
+// that cover overlapping ranges of values; compaction also drops the entries of deleted documents.
+//
+// Compaction blocks indexing (on this shard), but not queries: in-flight queries continue to read the old
+// generation, which is removed once they are closed.
+
+// Compacts every field that has overlapping buckets, or that may hold entries for deleted documents.
+func (db *FsScoreDb) CompactAll() error {
+	db.writeLock.Lock()
+	if db.closed {
+		db.writeLock.Unlock()
+		return ErrClosed
+	}
+	names := make([]string, 0, len(db.fields))
+	for name, fieldFiles := range db.fields {
+		if fieldFiles.deletionsAtCompaction != db.deleted.Count() || HasOverlappingBuckets(fieldFiles.files) {
+			names = append(names, name)
+		}
+	}
+	db.writeLock.Unlock()
+	for _, name := range names {
+		err := db.Compact(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs CompactAll() at the given interval, until the database is closed.  Errors are logged.
+func (db *FsScoreDb) CompactPeriodically(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := db.CompactAll()
+		if err == ErrClosed {
+			return
+		} else if err != nil {
+			log.Printf("Compaction of %v failed: %v\n", db.dataDir, err)
+		}
+	}
+}
+
+func HasOverlappingBuckets(files OrderedFileInfos) bool {
+	for idx1, file1 := range files {
+		for idx2, file2 := range files {
+			if idx1 == idx2 || file1.numVariableBits <= file2.numVariableBits {
+				continue
+			}
+			numVar := file1.numVariableBits
+			if math.Float32bits(file1.minVal)>>numVar == math.Float32bits(file2.minVal)>>numVar {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (db *FsScoreDb) Compact(fieldName string) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	oldFiles, ok := db.fields[fieldName]
+	if !ok {
+		return nil
+	}
+	deletionCount := db.deleted.Count()
+	scan := func(visit func(docId int64, value float32) error) error {
+		return db.scanField(fieldName, oldFiles, visit)
+	}
+	buckets, err := PlanBuckets(scan)
+	if err != nil {
+		return err
+	}
+
+	newFiles := &FieldFiles{
+		fieldDir:              oldFiles.fieldDir,
+		generation:            oldFiles.generation + 1,
+		files:                 make(OrderedFileInfos, 0, len(buckets)),
+		deletionsAtCompaction: deletionCount,
+	}
+	dir := newFiles.Dir()
+	err = os.RemoveAll(dir) // (may exist if a previous compaction was interrupted)
+	if err != nil {
+		return err
+	}
+	err = EnsureDirectory(dir)
+	if err != nil {
+		return err
+	}
+
+	// Write each live entry (again in doc id order) to its bucket's file, opening each file at its first entry
+	writers := make(map[uint]map[uint32]*FileInfo) // by the number of variable bits, then by prefix
+	levels := make([]uint, 0)                      // (the keys of writers, from the widest buckets to the narrowest)
+	for _, bucket := range buckets {
+		if _, ok := writers[bucket.numVariableBits]; !ok {
+			writers[bucket.numVariableBits] = make(map[uint32]*FileInfo)
+			levels = append(levels, bucket.numVariableBits)
+		}
+		writers[bucket.numVariableBits][bucket.prefix] = nil
+	}
+	sort.Slice(levels, func(i, j int) bool { return levels[i] > levels[j] })
+	defer func() { // (closes the writers that a failure left open; the next attempt removes their generation)
+		for _, fileInfo := range newFiles.files {
+			if fileInfo.writer != nil {
+				fileInfo.writer.Close()
+				atomic.AddInt64(&numOpenFiles, -1)
+			}
+		}
+	}()
+	err = scan(func(docId int64, value float32) error {
+		bits := math.Float32bits(value)
+		for _, numVar := range levels {
+			fileInfo, ok := writers[numVar][bits>>numVar]
+			if !ok {
+				continue
+			}
+			if fileInfo == nil {
+				fileInfo, err := MakeFileInfo(dir, value, numVar, docId)
+				if err != nil {
+					return err
+				}
+				writers[numVar][bits>>numVar] = fileInfo
+				newFiles.files = append(newFiles.files, fileInfo)
+				return nil
+			}
+			WritePostingListEntry(fileInfo, docId, value)
+			return nil
+		}
+		return fmt.Errorf("No bucket was planned for %v in %v", value, fieldName)
+	})
+	if err != nil {
+		return err
+	}
+	for _, fileInfo := range newFiles.files {
+		err = CloseWriter(fileInfo)
+		if err != nil {
+			return err
+		}
+		err = SyncPath(fileInfo.path)
+		if err != nil {
+			return err
+		}
+		fileInfo.publish() // (queries can not see the new generation until it is swapped in below)
+	}
+	sort.Sort(newFiles.files)
+	err = SyncPath(dir)
+	if err != nil {
+		return err
+	}
+
+	// Atomically switch to the new generation, on disk and then in memory
+	err = writeGenerationFile(newFiles.fieldDir, newFiles.generation, newFiles.deletionsAtCompaction)
+	if err != nil {
+		return err
+	}
+	db.fieldsLock.Lock()
+	db.fields[fieldName] = newFiles
+	db.fieldsLock.Unlock()
+	oldFiles.Retire()
+	return nil
+}
+
+// Calls visit with every live entry of a field, in doc id order
+func (db *FsScoreDb) scanField(fieldName string, fieldFiles *FieldFiles, visit func(docId int64, value float32) error) error {
+	itrs := make([]DocItr, len(fieldFiles.files))
+	for fileIdx, fileInfo := range fieldFiles.files {
+		itrs[fileIdx] = NewPostingListDocItr(math.Float32bits(fileInfo.minVal), fileInfo.path, fileInfo.header, fileInfo.numVariableBits, db.deleted)
+	}
+	itr := NewFieldDocItr(fieldName, itrs)
+	defer itr.Close()
+	for itr.Next(itr.docId + 1) {
+		err := visit(itr.Cur())
+		if err != nil {
+			return err
+		}
+	}
+	return itr.Err()
+}
+
+// Replaces the GENERATION file of a field, which also records the number of deletions that the generation has dropped
+func writeGenerationFile(fieldDir string, generation int, deletionsAtCompaction int) error {
+	generationPath := path.Join(fieldDir, GENERATION_FILENAME)
+	contents := fmt.Sprintf("%d %d", generation, deletionsAtCompaction)
+	err := ioutil.WriteFile(generationPath+".tmp", []byte(contents), 0666)
+	if err != nil {
+		return err
+	}
+	err = SyncPath(generationPath + ".tmp")
+	if err != nil {
+		return err
+	}
+	err = os.Rename(generationPath+".tmp", generationPath)
+	if err != nil {
+		return err
+	}
+	return SyncPath(fieldDir)
+}
+
+// Reads a field's GENERATION file; a field that has never been compacted is generation 0.
+// (Files written before the number of deletions was recorded hold only the generation.)
+func readGenerationFile(fieldDir string) (generation int, deletionsAtCompaction int, err error) {
+	generationPath := path.Join(fieldDir, GENERATION_FILENAME)
+	if !Exists(generationPath) {
+		return 0, 0, nil
+	}
+	buf, err := ioutil.ReadFile(generationPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	parts := strings.Fields(string(buf))
+	if len(parts) == 0 || len(parts) > 2 {
+		return 0, 0, fmt.Errorf("Invalid generation file in %v", fieldDir)
+	}
+	generation, err = strconv.Atoi(parts[0])
+	if err == nil && len(parts) == 2 {
+		deletionsAtCompaction, err = strconv.Atoi(parts[1])
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid generation file in %v: %v", fieldDir, err)
+	}
+	return generation, deletionsAtCompaction, nil
+}
+
+// A bucket of the compacted field: the values whose bits, shifted right by numVariableBits, are prefix
+type compactionBucket struct {
+	numVariableBits uint
+	prefix          uint32
+	count           int64
+	minVal, maxVal  float32
+}
+
+// Divides the entries that scan visits into the fewest non-overlapping buckets that respect MaxDocsForBucket().
+// Only the counts of the buckets are kept: each bucket that is too large is split into narrower ones, which are
+// counted by scanning again.
+func PlanBuckets(scan func(visit func(docId int64, value float32) error) error) ([]compactionBucket, error) {
+	buckets := make([]compactionBucket, 0)
+	numVar := INITIAL_VAR_BITS
+	var splitting map[uint32]bool // prefixes (with splitVar variable bits) of the buckets being split; nil at first
+	splitVar := uint(0)
+	for {
+		counts := make(map[uint32]*compactionBucket)
+		err := scan(func(docId int64, value float32) error {
+			bits := math.Float32bits(value)
+			if splitting != nil && !splitting[bits>>splitVar] {
+				return nil
+			}
+			bucket, ok := counts[bits>>numVar]
+			if !ok {
+				bucket = &compactionBucket{numVariableBits: numVar, prefix: bits >> numVar, minVal: value, maxVal: value}
+				counts[bits>>numVar] = bucket
+			}
+			bucket.count += 1
+			bucket.minVal = Min(bucket.minVal, value)
+			bucket.maxVal = Max(bucket.maxVal, value)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		splitting, splitVar = make(map[uint32]bool), numVar
+		for prefix, bucket := range counts {
+			singleValued := bucket.minVal == bucket.maxVal
+			if numVar == 0 || singleValued || bucket.count <= MaxDocsForBucket(numVar) {
+				buckets = append(buckets, *bucket)
+			} else {
+				splitting[prefix] = true
+			}
+		}
+		if len(splitting) == 0 {
+			return buckets, nil
+		}
+		if numVar > 3 {
+			numVar -= 3
+		} else {
+			numVar = 0
+		}
+	}
+}
+
+// Flushes a file or directory to stable storage
+func SyncPath(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = fd.Sync()
+	closeErr := fd.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
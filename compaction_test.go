@@ -0,0 +1,108 @@
+package scoredb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+)
+
+func CountFiles(dir string) int {
+	entries, _ := ioutil.ReadDir(dir)
+	return len(entries)
+}
+
+func TestCompaction(t *testing.T) {
+	testdir := RmAllTestData()("compaction.1")
+	defer RmAllTestData()
+	fsDb := OpenFsScoreDb(t, testdir)
+	db := BaseDb{StreamingDb: BaseStreamingDb{fsDb}, IdDb: NewMemoryIdDb()}
+
+	// enough records in one bucket to force it to split into narrower (overlapping) buckets
+	numRecords := 40000
+	records := make([]Record, numRecords)
+	for i := 0; i < numRecords; i++ {
+		records[i] = Record{Id: fmt.Sprintf("r%d", i), Values: map[string]float32{"x": 1.0 + float32(i)/float32(numRecords)}}
+	}
+	err := db.BulkIndex(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !HasOverlappingBuckets(fsDb.fields["x"].files) {
+		t.Fatalf("Expected overlapping buckets before compaction")
+	}
+	err = db.Delete("r39999")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"r39998", "r39997", "r39996"}
+	CallAndCheck(db, t, expected, 3, []interface{}{"field", "x"})
+
+	// an in-flight query keeps reading the old generation
+	oldFiles := fsDb.fields["x"].files
+	inFlight := fsDb.FieldDocItr("x")
+	if !inFlight.Next(0) {
+		t.FailNow()
+	}
+
+	err = fsDb.CompactAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fieldFiles := fsDb.fields["x"]
+	if fieldFiles.generation != 1 || HasOverlappingBuckets(fieldFiles.files) {
+		t.Fatalf("Unexpected state after compaction: %+v", fieldFiles)
+	}
+	numDocs := int64(0)
+	for _, fileInfo := range fieldFiles.files {
+		numDocs += fileInfo.header.NumDocs
+	}
+	if numDocs != int64(numRecords-1) {
+		t.Fatalf("Expected deleted doc to be dropped; found %v docs", numDocs)
+	}
+	CallAndCheck(db, t, expected, 3, []interface{}{"field", "x"})
+
+	count := 1
+	for {
+		docId, _ := inFlight.Cur()
+		if !inFlight.Next(docId + 1) {
+			break
+		}
+		count += 1
+	}
+	if count != numRecords-1 {
+		t.Fatalf("In-flight query found %v docs", count)
+	}
+	if !Exists(oldFiles[0].path) {
+		t.Fatalf("Old generation was removed while still in use")
+	}
+	inFlight.Close()
+	if CountFiles(testdir+"/x") != 2 { // the GENERATION file and the gen.1 directory
+		t.Fatalf("Old generation was not removed; found %v files", CountFiles(testdir+"/x"))
+	}
+
+	// nothing more to do
+	err = fsDb.CompactAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsDb.fields["x"].generation != 1 {
+		t.FailNow()
+	}
+
+	// the new generation is used when reloading, and can be written to
+	reloadedFsDb := OpenFsScoreDb(t, testdir)
+	reloaded := BaseDb{StreamingDb: BaseStreamingDb{reloadedFsDb}, IdDb: db.IdDb}
+	CallAndCheck(reloaded, t, expected, 3, []interface{}{"field", "x"})
+	err = reloadedFsDb.CompactAll() // (the deletion was already compacted away before reloading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloadedFsDb.fields["x"].generation != 1 {
+		t.Fatalf("Compacted again after reloading: %+v", reloadedFsDb.fields["x"])
+	}
+	err = reloaded.Index("new", map[string]float32{"x": 1.99995})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CallAndCheck(reloaded, t, []string{"new", "r39998"}, 2, []interface{}{"field", "x"})
+}
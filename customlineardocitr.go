@@ -32,7 +32,8 @@ func ComputeCustomFunc(x float32, points []CustomPoint) float32 {
 	}
 }
 
-func (op *CustomLinearDocItr) Name() string { return "CustomLinearDocItr" }
+func (op *CustomLinearDocItr) Name() string       { return "CustomLinearDocItr" }
+func (op *CustomLinearDocItr) Children() []DocItr { return []DocItr{op.docItr} }
 func (op *CustomLinearDocItr) Cur() (int64, float32) {
 	docId, score := op.docItr.Cur()
 	return docId, ComputeCustomFunc(score, op.points)
@@ -61,6 +62,9 @@ func (op *CustomLinearDocItr) GetBounds() (min, max float32) {
 func (op *CustomLinearDocItr) Close() {
 	op.docItr.Close()
 }
+func (op *CustomLinearDocItr) Err() error {
+	return op.docItr.Err()
+}
 func (op *CustomLinearDocItr) Next(minId int64) bool {
 	return op.docItr.Next(minId)
 }
@@ -18,7 +18,8 @@ func (op *CustomMapDocItr) ComputeCustomFunc(val float32) float32 {
 	}
 }
 
-func (op *CustomMapDocItr) Name() string { return "CustomMapDocItr" }
+func (op *CustomMapDocItr) Name() string       { return "CustomMapDocItr" }
+func (op *CustomMapDocItr) Children() []DocItr { return []DocItr{op.docItr} }
 func (op *CustomMapDocItr) Cur() (int64, float32) {
 	docId, score := op.docItr.Cur()
 	return docId, op.ComputeCustomFunc(score)
@@ -38,6 +39,9 @@ func (op *CustomMapDocItr) GetBounds() (min, max float32) {
 func (op *CustomMapDocItr) Close() {
 	op.docItr.Close()
 }
+func (op *CustomMapDocItr) Err() error {
+	return op.docItr.Err()
+}
 func (op *CustomMapDocItr) Next(minId int64) bool {
 	return op.docItr.Next(minId)
 }
@@ -2,9 +2,14 @@ package scoredb
 
 import (
 	"container/heap"
-	"errors"
+	"context"
 	"fmt"
+	"io"
 	"math"
+	"os"
+	"path"
+	"sync"
+	"time"
 )
 
 type Query struct {
@@ -14,6 +19,25 @@ type Query struct {
 
 	// mixed, nested arrays of strings and numbers describing a function; for example: ["sum", ["field", "age"], ["field", "height"]]
 	Scorer []interface{}
+
+	// (optional) the same function, already built (see expr.go); when given, Scorer is ignored
+	Expr *Expr
+
+	// (optional) fields whose stored values should be returned with each result
+	Fields []string
+
+	// (optional) predicates that every result must satisfy; for example: [["range", "price", null, 20000], ["in", "color", [1, 3]]]
+	Filters []interface{}
+
+	// (optional) return how each result's score was computed
+	Explain bool
+
+	// (optional) return what work the query did
+	Profile bool
+
+	// (optional) when the query's context is cancelled (or its deadline passes), return the results found so far,
+	// rather than the context's error
+	AllowPartial bool
 }
 
 type DocScore struct {
@@ -27,56 +51,123 @@ type Record struct {
 }
 
 type QueryResult struct {
-	Ids    []string
-	Scores []float32
+	Ids          []string
+	Scores       []float32
+	Values       []map[string]float32 `json:",omitempty"` // only when Query.Fields is given; fields without a value are absent
+	Explanations []Explanation        `json:",omitempty"` // only when Query.Explain is set
+	Profile      *Profile             `json:",omitempty"` // only when Query.Profile is set
+	Partial      bool                 `json:",omitempty"` // the query was stopped early (see Query.AllowPartial)
 }
 
 // Three layers of database interfaces, each one wrapping the next:
 
 type Db interface { // Outermost interface; clients use this
-	BulkIndex(records []Record) error
+	BulkIndex(records []Record) error // records with ids that already exist replace the existing record
 	Index(id string, values map[string]float32) error
+	Delete(id string) error
 	Query(query Query) (QueryResult, error)
+	QueryContext(ctx context.Context, query Query) (QueryResult, error) // Query, but stops when the context is done
 }
 
 type StreamingDb interface { // Uses a DocItr based query, useful for middleware that alters or combines result streams
-	BulkIndex(records []map[string]float32) ([]int64, error)
-	QueryItr(Scorer []interface{}) (DocItr, error)
+	BulkIndex(clientIds []string, records []map[string]float32) ([]int64, error) // the client ids may be used to decide where records go
+	Delete(ids []int64) error
+	QueryItr(ctx context.Context, expr *Expr) (DocItr, error) // the context may stop iterators that work in the background
+	FieldValues(ids []int64, fields []string) ([]map[string]float32, error)
 }
 
 type DbBackend interface { // the minimal interface to implement storage (filesystem, memory, etc)
 	BulkIndex(records []map[string]float32) ([]int64, error)
+	Delete(ids []int64) error // deleted ids must never again be produced by FieldDocItr()
 	FieldDocItr(field string) DocItr
+	AllDocsItr() DocItr                                                     // every document that has not been deleted, each with a score of zero
+	FieldValues(ids []int64, fields []string) ([]map[string]float32, error) // may fail if the backend does not store values
 }
 
 type IdBackend interface { // stores a mapping from scoredb's identifiers to the clients'
-	Put(scoreIds []int64, clientIds []string) error
-	Get(scoreIds []int64) ([]string, error)
+	Put(scoreIds []int64, clientIds []string) error // also (re)points each client id at its new score id
+	Get(scoreIds []int64) ([]string, error)         // "" where a score id has no client id (yet, or any longer)
+	Lookup(clientIds []string) ([]int64, error)     // score ids for the given client ids, or -1 where unknown
+	Delete(clientIds []string) error
 }
 
 type BaseDb struct {
 	StreamingDb StreamingDb
 	IdDb        IdBackend
+
+	// (optional) held by each change, and by Snapshot(), so that only one runs at a time.
+	// Without it, changes must not be made concurrently (for instance, two updates to the same id could leave
+	// both versions in place), and snapshots may capture half of a change.
+	WriteLock *sync.Mutex
 }
 
 func (db BaseDb) BulkIndex(records []Record) error {
+	if db.WriteLock != nil {
+		db.WriteLock.Lock()
+		defer db.WriteLock.Unlock()
+	}
 	clientIds := make([]string, len(records))
 	values := make([]map[string]float32, len(records))
 	for idx, rec := range records {
 		values[idx] = rec.Values
 		clientIds[idx] = rec.Id
 	}
-	scoreIds, err := db.StreamingDb.BulkIndex(values)
+	// Updates are modeled as a delete of the old record plus an insert of the new one
+	existingIds, err := db.IdDb.Lookup(clientIds)
+	if err != nil {
+		return err
+	}
+	scoreIds, err := db.StreamingDb.BulkIndex(clientIds, values)
+	if err != nil {
+		return err
+	}
+	err = db.IdDb.Put(scoreIds, clientIds)
 	if err != nil {
 		return err
 	}
-	return db.IdDb.Put(scoreIds, clientIds)
+	staleIds := make([]int64, 0)
+	for _, scoreId := range existingIds {
+		if scoreId != -1 {
+			staleIds = append(staleIds, scoreId)
+		}
+	}
+	// the same id may appear more than once in a batch; the last one wins
+	lastIndexOf := make(map[string]int, len(clientIds))
+	for idx, clientId := range clientIds {
+		if prevIdx, ok := lastIndexOf[clientId]; ok {
+			staleIds = append(staleIds, scoreIds[prevIdx])
+		}
+		lastIndexOf[clientId] = idx
+	}
+	if len(staleIds) == 0 {
+		return nil
+	}
+	return db.StreamingDb.Delete(staleIds)
 }
 
 func (db BaseDb) Index(id string, values map[string]float32) error {
 	return db.BulkIndex([]Record{Record{Id: id, Values: values}})
 }
 
+func (db BaseDb) Delete(id string) error {
+	if db.WriteLock != nil {
+		db.WriteLock.Lock()
+		defer db.WriteLock.Unlock()
+	}
+	scoreIds, err := db.IdDb.Lookup([]string{id})
+	if err != nil {
+		return err
+	}
+	if scoreIds[0] == -1 { // deleting an unknown id is not an error
+		return nil
+	}
+	err = db.StreamingDb.Delete(scoreIds)
+	if err != nil {
+		return err
+	}
+	return db.IdDb.Delete([]string{id})
+}
+
 func CandidateIsLess(r1, r2 DocScore) bool {
 	s1, s2 := r1.Score, r2.Score
 	if s1 < s2 {
@@ -105,62 +196,180 @@ func (h *BaseDbResultSet) Pop() interface{} {
 }
 
 func (db BaseDb) Query(query Query) (QueryResult, error) {
-	itr, err := db.StreamingDb.QueryItr(query.Scorer)
+	return db.QueryContext(context.Background(), query)
+}
+
+// Checks for cancellation between each candidate; once the context is done, returns its error
+// (or, with Query.AllowPartial, the results found so far)
+func (db BaseDb) QueryContext(ctx context.Context, query Query) (QueryResult, error) {
+	expr, err := query.ToExpr()
 	if err != nil {
 		return QueryResult{}, err
 	}
-	minScore, offset, limit := query.MinScore, query.Offset, query.Limit
+	offset, limit := query.Offset, query.Limit
 	if limit == 0 { // we short circuit this case because the code below assumes at least one result
-		return QueryResult{Ids: []string{}}, nil
+		itr, err := db.StreamingDb.QueryItr(ctx, expr)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		itr.Close()
+		return QueryResult{Ids: []string{}}, itr.Err()
+	}
+	// Documents without a client id belong to a change that is still being made (or to one that failed partway);
+	// they are dropped before the offset and limit apply, and the query is run again with room for as many more
+	// candidates if that left the page short.
+	for extra := 0; ; {
+		top, err := db.topDocs(ctx, query, expr, offset+limit+extra)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		ids := make([]int64, len(top.candidates))
+		for idx, candidate := range top.candidates {
+			ids[idx] = candidate.DocId
+		}
+		clientIds, err := db.IdDb.Get(ids)
+		if err != nil {
+			return QueryResult{}, err
+		}
+		kept := make([]int, 0, len(ids))
+		for idx, clientId := range clientIds {
+			if clientId != "" {
+				kept = append(kept, idx)
+			}
+		}
+		numDropped := len(ids) - len(kept)
+		exhausted := len(ids) < offset+limit+extra // (there were no more candidates to be had)
+		if numDropped > 0 && !exhausted && !top.partial && len(kept) < offset+limit {
+			extra += numDropped
+			continue
+		}
+		if offset > len(kept) {
+			offset = len(kept)
+		}
+		kept = kept[offset:]
+		if len(kept) > limit {
+			kept = kept[:limit]
+		}
+		return db.makeResult(query, top, kept, ids, clientIds)
 	}
+}
+
+// The best candidates for a query, from best to worst
+type topDocs struct {
+	candidates   []DocScore
+	explanations map[int64]Explanation // (only when explaining)
+	profile      *Profile              // (only when profiling)
+	partial      bool
+}
+
+// Finds (at most) the numResults best candidates
+func (db BaseDb) topDocs(ctx context.Context, query Query, expr *Expr, numResults int) (topDocs, error) {
+	itr, err := db.StreamingDb.QueryItr(ctx, expr)
+	if err != nil {
+		return topDocs{}, err
+	}
+	minScore := query.MinScore
 	//fmt.Printf("> %+v\n", query);
-	numResults := offset + limit
+	topK, watchesContext := itr.(TopKDocItr)
+	if watchesContext {
+		topK.SetTopK(numResults, query.Explain)
+	}
 	resultData := make(BaseDbResultSet, 0, numResults+1)
 	results := &resultData
 	heap.Init(results)
 	minCandidate := DocScore{Score: float32(math.Inf(-1))}
 	maxScore := float32(math.Inf(1))
+	explanations := make(map[int64]Explanation) // (only when explaining) for each candidate in the heap
+	profile := &Profile{}
+	startTime := time.Now()
+	done := ctx.Done()
+	if watchesContext { // (it produces what it has found, then stops)
+		done = nil
+	}
+	stopped := false
 	docId := int64(-1)
 	var score float32
-	for itr.Next(docId + 1) {
+	for !stopped && itr.Next(docId+1) {
+		select {
+		case <-done:
+			stopped = true
+		default:
+		}
 		docId, score = itr.Cur()
+		profile.Candidates++
 		if score < minScore {
 			continue
 		}
 		candidate := DocScore{DocId: docId, Score: score}
 		if CandidateIsLess(minCandidate, candidate) {
 			heap.Push(results, candidate)
+			if query.Explain {
+				explanations[docId] = Explain(itr)
+			}
 			if results.Len() > numResults {
-				heap.Pop(results)
+				delete(explanations, heap.Pop(results).(DocScore).DocId)
 				minCandidate = resultData[0]
 				itr.SetBounds(minCandidate.Score, maxScore)
+				if query.Profile {
+					profile.Timeline = append(profile.Timeline, ProfilePoint{
+						Elapsed:    time.Since(startTime),
+						Candidates: profile.Candidates,
+						MinScore:   minCandidate.Score,
+					})
+				}
 			}
 		}
 	}
 	itr.Close()
-
-	for offset > 0 && len(resultData) > 0 {
-		heap.Pop(results)
-		offset -= 1
+	err = itr.Err()
+	if err == nil && stopped {
+		err = ctx.Err()
+	}
+	partial := err != nil && err == ctx.Err() && query.AllowPartial
+	if err != nil && !partial {
+		return topDocs{}, err
+	}
+	top := topDocs{candidates: make([]DocScore, results.Len()), explanations: explanations, partial: partial}
+	if query.Profile {
+		profile.Elapsed = time.Since(startTime)
+		profile.Fields = ProfileFields(itr)
+		top.profile = profile
+	}
+	for idx := len(top.candidates) - 1; idx >= 0; idx-- {
+		top.candidates[idx] = heap.Pop(results).(DocScore)
 	}
+	return top, nil
+}
 
-	numResults = results.Len()
-	var resultIds = make([]int64, numResults)
-	var resultScores = make([]float32, numResults)
-	for idx, _ := range resultIds {
-		rec := heap.Pop(results).(DocScore)
-		i := numResults - (idx + 1)
-		resultIds[i] = rec.DocId
-		resultScores[i] = rec.Score
+// Builds the result from the candidates at the given indexes
+func (db BaseDb) makeResult(query Query, top topDocs, indexes []int, ids []int64, clientIds []string) (QueryResult, error) {
+	numResults := len(indexes)
+	resultIds := make([]int64, numResults)
+	result := QueryResult{Ids: make([]string, numResults), Scores: make([]float32, numResults), Partial: top.partial}
+	for idx, candidateIdx := range indexes {
+		resultIds[idx] = ids[candidateIdx]
+		result.Ids[idx] = clientIds[candidateIdx]
+		result.Scores[idx] = top.candidates[candidateIdx].Score
 	}
 	//fmt.Printf("< %+v\n", resultIds);
-	//fmt.Printf("< %+v\n", resultScores);
-
-	clientIds, err := db.IdDb.Get(resultIds)
-	if err != nil {
-		return QueryResult{}, err
+	//fmt.Printf("< %+v\n", result.Scores);
+	if query.Profile {
+		result.Profile = top.profile
+	}
+	if query.Explain {
+		result.Explanations = make([]Explanation, numResults)
+		for idx, docId := range resultIds {
+			result.Explanations[idx] = top.explanations[docId]
+		}
+	}
+	if len(query.Fields) > 0 {
+		var err error
+		result.Values, err = db.StreamingDb.FieldValues(resultIds, query.Fields)
+		if err != nil {
+			return QueryResult{}, err
+		}
 	}
-	return QueryResult{Ids: clientIds, Scores: resultScores}, nil
+	return result, nil
 }
 
 func ToFloat32(val interface{}) (float32, error) {
@@ -170,33 +379,62 @@ func ToFloat32(val interface{}) (float32, error) {
 	case float64:
 		return float32(typed), nil
 	default:
-		return 0.0, errors.New(fmt.Sprintf("Invalid value ('%s') given, must be floating point number", val))
+		return 0.0, fmt.Errorf("Invalid value ('%v') given, must be floating point number", val)
 	}
 }
 
-func ToXyPoints(input interface{}) ([]CustomPoint, error) {
-	switch inputPoints := input.(type) {
-	case []interface{}:
-		points := make([]CustomPoint, len(inputPoints))
-		for idx, inputPoint := range inputPoints {
-			pair := inputPoint.([]interface{})
-			if len(pair) != 2 {
-				return nil, fmt.Errorf("Invalid (x,y) point; found: '%v' instead", pair)
-			}
-			xPoint, err := ToFloat32(pair[0])
-			if err != nil {
-				return nil, err
-			}
-			yPoint, err := ToFloat32(pair[1])
-			if err != nil {
-				return nil, err
-			}
-			points[idx] = CustomPoint{xPoint, yPoint}
-		}
-		return points, nil
-	default:
-		return nil, fmt.Errorf("Expected array of (x,y) points; found: '%v' instead", input)
+// Converts an (optional) JSON number into a bound, using the given value (an infinity) for null
+func ToBound(val interface{}, unbounded float32) (float32, error) {
+	if val == nil {
+		return unbounded, nil
+	}
+	return ToFloat32(val)
+}
+
+// Copies the StreamingDb to dest, and the ids to dest/iddb (the layout that the scoredb command uses)
+func (db BaseDb) Snapshot(dest string) error {
+	streamingDb, ok := db.StreamingDb.(SnapshottingDb)
+	if !ok {
+		return fmt.Errorf("%T does not support snapshots", db.StreamingDb)
+	}
+	idDb, ok := db.IdDb.(SnapshottingDb)
+	if !ok {
+		return fmt.Errorf("%T does not support snapshots", db.IdDb)
+	}
+	if Exists(dest) {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	if db.WriteLock != nil {
+		db.WriteLock.Lock()
+		defer db.WriteLock.Unlock()
+	}
+	err := streamingDb.Snapshot(dest)
+	if err == nil {
+		err = idDb.Snapshot(path.Join(dest, "iddb"))
+	}
+	if err != nil {
+		os.RemoveAll(dest)
 	}
+	return err
+}
+
+// Closes the StreamingDb and the ids, once nothing is using them
+func (db BaseDb) Close() error {
+	err := CloseIfCloser(db.StreamingDb)
+	idErr := CloseIfCloser(db.IdDb)
+	if err != nil {
+		return err
+	}
+	return idErr
+}
+
+// Closes anything (a Db, StreamingDb, DbBackend, or IdBackend) that holds resources; others need no closing
+func CloseIfCloser(db interface{}) error {
+	closer, ok := db.(io.Closer)
+	if !ok {
+		return nil
+	}
+	return closer.Close()
 }
 
 // BaseStreamingDb : The usual way to bridge a StreamingDb to a DbBackend
@@ -205,190 +443,148 @@ type BaseStreamingDb struct {
 	Backend DbBackend
 }
 
-func (db BaseStreamingDb) BulkIndex(records []map[string]float32) ([]int64, error) {
+func (db BaseStreamingDb) BulkIndex(clientIds []string, records []map[string]float32) ([]int64, error) {
 	return db.Backend.BulkIndex(records)
 }
 
-func (db BaseStreamingDb) QueryItr(scorer []interface{}) (DocItr, error) {
-	args := scorer[1:]
-	switch scorer[0].(string) {
-	case "sum":
-		fieldItrs := make([]DocItr, len(args))
-		for idx, v := range args {
-			itr, err := db.QueryItr(v.([]interface{}))
-			if err != nil {
-				return nil, err
-			}
-			fieldItrs[idx] = itr
-		}
-		return NewSumDocItr(fieldItrs), nil
-	case "product":
-		fieldItrs := make([]DocItr, len(args))
-		for idx, v := range args {
-			itr, err := db.QueryItr(v.([]interface{}))
+func (db BaseStreamingDb) Delete(ids []int64) error {
+	return db.Backend.Delete(ids)
+}
+
+func (db BaseStreamingDb) FieldValues(ids []int64, fields []string) ([]map[string]float32, error) {
+	return db.Backend.FieldValues(ids, fields)
+}
+
+func (db BaseStreamingDb) Snapshot(dest string) error {
+	backend, ok := db.Backend.(SnapshottingDb)
+	if !ok {
+		return fmt.Errorf("%T does not support snapshots", db.Backend)
+	}
+	return backend.Snapshot(dest)
+}
+
+func (db BaseStreamingDb) Close() error {
+	return CloseIfCloser(db.Backend)
+}
+
+func (db BaseStreamingDb) QueryItr(ctx context.Context, expr *Expr) (DocItr, error) {
+	// the iterators of each sub-expression; on failure, those already opened are closed
+	argItrs := func() ([]DocItr, error) {
+		itrs := make([]DocItr, len(expr.Args))
+		for idx, arg := range expr.Args {
+			itr, err := db.QueryItr(ctx, arg)
 			if err != nil {
+				for _, prev := range itrs[:idx] {
+					prev.Close()
+				}
 				return nil, err
 			}
-			fieldItrs[idx] = itr
+			itrs[idx] = itr
 		}
-		return NewProductDocItr(fieldItrs), nil
-	case "min":
-		fieldItrs := make([]DocItr, len(args))
-		for idx, v := range args {
-			itr, err := db.QueryItr(v.([]interface{}))
-			if err != nil {
-				return nil, err
-			}
-			fieldItrs[idx] = itr
+		return itrs, nil
+	}
+	switch expr.Op {
+	case "field":
+		itr := db.Backend.FieldDocItr(expr.Fields[0])
+		if len(expr.Values) == 0 {
+			return itr, nil
 		}
-		return NewMinDocItr(fieldItrs), nil
-	case "scale":
-		if len(args) != 2 {
-			return nil, errors.New("Wrong number of arguments to scale function")
+		return NewDefaultDocItr(expr.Values[0], itr, db.Backend.AllDocsItr()), nil
+	case "const": // (every document has the value)
+		return &OffsetDocItr{expr.Values[0], db.Backend.AllDocsItr()}, nil
+	case "geo_distance":
+		latField, lngField := expr.Fields[0], expr.Fields[1]
+		return NewGeoDistanceDocItr(expr.Values[0], expr.Values[1], db.Backend.FieldDocItr(latField), db.Backend.FieldDocItr(lngField), db.Backend.FieldDocItr(lngField)), nil
+	case "geo_within":
+		latField, lngField := expr.Fields[0], expr.Fields[1]
+		itr := NewGeoDistanceDocItr(expr.Values[0], expr.Values[1], db.Backend.FieldDocItr(latField), db.Backend.FieldDocItr(lngField), db.Backend.FieldDocItr(lngField))
+		itr.SetBounds(0.0, expr.Values[2])
+		return itr, nil
+	case "geo_box":
+		south, west, north, east := expr.Values[0], expr.Values[1], expr.Values[2], expr.Values[3]
+		var lngItr DocItr
+		if west <= east {
+			lngItr = NewPredicateDocItr(db.Backend.FieldDocItr(expr.Fields[1]), west, east, nil)
+		} else { // (the box crosses the antimeridian)
+			lngItr = NewMaxDocItr([]DocItr{
+				NewPredicateDocItr(db.Backend.FieldDocItr(expr.Fields[1]), west, 180.0, nil),
+				NewPredicateDocItr(db.Backend.FieldDocItr(expr.Fields[1]), -180.0, east, nil),
+			})
 		}
-		itr, err := db.QueryItr(args[1].([]interface{}))
-		if err != nil {
-			return nil, err
+		latItr := NewPredicateDocItr(db.Backend.FieldDocItr(expr.Fields[0]), south, north, nil)
+		return NewFilterDocItr(latItr, []DocItr{lngItr}), nil
+	case "range", "eq":
+		min, max := expr.Values[0], expr.Values[len(expr.Values)-1]
+		return NewPredicateDocItr(db.Backend.FieldDocItr(expr.Fields[0]), min, max, nil), nil
+	case "in":
+		values := make(map[float32]bool)
+		min, max := PositiveInfinity, NegativeInfinity
+		for _, value := range expr.Values {
+			values[value] = true
+			min, max = Min(min, value), Max(max, value)
 		}
-		weight := args[0]
-		switch typed := weight.(type) {
-		case float32:
-			return &ScaleDocItr{typed, itr}, nil
-		case float64:
-			return &ScaleDocItr{float32(typed), itr}, nil
-		default:
-			return nil, errors.New(fmt.Sprintf("Invalid weight ('%s') given to scale function, must be floating point number", weight))
+		return NewPredicateDocItr(db.Backend.FieldDocItr(expr.Fields[0]), min, max, values), nil
+	}
+
+	itrs, err := argItrs()
+	if err != nil {
+		return nil, err
+	}
+	switch expr.Op {
+	case "sum":
+		return NewSumDocItr(itrs), nil
+	case "product":
+		return NewProductDocItr(itrs), nil
+	case "min":
+		return NewMinDocItr(itrs), nil
+	case "max":
+		return NewMaxDocItr(itrs), nil
+	case "filter":
+		return NewFilterDocItr(itrs[0], itrs[1:]), nil
+	case "scale":
+		return &ScaleDocItr{expr.Values[0], itrs[0]}, nil
+	case "offset":
+		return &OffsetDocItr{expr.Values[0], itrs[0]}, nil
+	case "log", "log1p", "sigmoid", "tanh":
+		return NewMonotonicDocItr(expr.Op, itrs[0]), nil
+	case "clamp":
+		return NewClampDocItr(expr.Values[0], expr.Values[1], itrs[0]), nil
+	case "gauss", "exp", "linear":
+		if len(expr.Values) == 0 { // (the exponential function, rather than exponential decay)
+			return NewMonotonicDocItr(expr.Op, itrs[0]), nil
 		}
+		return NewDecayDocItr(expr.Op, expr.Values[0], expr.Values[1], expr.Values[2], expr.Values[3], itrs[0]), nil
 	case "diff":
-		if len(args) != 2 {
-			return nil, errors.New("Wrong number of arguments to diff function")
-		}
-		target, err := ToFloat32(args[0])
-		if err != nil {
-			return nil, err
-		}
-		itr, err := db.QueryItr(args[1].([]interface{}))
-		if err != nil {
-			return nil, err
-		}
 		return &DiffDocItr{
-			target: target,
-			itr:    itr,
+			target: expr.Values[0],
+			itr:    itrs[0],
 		}, nil
 	case "pow":
-		if len(args) != 2 {
-			return nil, errors.New("Wrong number of arguments to pow function")
-		}
-		exp, err := ToFloat32(args[1])
-		if err != nil {
-			return nil, err
-		}
-		itr, err := db.QueryItr(args[0].([]interface{}))
-		if err != nil {
-			return nil, err
-		}
 		return &PowDocItr{
-			itr: itr,
-			exp: exp,
+			itr: itrs[0],
+			exp: expr.Values[0],
 		}, nil
-
 	case "custom_map":
-		if len(args) != 3 {
-			return nil, errors.New("Wrong number of arguments to custom_map function")
-		}
-
-		points, err := ToXyPoints(args[0])
-		if err != nil {
-			return nil, err
-		}
-
-		deflt, err := ToFloat32(args[1])
-		if err != nil {
-			return nil, err
-		}
-
-		itr, err := db.QueryItr(args[2].([]interface{}))
-		if err != nil {
-			return nil, err
-		}
-
 		scoremap := make(map[float32]float32)
-		for _, pt := range points {
+		for _, pt := range expr.Points {
 			scoremap[pt.X] = pt.Y
 		}
 		return &CustomMapDocItr{
 			points: scoremap,
-			deflt:  deflt,
-			docItr: itr,
+			deflt:  expr.Values[0],
+			docItr: itrs[0],
 		}, nil
-
 	case "custom_linear":
-		if len(args) != 2 {
-			return nil, errors.New("Wrong number of arguments to custom_linear function")
-		}
-
-		inputPoints := args[0].([]interface{})
-		points := make([]CustomPoint, len(inputPoints))
-		for idx, inputPoint := range inputPoints {
-			pair := inputPoint.([]interface{})
-			if len(pair) != 2 {
-				return nil, fmt.Errorf("Invalid (x,y) point in custom_linear; found: '%v' instead", pair)
-			}
-			xPoint, err := ToFloat32(pair[0])
-			if err != nil {
-				return nil, err
-			}
-			yPoint, err := ToFloat32(pair[1])
-			if err != nil {
-				return nil, err
-			}
-			points[idx] = CustomPoint{xPoint, yPoint}
-		}
-
-		itr, err := db.QueryItr(args[1].([]interface{}))
-		if err != nil {
-			return nil, err
-		}
-
 		return &CustomLinearDocItr{
-			points: points,
-			docItr: itr,
+			points: expr.Points,
+			docItr: itrs[0],
 		}, nil
-
-	case "geo_distance":
-		if len(args) != 4 {
-			return nil, errors.New("Wrong number of arguments to geo_distance function")
-		}
-		lat, err := ToFloat32(args[0])
-		if err != nil {
-			return nil, err
-		}
-		lng, err := ToFloat32(args[1])
-		if err != nil {
-			return nil, err
-		}
-		latFieldName := args[2].(string)
-		lngFieldName := args[3].(string)
-		latItr := &DiffDocItr{target: lat, itr: db.Backend.FieldDocItr(latFieldName)}
-		lngItr := &DiffDocItr{target: lng, itr: db.Backend.FieldDocItr(lngFieldName)}
-		// bias longitude distances by approximate latitude (matters less at poles)
-		multiplier := float32(math.Cos(float64(lat) * math.Pi / 180.0))
-		biasedLngItr := &ScaleDocItr{multiplier, lngItr}
-		// square each component
-		latSquaredItr := NewPowDocItr(latItr, 2.0)
-		lngSquaredItr := NewPowDocItr(biasedLngItr, 2.0)
-		// sum and square root
-		distanceItr := NewPowDocItr(NewSumDocItr([]DocItr{latSquaredItr, lngSquaredItr}), 0.5)
-		// convert degrees distance to radians and multiply by radius of the earth (in km)
-		earthRadius := float32(6371.0 * math.Pi / 180.0)
-		return &ScaleDocItr{earthRadius, distanceItr}, nil
-	case "field":
-		if len(args) != 1 {
-			return nil, errors.New("Wrong number of arguments to field function")
-		}
-		key := args[0].(string)
-		return db.Backend.FieldDocItr(key), nil
+	case "default":
+		return NewDefaultDocItr(expr.Values[0], itrs[0], db.Backend.AllDocsItr()), nil
 	default:
-		return nil, errors.New(fmt.Sprintf("Scoring function '%s' is not recognized", scorer[0]))
+		for _, itr := range itrs {
+			itr.Close()
+		}
+		return nil, fmt.Errorf("Scoring function '%s' is not recognized", expr.Op)
 	}
 }
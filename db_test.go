@@ -1,11 +1,14 @@
 package scoredb
 
 import (
+	"context"
 	"fmt"
 	"math"
 	"os"
 	"path"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -65,9 +68,24 @@ func DbBasicsTest(db Db, t *testing.T) {
 	CallAndCheck(db, t, []string{"r1", "r3", "r2"}, 3, []interface{}{"product",
 		[]interface{}{"field", "age"},
 		[]interface{}{"field", "height"}})
+	CallAndCheck(db, t, []string{"r1", "r2", "r3"}, 3, []interface{}{"product",
+		[]interface{}{"offset", -15.0, []interface{}{"field", "age"}},
+		[]interface{}{"field", "height"}})
+	CallAndCheck(db, t, []string{"r3", "r1", "r2"}, 3, []interface{}{"product",
+		[]interface{}{"const", 2.0},
+		[]interface{}{"field", "height"}})
+	CallAndCheck(db, t, []string{"r3", "r2", "r1"}, 3, []interface{}{"sum",
+		[]interface{}{"const", 100.0},
+		[]interface{}{"scale", -1.0, []interface{}{"field", "age"}}})
 	CallAndCheck(db, t, []string{"r3", "r1", "r2"}, 3, []interface{}{"min",
 		[]interface{}{"field", "age"},
 		[]interface{}{"field", "height"}})
+	CallAndCheck(db, t, []string{"r1", "r2", "r3"}, 3, []interface{}{"max",
+		[]interface{}{"field", "age"},
+		[]interface{}{"field", "height"}})
+	CallAndCheck(db, t, []string{"r3", "r1"}, 2, []interface{}{"max",
+		[]interface{}{"scale", 0.1, []interface{}{"field", "age"}},
+		[]interface{}{"scale", 2.0, []interface{}{"field", "height"}}})
 	CallAndCheck(db, t, []string{"r1", "r2", "r3"}, 3, []interface{}{"custom_linear",
 		[]interface{}{ // scores by closeness to age 30:
 			[]interface{}{float32(0), float32(0.0)},
@@ -75,7 +93,44 @@ func DbBasicsTest(db Db, t *testing.T) {
 			[]interface{}{float32(100), float32(0.0)}},
 		[]interface{}{"field", "age"}})
 	CallAndCheck(db, t, []string{"r3", "r2", "r1"}, 3, []interface{}{"geo_distance", 45.0, -69.9, "lat", "lon"})
-	CallAndCheck(db, t, []string{"r3", "r1", "r2"}, 3, []interface{}{"geo_distance", 20.0, 70.0, "lat", "lon"})
+	CallAndCheck(db, t, []string{"r3", "r2", "r1"}, 3, []interface{}{"geo_distance", 20.0, 70.0, "lat", "lon"})
+}
+
+func DbDeleteTest(db Db, t *testing.T) {
+	db.Index("d1", map[string]float32{"age": 10, "height": 1.0})
+	db.Index("d2", map[string]float32{"age": 20, "height": 2.0})
+	db.Index("d3", map[string]float32{"age": 30, "height": 3.0})
+	CallAndCheck(db, t, []string{"d3", "d2", "d1"}, 3, []interface{}{"field", "age"})
+
+	err := db.Delete("d3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	CallAndCheck(db, t, []string{"d2", "d1"}, 3, []interface{}{"field", "age"})
+
+	// deleting an unknown id is a no-op
+	err = db.Delete("d4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// update d1 so that it now has the highest age
+	err = db.Index("d1", map[string]float32{"age": 40, "height": 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CallAndCheck(db, t, []string{"d1", "d2"}, 3, []interface{}{"field", "age"})
+	CallAndCheck(db, t, []string{"d2", "d1"}, 3, []interface{}{"field", "height"})
+
+	// within a batch, the last record for an id wins
+	err = db.BulkIndex([]Record{
+		Record{Id: "d2", Values: map[string]float32{"age": 50, "height": 5.0}},
+		Record{Id: "d2", Values: map[string]float32{"age": 5, "height": 0.1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CallAndCheck(db, t, []string{"d1", "d2"}, 3, []interface{}{"field", "age"})
 }
 
 func RmAllTestData() func(name string) string {
@@ -96,3 +151,280 @@ func RmAllTestData() func(name string) string {
 		return fullname
 	}
 }
+
+func DbFieldValuesTest(db Db, t *testing.T) {
+	db.Index("v1", map[string]float32{"age": 10, "height": 1.0})
+	db.Index("v2", map[string]float32{"age": 20})
+	db.Index("v3", map[string]float32{"height": 3.0})
+	db.Index("v1", map[string]float32{"age": 40, "height": 4.0}) // the stored values are replaced too
+
+	result, err := db.Query(Query{Limit: 3, Scorer: []interface{}{"field", "age"}, Fields: []string{"age", "height", "weight"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]float32{
+		map[string]float32{"age": 40, "height": 4.0},
+		map[string]float32{"age": 20},
+	}
+	if !reflect.DeepEqual(result.Ids, []string{"v1", "v2"}) || !reflect.DeepEqual(result.Values, expected) {
+		t.Fatalf("expected: %v found: %v", expected, result)
+	}
+
+	// values are omitted unless requested
+	result, err = db.Query(Query{Limit: 3, Scorer: []interface{}{"field", "height"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Values != nil {
+		t.Fatalf("Unexpected values: %v", result)
+	}
+}
+
+func DbDefaultsTest(db Db, t *testing.T) {
+	db.Index("m1", map[string]float32{"age": 30, "height": 2.0})
+	db.Index("m2", map[string]float32{"age": 20})
+	db.Index("m3", map[string]float32{"height": 3.0})
+	db.Index("m4", map[string]float32{"age": 10, "height": 1.0})
+
+	// without defaults, only documents with every field can be returned
+	CallAndCheck(db, t, []string{"m1", "m4"}, 4, []interface{}{"sum",
+		[]interface{}{"field", "age"},
+		[]interface{}{"field", "height"}})
+	CallAndCheck(db, t, []string{"m1", "m2", "m4", "m3"}, 4, []interface{}{"sum",
+		[]interface{}{"field", "age", 0.0},
+		[]interface{}{"field", "height", 0.0}})
+	CallAndCheck(db, t, []string{"m3", "m1"}, 2, []interface{}{"default", 100.0, []interface{}{"field", "age"}})
+	CallAndCheck(db, t, []string{"m4", "m2", "m1", "m3"}, 4, []interface{}{"scale", -1.0, []interface{}{"field", "age", 50.0}})
+
+	// once the worst candidate beats the default, documents without the field are skipped
+	CallAndCheck(db, t, []string{"m3", "m1"}, 2, []interface{}{"field", "height", -5.0})
+
+	// max produces documents that have either field
+	CallAndCheck(db, t, []string{"m1", "m2", "m4", "m3"}, 4, []interface{}{"max",
+		[]interface{}{"field", "age"},
+		[]interface{}{"field", "height"}})
+
+	// deleted documents do not get the default
+	db.Delete("m3")
+	CallAndCheck(db, t, []string{"m1", "m2", "m4"}, 4, []interface{}{"default", 100.0, []interface{}{"field", "age"}})
+}
+
+func CallAndCheckFiltered(db Db, t *testing.T, r1 []string, scorer []interface{}, filters []interface{}) {
+	r2, err := db.Query(Query{Limit: 10, Scorer: scorer, Filters: filters})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r1, r2.Ids) {
+		t.Fatalf("expected: %v found: %v", r1, r2)
+	}
+}
+
+func DbFiltersTest(db Db, t *testing.T) {
+	db.Index("c1", map[string]float32{"price": 15000, "year": 2016, "color": 1})
+	db.Index("c2", map[string]float32{"price": 25000, "year": 2018, "color": 2})
+	db.Index("c3", map[string]float32{"price": 9000, "year": 2012, "color": 3})
+	db.Index("c4", map[string]float32{"price": 19000, "year": 2015, "color": 3})
+	db.Index("c5", map[string]float32{"price": 12000, "color": 1})
+
+	byYear := []interface{}{"field", "year"}
+	CallAndCheckFiltered(db, t, []string{"c2", "c1", "c4", "c3"}, byYear, []interface{}{})
+	CallAndCheckFiltered(db, t, []string{"c1", "c4"}, byYear, []interface{}{
+		[]interface{}{"range", "price", nil, 20000.0},
+		[]interface{}{"range", "year", 2015.0, nil}})
+	CallAndCheckFiltered(db, t, []string{"c4", "c3"}, byYear, []interface{}{[]interface{}{"eq", "color", 3.0}})
+	CallAndCheckFiltered(db, t, []string{"c2", "c1"}, byYear, []interface{}{[]interface{}{"in", "color", []interface{}{1.0, 2.0}}})
+	CallAndCheckFiltered(db, t, []string{}, byYear, []interface{}{[]interface{}{"in", "color", []interface{}{}}})
+
+	// filtering on a field that the scorer does not use, for documents that lack a scoring field
+	CallAndCheckFiltered(db, t, []string{"c1", "c5"}, []interface{}{"field", "year", 0.0}, []interface{}{[]interface{}{"eq", "color", 1.0}})
+
+	// geographic predicates
+	db.Index("nyc", map[string]float32{"lat": 40.7, "lng": -74.0, "pop": 8.3})
+	db.Index("newark", map[string]float32{"lat": 40.7, "lng": -74.2, "pop": 0.3})
+	db.Index("philly", map[string]float32{"lat": 39.95, "lng": -75.17, "pop": 1.6})
+	db.Index("boston", map[string]float32{"lat": 42.36, "lng": -71.06, "pop": 0.7})
+	db.Index("sydney", map[string]float32{"lat": -33.9, "lng": 151.2, "pop": 5.3})
+	db.Index("suva", map[string]float32{"lat": -18.1, "lng": 178.4, "pop": 0.09})
+	db.Index("apia", map[string]float32{"lat": -13.8, "lng": -171.8, "pop": 0.04})
+	byPop := []interface{}{"field", "pop"}
+	CallAndCheckFiltered(db, t, []string{"nyc", "newark"}, byPop, []interface{}{[]interface{}{"geo_within", 40.7, -74.0, 50.0, "lat", "lng"}})
+	CallAndCheckFiltered(db, t, []string{"nyc", "philly", "newark"}, byPop, []interface{}{[]interface{}{"geo_within", 40.7, -74.0, 150.0, "lat", "lng"}})
+	CallAndCheckFiltered(db, t, []string{"suva", "apia"}, byPop, []interface{}{[]interface{}{"geo_within", -16.0, 179.9, 1000.0, "lat", "lng"}})
+	CallAndCheckFiltered(db, t, []string{"nyc", "philly", "newark"}, byPop, []interface{}{[]interface{}{"geo_box", 39.0, -76.0, 41.0, -73.0, "lat", "lng"}})
+	CallAndCheckFiltered(db, t, []string{"suva", "apia"}, byPop, []interface{}{[]interface{}{"geo_box", -25.0, 170.0, -10.0, -170.0, "lat", "lng"}})
+	CallAndCheckFiltered(db, t, []string{"nyc"}, byPop, []interface{}{
+		[]interface{}{"geo_box", 39.0, -76.0, 41.0, -73.0, "lat", "lng"},
+		[]interface{}{"geo_within", 40.7, -74.0, 10.0, "lat", "lng"}})
+
+	_, err := db.Query(Query{Limit: 10, Scorer: byYear, Filters: []interface{}{[]interface{}{"like", "color", 1.0}}})
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown predicate")
+	}
+}
+
+func DbExplainTest(db Db, t *testing.T) {
+	db.Index("e1", map[string]float32{"age": 30, "height": 2.0})
+	db.Index("e2", map[string]float32{"age": 20})
+	db.Index("e3", map[string]float32{"height": 1.0})
+
+	scorer := []interface{}{"max", []interface{}{"field", "age"}, []interface{}{"scale", 10.0, []interface{}{"field", "height"}}}
+	result, err := db.Query(Query{Limit: 3, Scorer: scorer, Explain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Ids, []string{"e1", "e2", "e3"}) || len(result.Explanations) != 3 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	explanations := make([]Explanation, 3)
+	for idx, explanation := range result.Explanations {
+		if explanation.Name == "ParallelDocItr" { // sharded databases explain the shard's iterators
+			explanation = explanation.Children[0]
+		}
+		if explanation.Name != "MaxDocItr" || explanation.Score != result.Scores[idx] {
+			t.Fatalf("unexpected explanation: %+v for score %v", explanation, result.Scores[idx])
+		}
+		explanations[idx] = explanation
+	}
+
+	// e1 has both scores
+	if len(explanations[0].Children) != 2 {
+		t.Fatalf("unexpected explanation: %+v", explanations[0])
+	}
+	for _, child := range explanations[0].Children {
+		if child.Field == "age" && child.Score != 30.0 {
+			t.Fatalf("unexpected explanation: %+v", explanations[0])
+		}
+		if child.Name == "ScaleDocItr" && (child.Score != 20.0 || child.Children[0].Field != "height" || child.Children[0].Score != 2.0) {
+			t.Fatalf("unexpected explanation: %+v", explanations[0])
+		}
+	}
+	// e2 has no height
+	for _, child := range explanations[1].Children {
+		if child.Name == "ScaleDocItr" && !child.Missing {
+			t.Fatalf("unexpected explanation: %+v", explanations[1])
+		}
+	}
+
+	result, err = db.Query(Query{Limit: 3, Scorer: scorer})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Explanations != nil {
+		t.Fatalf("Expected no explanations unless requested")
+	}
+}
+
+func DbCancelTest(db Db, t *testing.T) {
+	for idx := 0; idx < 100; idx++ {
+		db.Index(fmt.Sprintf("x%d", idx), map[string]float32{"age": float32(idx)})
+	}
+	scorer := []interface{}{"field", "age"}
+	result, err := db.QueryContext(context.Background(), Query{Limit: 200, Scorer: scorer})
+	if err != nil || len(result.Ids) != 100 || result.Partial {
+		t.Fatalf("unexpected result: %+v (%v)", result, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = db.QueryContext(ctx, Query{Limit: 200, Scorer: scorer})
+	if err != context.Canceled {
+		t.Fatalf("expected the query to be cancelled, found: %v", err)
+	}
+	result, err = db.QueryContext(ctx, Query{Limit: 200, Scorer: scorer, AllowPartial: true})
+	if err != nil || !result.Partial || len(result.Ids) == 100 {
+		t.Fatalf("expected partial results, found: %+v (%v)", result, err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, err = db.QueryContext(ctx, Query{Limit: 200, Scorer: scorer})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected the query to time out, found: %v", err)
+	}
+}
+
+// Indexes and deletes from several goroutines while others query; best run with "go test -race"
+func DbConcurrencyTest(db Db, t *testing.T) {
+	numWriters, numBatches, batchSize := 4, 10, 20
+	scorer := []interface{}{"field", "age"}
+	errs := make(chan error, 100)
+	var writers, readers sync.WaitGroup
+	stop := make(chan bool)
+	for writer := 0; writer < numWriters; writer++ {
+		writers.Add(1)
+		go func(writer int) {
+			defer writers.Done()
+			for batchNum := 0; batchNum < numBatches; batchNum++ {
+				records := make([]Record, batchSize)
+				deletes := []string{}
+				for idx := range records {
+					id := fmt.Sprintf("w%d.%d.%d", writer, batchNum, idx)
+					records[idx] = Record{Id: id, Values: map[string]float32{"age": float32(batchNum*batchSize + idx)}}
+					if idx%5 == 0 {
+						deletes = append(deletes, id)
+					}
+				}
+				if err := db.BulkIndex(records); err != nil {
+					errs <- err
+					return
+				}
+				for _, id := range deletes {
+					if err := db.Delete(id); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}
+		}(writer)
+	}
+	for reader := 0; reader < 4; reader++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				result, err := db.Query(Query{Limit: 50, Scorer: scorer, Filters: []interface{}{[]interface{}{"range", "age", 10.0, 400.0}}})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(result.Ids) != len(result.Scores) {
+					errs <- fmt.Errorf("found %d ids but %d scores", len(result.Ids), len(result.Scores))
+					return
+				}
+				for idx := 1; idx < len(result.Scores); idx++ {
+					if result.Scores[idx] > result.Scores[idx-1] {
+						errs <- fmt.Errorf("results are out of order: %v", result.Scores)
+						return
+					}
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	result, err := db.Query(Query{Limit: numWriters * numBatches * batchSize, Scorer: scorer, MinScore: float32(math.Inf(-1))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := numWriters * numBatches * batchSize * 4 / 5; len(result.Ids) != expected {
+		t.Fatalf("expected %d records, found %d", expected, len(result.Ids))
+	}
+	for _, id := range result.Ids {
+		var writer, batchNum, idx int
+		fmt.Sscanf(id, "w%d.%d.%d", &writer, &batchNum, &idx)
+		if idx%5 == 0 {
+			t.Fatalf("found deleted record %s", id)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package scoredb
+
+import (
+	"math"
+)
+
+// Scores a value by how close it is to an origin, like the decay functions of elasticsearch's function_score query.
+// Values within offset of the origin score 1.0; beyond that, the score falls with distance so that it is exactly
+// decay at offset+scale from the origin:
+//
+//	gauss:  decay ^ ((distance / scale) ^ 2)
+//	exp:    decay ^ (distance / scale)
+//	linear: max(0, 1 - (1 - decay) * distance / scale)
+//
+// (where distance is how far beyond offset the value is).  Since the score only falls with distance, a lower bound
+// on the score becomes a range around the origin, much like "diff".
+type DecayDocItr struct {
+	shape  string // "gauss", "exp", or "linear"
+	origin float32
+	scale  float32
+	offset float32
+	decay  float32
+	itr    DocItr
+}
+
+func NewDecayDocItr(shape string, origin, scale, offset, decay float32, itr DocItr) *DecayDocItr {
+	return &DecayDocItr{shape: shape, origin: origin, scale: scale, offset: offset, decay: decay, itr: itr}
+}
+
+// The score at a distance (beyond the offset)
+func (op *DecayDocItr) score(distance float64) float32 {
+	relative := distance / float64(op.scale)
+	switch op.shape {
+	case "gauss":
+		return float32(math.Pow(float64(op.decay), relative*relative))
+	case "exp":
+		return float32(math.Pow(float64(op.decay), relative))
+	default:
+		return float32(math.Max(0.0, 1.0-(1.0-float64(op.decay))*relative))
+	}
+}
+
+// The greatest distance (beyond the offset) at which the score is at least the given one (which must be in (0, 1])
+func (op *DecayDocItr) distance(score float32) float64 {
+	logRatio := math.Log(float64(score)) / math.Log(float64(op.decay))
+	switch op.shape {
+	case "gauss":
+		return float64(op.scale) * math.Sqrt(logRatio)
+	case "exp":
+		return float64(op.scale) * logRatio
+	default:
+		return float64(op.scale) * (1.0 - float64(score)) / (1.0 - float64(op.decay))
+	}
+}
+
+func (op *DecayDocItr) beyondOffset(value float32) float64 {
+	return math.Max(0.0, math.Abs(float64(value-op.origin))-float64(op.offset))
+}
+
+func (op *DecayDocItr) Name() string       { return "DecayDocItr" }
+func (op *DecayDocItr) Children() []DocItr { return []DocItr{op.itr} }
+func (op *DecayDocItr) Cur() (int64, float32) {
+	docId, value := op.itr.Cur()
+	return docId, op.score(op.beyondOffset(value))
+}
+func (op *DecayDocItr) GetBounds() (min, max float32) {
+	valueMin, valueMax := op.itr.GetBounds()
+	nearest := math.Min(op.beyondOffset(valueMin), op.beyondOffset(valueMax))
+	if valueMin <= op.origin && op.origin <= valueMax {
+		nearest = 0.0
+	}
+	farthest := math.Max(op.beyondOffset(valueMin), op.beyondOffset(valueMax))
+	return op.score(farthest), op.score(nearest)
+}
+func (op *DecayDocItr) Close() {
+	op.itr.Close()
+}
+func (op *DecayDocItr) Err() error {
+	return op.itr.Err()
+}
+func (op *DecayDocItr) Next(minId int64) bool {
+	return op.itr.Next(minId)
+}
+
+func (op *DecayDocItr) SetBounds(min, max float32) bool {
+	// (like diff, a maximum is not useful: it would rule out the middle of the child's range)
+	if min > 1.0 {
+		return false
+	}
+	if min <= 0.0 {
+		return true
+	}
+	// widened by the smallest possible step (as in MonotonicDocItr), so that rounding never rules out a value
+	// whose score is exactly on the bound
+	widened := math.Nextafter32(min, NegativeInfinity)
+	if widened <= 0.0 {
+		return true
+	}
+	reach := float32(float64(op.offset) + op.distance(widened))
+	valueMin := math.Nextafter32(op.origin-reach, NegativeInfinity)
+	valueMax := math.Nextafter32(op.origin+reach, PositiveInfinity)
+	return op.itr.SetBounds(valueMin, valueMax)
+}
@@ -0,0 +1,58 @@
+package scoredb
+
+import (
+	"testing"
+)
+
+func TestDecayDocItr(t *testing.T) {
+	values := []float32{100, 110, 120, 90, 140, 60}
+	for shape, expected := range map[string][]float32{
+		// an origin of 100, an offset of 10, and a score of 0.5 at 30 (that is, 20 beyond the offset)
+		"gauss":  []float32{1.0, 1.0, 0.8409, 1.0, 0.2102, 0.2102},
+		"exp":    []float32{1.0, 1.0, 0.7071, 1.0, 0.3536, 0.3536},
+		"linear": []float32{1.0, 1.0, 0.75, 1.0, 0.25, 0.25},
+	} {
+		itr := NewDecayDocItr(shape, 100, 20, 10, 0.5, NewMemoryScoreDocItr(values))
+		if min, max := itr.GetBounds(); Abs(min-expected[4]) > 1e-4 || max != 1.0 { // (140 and 60 are the farthest)
+			t.Fatalf("%s: %v %v", shape, min, max)
+		}
+		for idx, score := range expected {
+			if !itr.Next(int64(idx + 1)) {
+				t.Fatalf("%s: expected doc %v", shape, idx+1)
+			}
+			if docId, found := itr.Cur(); docId != int64(idx+1) || Abs(found-score) > 1e-4 {
+				t.Fatalf("%s: expected %v for doc %v, found %v", shape, score, idx+1, found)
+			}
+		}
+
+		// a minimum score becomes a range of values around the origin
+		child := NewMemoryScoreDocItr(values)
+		itr = NewDecayDocItr(shape, 100, 20, 10, 0.5, child)
+		itr.SetBounds(0.5, 1.0)
+		if min, max := child.GetBounds(); Abs(min-70) > 1e-3 || min > 70 || Abs(max-130) > 1e-3 || max < 130 { // (never narrower)
+			t.Fatalf("%s: %v %v", shape, min, max)
+		}
+		if itr.SetBounds(1.5, 2.0) {
+			t.Fatalf("%s: expected no values to score above 1", shape)
+		}
+	}
+
+	// bounds away from the origin
+	itr := NewDecayDocItr("exp", 0, 10, 0, 0.5, NewMemoryScoreDocItr([]float32{10, 20, 30}))
+	if min, max := itr.GetBounds(); Abs(min-0.125) > 1e-4 || Abs(max-0.5) > 1e-4 {
+		t.Fatalf("%v %v", min, max)
+	}
+}
+
+func TestDecayQuery(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	db.Index("cheap", map[string]float32{"price": 8000, "age": 1})
+	db.Index("ideal", map[string]float32{"price": 20500, "age": 3})
+	db.Index("close", map[string]float32{"price": 23000, "age": 2})
+	db.Index("pricey", map[string]float32{"price": 40000, "age": 0})
+	CallAndCheck(db, t, []string{"ideal", "close", "cheap", "pricey"}, 4, []interface{}{"gauss", 20000.0, 5000.0, 1000.0, 0.5, []interface{}{"field", "price"}})
+	// fresher (younger) first, while still preferring a price near the ideal
+	CallAndCheck(db, t, []string{"close", "ideal"}, 2, []interface{}{"product",
+		[]interface{}{"exp", 0.0, 2.0, []interface{}{"field", "age"}},
+		[]interface{}{"linear", 20000.0, 10000.0, []interface{}{"field", "price"}}})
+}
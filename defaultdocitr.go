@@ -0,0 +1,128 @@
+package scoredb
+
+import ()
+
+// Gives a constant score to documents that the wrapped iterator does not produce (for example, those
+// missing a field), so that they can still be ranked.
+//
+// While the default score is within the bounds, every document must be visited, so the wrapped iterator
+// is walked alongside an iterator over all documents, and it is never pruned (pruning it would make
+// documents that do have a value look like they are missing one).
+// Once the bounds exclude the default, only documents with a value can qualify: from then on, the
+// wrapped iterator is used alone, and the bounds are passed through to it.
+type DefaultDocItr struct {
+	score     float32
+	docId     int64
+	min, max  float32
+	deflt     float32
+	itr       DocItr
+	all       DocItr
+	itrDone   bool
+	childOnly bool
+}
+
+func NewDefaultDocItr(deflt float32, itr DocItr, all DocItr) *DefaultDocItr {
+	min, max := itr.GetBounds()
+	return &DefaultDocItr{
+		score: 0.0,
+		docId: -1,
+		min:   Min(min, deflt),
+		max:   Max(max, deflt),
+		deflt: deflt,
+		itr:   itr,
+		all:   all,
+	}
+}
+
+func (op *DefaultDocItr) Name() string       { return "DefaultDocItr" }
+func (op *DefaultDocItr) Children() []DocItr { return []DocItr{op.itr} }
+func (op *DefaultDocItr) Cur() (int64, float32) {
+	return op.docId, op.score
+}
+func (op *DefaultDocItr) GetBounds() (min, max float32) {
+	return op.min, op.max
+}
+func (op *DefaultDocItr) Close() {
+	op.itr.Close()
+	op.all.Close()
+}
+func (op *DefaultDocItr) Err() error {
+	if err := op.itr.Err(); err != nil {
+		return err
+	}
+	return op.all.Err()
+}
+
+func (op *DefaultDocItr) SetBounds(min, max float32) bool {
+	op.min = Max(op.min, min)
+	op.max = Min(op.max, max)
+	if op.min > op.max {
+		return false
+	}
+	if op.childOnly {
+		return op.itr.SetBounds(op.min, op.max)
+	}
+	if op.min <= op.deflt && op.deflt <= op.max {
+		return true
+	}
+	op.childOnly = true
+	op.all.Close()
+	if op.itrDone {
+		return false
+	}
+	return op.itr.SetBounds(op.min, op.max)
+}
+
+func (op *DefaultDocItr) Next(minId int64) bool {
+	if op.childOnly {
+		return op.nextFromChild(minId)
+	}
+	for {
+		if !op.all.Next(minId) {
+			return false
+		}
+		docId, _ := op.all.Cur()
+		score := op.deflt
+		if !op.itrDone {
+			childId, childScore := op.itr.Cur()
+			if childId < docId {
+				if op.itr.Next(docId) {
+					childId, childScore = op.itr.Cur()
+				} else {
+					op.itrDone = true
+				}
+			}
+			if !op.itrDone && childId == docId {
+				score = childScore
+			}
+		}
+		if op.min <= score && score <= op.max {
+			op.docId = docId
+			op.score = score
+			return true
+		}
+		minId = docId + 1
+	}
+}
+
+func (op *DefaultDocItr) nextFromChild(minId int64) bool {
+	if op.itrDone {
+		return false
+	}
+	for {
+		docId, score := op.itr.Cur()
+		if docId < minId {
+			if !op.itr.Next(minId) {
+				op.itrDone = true
+				return false
+			}
+			docId, score = op.itr.Cur()
+		}
+		if op.min <= score && score <= op.max {
+			op.docId = docId
+			op.score = score
+			return true
+		}
+		minId = docId + 1
+	}
+}
@@ -0,0 +1,49 @@
+package scoredb
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDefaultDocItr(t *testing.T) {
+	nan := float32(math.NaN())
+	child := NewMemoryScoreDocItr([]float32{nan, 5.0, nan, 1.0, nan})
+	all := NewAllDocsItr(1, 5, func(docId int64) bool { return docId == 5 })
+	itr := NewDefaultDocItr(3.0, child, all)
+
+	if min, max := itr.GetBounds(); min != 1.0 || max != 5.0 {
+		t.Fatalf("%v %v", min, max)
+	}
+	if !itr.Next(0) {
+		t.FailNow()
+	}
+	if docId, score := itr.Cur(); docId != 1 || score != 3.0 {
+		t.Fatalf("%v %v", docId, score)
+	}
+
+	// while the default is within bounds, the child is not pruned
+	if !itr.SetBounds(2.0, 5.0) {
+		t.FailNow()
+	}
+	if min, _ := child.GetBounds(); min != 1.0 {
+		t.Fatalf("%v", min)
+	}
+	if !itr.Next(2) {
+		t.FailNow()
+	}
+	if docId, score := itr.Cur(); docId != 2 || score != 5.0 {
+		t.Fatalf("%v %v", docId, score)
+	}
+
+	// once the bounds exclude the default, only the child's documents remain
+	if !itr.SetBounds(4.0, 5.0) {
+		t.FailNow()
+	}
+	if min, _ := child.GetBounds(); min != 4.0 {
+		t.Fatalf("%v", min)
+	}
+	if itr.Next(3) {
+		docId, score := itr.Cur()
+		t.Fatalf("%v %v", docId, score)
+	}
+}
@@ -0,0 +1,278 @@
+package scoredb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+)
+
+// A set of deleted document ids for a single shard, persisted as a plain bitmap plus a log of the ids deleted
+// since the bitmap was last written.
+// A nil *DeletionBitmap is valid, and contains nothing.
+//
+// Add() appends a record to the log (so each deletion writes only the ids it deletes), and rewrites the bitmap
+// once the log has grown larger than it.  A record that a crash left partly written is ignored, so a crash leaves
+// either the old or the new set of deletions.
+//
+// Add() must not be called concurrently with itself, but Contains() may be called at any time (see idBitset).
+type DeletionBitmap struct {
+	path    string
+	ids     idBitset
+	logSize int64 // the length of the log's complete records
+}
+
+// An in-memory set of ids, which one writer may add to while any number of readers check it.
+// Words are only changed atomically, and the words are only replaced (with a larger copy) when they need to grow.
+type idBitset struct {
+	bits  atomic.Value // []uint64, whose words are read and written atomically
+	count int64        // atomic
+}
+
+func newIdBitset() *idBitset {
+	ids := &idBitset{}
+	ids.bits.Store([]uint64{})
+	return ids
+}
+
+func (ids *idBitset) words() []uint64 {
+	return ids.bits.Load().([]uint64)
+}
+
+// (a nil *idBitset contains nothing)
+func (ids *idBitset) Contains(docId int64) bool {
+	if ids == nil {
+		return false
+	}
+	bits := ids.words()
+	word := int(docId >> 6)
+	if docId < 0 || word >= len(bits) {
+		return false
+	}
+	return atomic.LoadUint64(&bits[word])&(1<<uint(docId&63)) != 0
+}
+
+func (ids *idBitset) Count() int {
+	return int(atomic.LoadInt64(&ids.count))
+}
+
+func (ids *idBitset) HighestId() int64 {
+	bits := ids.words()
+	for word := len(bits) - 1; word >= 0; word-- {
+		value := atomic.LoadUint64(&bits[word])
+		for bit := 63; bit >= 0; bit-- {
+			if value&(1<<uint(bit)) != 0 {
+				return int64(word)<<6 | int64(bit)
+			}
+		}
+	}
+	return 0
+}
+
+// The given ids that are not yet in the set (each once)
+func (ids *idBitset) unset(docIds []int64) []int64 {
+	newIds := make([]int64, 0, len(docIds))
+	seen := make(map[int64]bool)
+	for _, docId := range docIds {
+		if !ids.Contains(docId) && !seen[docId] {
+			seen[docId] = true
+			newIds = append(newIds, docId)
+		}
+	}
+	return newIds
+}
+
+// Adds ids that are not yet in the set (see unset())
+func (ids *idBitset) set(newIds []int64) {
+	bits := ids.words()
+	for _, docId := range newIds {
+		word := int(docId >> 6)
+		if word >= len(bits) {
+			if word < cap(bits) {
+				bits = bits[:word+1] // (no reader can see the words past the old length, which are still zero)
+			} else {
+				grown := make([]uint64, word+1, 2*(word+1))
+				for idx := range bits {
+					grown[idx] = atomic.LoadUint64(&bits[idx])
+				}
+				bits = grown
+			}
+			ids.bits.Store(bits)
+		}
+		atomic.StoreUint64(&bits[word], atomic.LoadUint64(&bits[word])|uint64(1)<<uint(docId&63))
+	}
+	atomic.AddInt64(&ids.count, int64(len(newIds)))
+}
+
+// Log records are: the number of ids (uint32), the ids (int64 each), then a CRC-32 of both (uint32)
+const deletionLogHeaderSize = 4
+const deletionLogFooterSize = 4
+
+// The log is not folded into the bitmap until it is at least this long
+var DELETION_LOG_MIN_COMPACT = int64(4096)
+
+func LoadDeletionBitmap(path string) (*DeletionBitmap, error) {
+	bitmap := &DeletionBitmap{path: path}
+	bitmap.ids.bits.Store([]uint64{})
+	if Exists(path) {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		bits := make([]uint64, len(buf)/8)
+		for idx := range bits {
+			word := binary.LittleEndian.Uint64(buf[idx*8:])
+			bits[idx] = word
+			for ; word != 0; word &= word - 1 {
+				bitmap.ids.count += 1
+			}
+		}
+		bitmap.ids.bits.Store(bits)
+	}
+	if !Exists(bitmap.logPath()) {
+		return bitmap, nil
+	}
+	buf, err := ioutil.ReadFile(bitmap.logPath())
+	if err != nil {
+		return nil, err
+	}
+	for {
+		docIds, size := readDeletionLogRecord(buf[bitmap.logSize:])
+		if size == 0 {
+			break // (the end of the log, or a record that a crash left incomplete)
+		}
+		bitmap.ids.set(bitmap.ids.unset(docIds))
+		bitmap.logSize += size
+	}
+	return bitmap, nil
+}
+
+func (bitmap *DeletionBitmap) logPath() string {
+	return bitmap.path + ".log"
+}
+
+// The ids in the record at the start of buf, and the record's size; zero if there is no complete record there
+func readDeletionLogRecord(buf []byte) ([]int64, int64) {
+	if len(buf) < deletionLogHeaderSize {
+		return nil, 0
+	}
+	numIds := int64(binary.LittleEndian.Uint32(buf))
+	size := deletionLogHeaderSize + numIds*8 + deletionLogFooterSize
+	if int64(len(buf)) < size {
+		return nil, 0
+	}
+	body := buf[:size-deletionLogFooterSize]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(buf[size-deletionLogFooterSize:]) {
+		return nil, 0
+	}
+	docIds := make([]int64, numIds)
+	for idx := range docIds {
+		docIds[idx] = int64(binary.LittleEndian.Uint64(body[deletionLogHeaderSize+idx*8:]))
+	}
+	return docIds, size
+}
+
+func (bitmap *DeletionBitmap) Contains(docId int64) bool {
+	if bitmap == nil {
+		return false
+	}
+	return bitmap.ids.Contains(docId)
+}
+
+// The number of deleted ids
+func (bitmap *DeletionBitmap) Count() int {
+	if bitmap == nil {
+		return 0
+	}
+	return bitmap.ids.Count()
+}
+
+// The largest deleted id, or zero if there are none
+func (bitmap *DeletionBitmap) HighestId() int64 {
+	return bitmap.ids.HighestId()
+}
+
+// Marks the given ids as deleted and saves them to disk (they are only visible to Contains() once saved)
+func (bitmap *DeletionBitmap) Add(docIds []int64) error {
+	newIds := bitmap.ids.unset(docIds)
+	if len(newIds) == 0 {
+		return nil
+	}
+	size, err := bitmap.appendLog(newIds)
+	if err != nil {
+		return err
+	}
+	bitmap.logSize += size
+	bitmap.ids.set(newIds)
+	if bitmap.logSize >= DELETION_LOG_MIN_COMPACT && bitmap.logSize > int64(len(bitmap.ids.words()))*8 {
+		return bitmap.save()
+	}
+	return nil
+}
+
+// Appends (and syncs) a record to the log, after dropping anything that follows the complete records
+func (bitmap *DeletionBitmap) appendLog(docIds []int64) (int64, error) {
+	buf := make([]byte, deletionLogHeaderSize+len(docIds)*8+deletionLogFooterSize)
+	binary.LittleEndian.PutUint32(buf, uint32(len(docIds)))
+	for idx, docId := range docIds {
+		binary.LittleEndian.PutUint64(buf[deletionLogHeaderSize+idx*8:], uint64(docId))
+	}
+	footer := len(buf) - deletionLogFooterSize
+	binary.LittleEndian.PutUint32(buf[footer:], crc32.ChecksumIEEE(buf[:footer]))
+
+	created := !Exists(bitmap.logPath())
+	fd, err := os.OpenFile(bitmap.logPath(), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	err = fd.Truncate(bitmap.logSize)
+	if err == nil {
+		_, err = fd.WriteAt(buf, bitmap.logSize)
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err == nil && created {
+		err = SyncPath(path.Dir(bitmap.logPath()))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(buf)), nil
+}
+
+// Rewrites the bitmap (replacing the file atomically) to include everything in the log, then empties the log
+func (bitmap *DeletionBitmap) save() error {
+	bits := bitmap.ids.words()
+	buf := make([]byte, len(bits)*8)
+	for idx := range bits {
+		binary.LittleEndian.PutUint64(buf[idx*8:], atomic.LoadUint64(&bits[idx]))
+	}
+	tmpPath := bitmap.path + ".tmp"
+	err := ioutil.WriteFile(tmpPath, buf, 0666)
+	if err != nil {
+		return err
+	}
+	err = SyncPath(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, bitmap.path)
+	if err != nil {
+		return err
+	}
+	err = SyncPath(path.Dir(bitmap.path))
+	if err != nil {
+		return err
+	}
+	// (if a crash comes first, the log's ids are simply applied again)
+	err = os.Truncate(bitmap.logPath(), 0)
+	if err != nil {
+		return err
+	}
+	bitmap.logSize = 0
+	return SyncPath(bitmap.logPath())
+}
@@ -0,0 +1,95 @@
+package scoredb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDeletionBitmap(t *testing.T) {
+	filename := RmAllTestData()("deletionbitmap")
+	defer RmAllTestData()
+
+	var empty *DeletionBitmap
+	if empty.Contains(1) {
+		t.FailNow()
+	}
+
+	bitmap, err := LoadDeletionBitmap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bitmap.Add([]int64{1, 64, 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := LoadDeletionBitmap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Count() != 3 || reloaded.HighestId() != 1000 {
+		t.Fatalf("%v %v", reloaded.Count(), reloaded.HighestId())
+	}
+	for _, id := range []int64{1, 64, 1000} {
+		if !reloaded.Contains(id) {
+			t.Fatalf("%v", id)
+		}
+	}
+	for _, id := range []int64{-1, 0, 2, 63, 65, 999, 1001, 100000} {
+		if reloaded.Contains(id) {
+			t.Fatalf("%v", id)
+		}
+	}
+}
+
+func TestDeletionBitmapLog(t *testing.T) {
+	filename := RmAllTestData()("deletionbitmap")
+	defer RmAllTestData()
+	defer func(minCompact int64) { DELETION_LOG_MIN_COMPACT = minCompact }(DELETION_LOG_MIN_COMPACT)
+	DELETION_LOG_MIN_COMPACT = 64
+
+	bitmap, err := LoadDeletionBitmap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(0); id < 300; id += 3 {
+		err = bitmap.Add([]int64{id, id}) // (each id once, whatever the log and the bitmap hold)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !Exists(filename) {
+		t.Fatalf("expected the log to have been folded into the bitmap")
+	}
+	// a record that a crash left incomplete is ignored
+	fd, err := os.OpenFile(filename+".log", os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte{2, 0, 0, 0, 7, 0, 0})
+	fd.Close()
+
+	reloaded, err := LoadDeletionBitmap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Count() != 100 || reloaded.HighestId() != 297 {
+		t.Fatalf("%v %v", reloaded.Count(), reloaded.HighestId())
+	}
+	for id := int64(0); id < 300; id++ {
+		if reloaded.Contains(id) != (id%3 == 0) {
+			t.Fatalf("%v", id)
+		}
+	}
+	err = reloaded.Add([]int64{1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err = LoadDeletionBitmap(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Count() != 101 || !reloaded.Contains(1000) || reloaded.Contains(7) {
+		t.Fatalf("%v", reloaded.Count())
+	}
+}
@@ -32,7 +32,8 @@ func Min(v1, v2 float32) float32 {
 	}
 }
 
-func (op *DiffDocItr) Name() string { return "DiffDocItr" }
+func (op *DiffDocItr) Name() string       { return "DiffDocItr" }
+func (op *DiffDocItr) Children() []DocItr { return []DocItr{op.itr} }
 func (op *DiffDocItr) Cur() (int64, float32) {
 	docId, score := op.itr.Cur()
 	return docId, Abs(score - op.target)
@@ -52,6 +53,9 @@ func (op *DiffDocItr) GetBounds() (min, max float32) {
 func (op *DiffDocItr) Close() {
 	op.itr.Close()
 }
+func (op *DiffDocItr) Err() error {
+	return op.itr.Err()
+}
 func (op *DiffDocItr) Next(minId int64) bool {
 	return op.itr.Next(minId)
 }
@@ -25,6 +25,10 @@ type DocItr interface {
 
 	Close() // release resources held by this iterator (if any)
 
+	// The error (typically I/O or data corruption) that caused Next() to return false early, if any.
+	// Callers should check this once the iterator is exhausted; it may also be set by Close().
+	Err() error
+
 	Cur() (int64, float32) // doc id and score of current result, or (-1, 0.0) if the iterator has not been initialized
 
 }
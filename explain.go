@@ -0,0 +1,55 @@
+package scoredb
+
+import ()
+
+// How a document's score was computed: the score of each iterator in the query's iterator tree
+type Explanation struct {
+	Name     string // the iterator, for example "SumDocItr"
+	Field    string `json:",omitempty"` // the field that the iterator reads, if any
+	Score    float32
+	Missing  bool          `json:",omitempty"` // the iterator produced no score for the document (for example, one part of a max)
+	Children []Explanation `json:",omitempty"`
+}
+
+// Iterators that combine or transform others implement this, so that their scores can be explained
+type ParentDocItr interface {
+	Children() []DocItr
+}
+
+// Iterators that read a field directly implement this
+type FieldReadingDocItr interface {
+	FieldName() string
+}
+
+// Iterators that can not be explained by walking their children implement this
+type ExplainingDocItr interface {
+	Explain() Explanation
+}
+
+// Explains the score of the document that the iterator is currently on
+func Explain(itr DocItr) Explanation {
+	docId, _ := itr.Cur()
+	return explainDoc(itr, docId)
+}
+
+func explainDoc(itr DocItr, docId int64) Explanation {
+	if explaining, ok := itr.(ExplainingDocItr); ok {
+		return explaining.Explain()
+	}
+	curDocId, score := itr.Cur()
+	explanation := Explanation{Name: itr.Name()}
+	if reader, ok := itr.(FieldReadingDocItr); ok {
+		explanation.Field = reader.FieldName()
+	}
+	if curDocId != docId {
+		explanation.Missing = true
+		return explanation
+	}
+	explanation.Score = score
+	if parent, ok := itr.(ParentDocItr); ok {
+		for _, child := range parent.Children() {
+			explanation.Children = append(explanation.Children, explainDoc(child, docId))
+		}
+	}
+	return explanation
+}
@@ -0,0 +1,664 @@
+package scoredb
+
+import (
+	"fmt"
+	"math"
+)
+
+// A typed scoring function (or filter predicate).
+// Embedding programs can build one with the functions below, for example:
+//
+//	Sum(Field("age"), Scale(2.0, Field("height")))
+//
+// and ParseExpr builds one from the JSON array form, for example:
+//
+//	["sum", ["field", "age"], ["scale", 2.0, ["field", "height"]]]
+//
+// Expressions that are built by hand (rather than with these functions or ParseExpr) must have the same
+// shape that ParseExpr would give them; Validate checks this.
+type Expr struct {
+	Op     string        // the function name, for example "sum" or "field"
+	Fields []string      // field names: one for "field" and the predicates, the latitude then longitude fields for the geo functions
+	Values []float32     // numeric arguments, in the order they appear in the JSON form; a range's missing bounds are infinite
+	Points []CustomPoint // for "custom_map" and "custom_linear"
+	Args   []*Expr       // sub-expressions; for "filter", the scorer followed by its predicates
+}
+
+func Field(name string) *Expr { return &Expr{Op: "field", Fields: []string{name}} }
+func FieldWithDefault(name string, deflt float32) *Expr {
+	return &Expr{Op: "field", Fields: []string{name}, Values: []float32{deflt}}
+}
+func Sum(args ...*Expr) *Expr     { return &Expr{Op: "sum", Args: args} }
+func Product(args ...*Expr) *Expr { return &Expr{Op: "product", Args: args} }
+func MinOf(args ...*Expr) *Expr   { return &Expr{Op: "min", Args: args} }
+func MaxOf(args ...*Expr) *Expr   { return &Expr{Op: "max", Args: args} }
+func Scale(weight float32, arg *Expr) *Expr {
+	return &Expr{Op: "scale", Values: []float32{weight}, Args: []*Expr{arg}}
+}
+func Offset(delta float32, arg *Expr) *Expr {
+	return &Expr{Op: "offset", Values: []float32{delta}, Args: []*Expr{arg}}
+}
+func Const(value float32) *Expr { return &Expr{Op: "const", Values: []float32{value}} }
+func Diff(target float32, arg *Expr) *Expr {
+	return &Expr{Op: "diff", Values: []float32{target}, Args: []*Expr{arg}}
+}
+func PowOf(arg *Expr, exp float32) *Expr {
+	return &Expr{Op: "pow", Values: []float32{exp}, Args: []*Expr{arg}}
+}
+func CustomMap(points []CustomPoint, deflt float32, arg *Expr) *Expr {
+	return &Expr{Op: "custom_map", Points: points, Values: []float32{deflt}, Args: []*Expr{arg}}
+}
+func CustomLinear(points []CustomPoint, arg *Expr) *Expr {
+	return &Expr{Op: "custom_linear", Points: points, Args: []*Expr{arg}}
+}
+func GeoDistance(lat, lng float32, latField, lngField string) *Expr {
+	return &Expr{Op: "geo_distance", Values: []float32{lat, lng}, Fields: []string{latField, lngField}}
+}
+
+// name is one of MonotonicFunctions: "log", "log1p", "exp", "sigmoid", or "tanh"
+func Monotonic(name string, arg *Expr) *Expr { return &Expr{Op: name, Args: []*Expr{arg}} }
+func Clamp(lo, hi float32, arg *Expr) *Expr {
+	return &Expr{Op: "clamp", Values: []float32{lo, hi}, Args: []*Expr{arg}}
+}
+
+// shape is "gauss", "exp", or "linear"
+func Decay(shape string, origin, scale, offset, decay float32, arg *Expr) *Expr {
+	return &Expr{Op: shape, Values: []float32{origin, scale, offset, decay}, Args: []*Expr{arg}}
+}
+func Default(deflt float32, arg *Expr) *Expr {
+	return &Expr{Op: "default", Values: []float32{deflt}, Args: []*Expr{arg}}
+}
+func Filter(scorer *Expr, predicates ...*Expr) *Expr {
+	return &Expr{Op: "filter", Args: append([]*Expr{scorer}, predicates...)}
+}
+
+// Use NegativeInfinity or PositiveInfinity for a range that is unbounded on one side
+func Range(field string, min, max float32) *Expr {
+	return &Expr{Op: "range", Fields: []string{field}, Values: []float32{min, max}}
+}
+func Eq(field string, value float32) *Expr {
+	return &Expr{Op: "eq", Fields: []string{field}, Values: []float32{value}}
+}
+func In(field string, values ...float32) *Expr {
+	return &Expr{Op: "in", Fields: []string{field}, Values: values}
+}
+func GeoWithin(lat, lng, radiusKm float32, latField, lngField string) *Expr {
+	return &Expr{Op: "geo_within", Values: []float32{lat, lng, radiusKm}, Fields: []string{latField, lngField}}
+}
+
+// A box that crosses the antimeridian has a west edge greater than its east edge
+func GeoBox(south, west, north, east float32, latField, lngField string) *Expr {
+	return &Expr{Op: "geo_box", Values: []float32{south, west, north, east}, Fields: []string{latField, lngField}}
+}
+
+// An invalid expression, and where in its JSON form the problem is; for example, "scorer[2][1]" is the
+// first argument of the second argument of the scorer (the function name is at index 0).
+type ExprError struct {
+	Path    string
+	Message string
+}
+
+func (e *ExprError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+func exprErrorf(path string, format string, args ...interface{}) error {
+	return &ExprError{Path: path, Message: fmt.Sprintf(format, args...)}
+}
+
+// Parses the JSON array form of a scoring function
+func ParseExpr(input interface{}) (*Expr, error) {
+	return parseExpr(input, "scorer")
+}
+
+// Parses the JSON array form of a filter predicate: ["range", <field>, <min or null>, <max or null>],
+// ["eq", <field>, <value>], ["in", <field>, [<value>, ...]], ["geo_within", <lat>, <lng>, <radius km>, <lat field>, <lng field>],
+// or ["geo_box", <south>, <west>, <north>, <east>, <lat field>, <lng field>]
+func ParsePredicate(input interface{}) (*Expr, error) {
+	return parsePredicate(input, "filter")
+}
+
+// The expression to run for a query: Query.Expr if it is given (otherwise, Query.Scorer), restricted by Query.Filters
+func (query Query) ToExpr() (*Expr, error) {
+	expr := query.Expr
+	if expr != nil {
+		if err := expr.Validate(); err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		expr, err = parseExpr(query.Scorer, "scorer")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(query.Filters) == 0 {
+		return expr, nil
+	}
+	predicates := make([]*Expr, len(query.Filters))
+	for idx, filter := range query.Filters {
+		predicate, err := parsePredicate(filter, fmt.Sprintf("filters[%d]", idx))
+		if err != nil {
+			return nil, err
+		}
+		predicates[idx] = predicate
+	}
+	return Filter(expr, predicates...), nil
+}
+
+// What each function's Expr holds: how many Fields and Values (any number, when nil), and how many Args
+type exprShape struct {
+	numFields int
+	numValues []int
+	minArgs   int
+	maxArgs   int // (-1 when unlimited)
+	points    bool
+}
+
+var scoringFunctionShapes = map[string]exprShape{
+	"sum":           {minArgs: 1, maxArgs: -1, numValues: []int{0}},
+	"product":       {minArgs: 1, maxArgs: -1, numValues: []int{0}},
+	"min":           {minArgs: 1, maxArgs: -1, numValues: []int{0}},
+	"max":           {minArgs: 1, maxArgs: -1, numValues: []int{0}},
+	"scale":         {minArgs: 1, maxArgs: 1, numValues: []int{1}},
+	"offset":        {minArgs: 1, maxArgs: 1, numValues: []int{1}},
+	"diff":          {minArgs: 1, maxArgs: 1, numValues: []int{1}},
+	"default":       {minArgs: 1, maxArgs: 1, numValues: []int{1}},
+	"pow":           {minArgs: 1, maxArgs: 1, numValues: []int{1}},
+	"const":         {numValues: []int{1}},
+	"custom_map":    {minArgs: 1, maxArgs: 1, numValues: []int{1}, points: true},
+	"custom_linear": {minArgs: 1, maxArgs: 1, numValues: []int{0}, points: true},
+	"log":           {minArgs: 1, maxArgs: 1, numValues: []int{0}},
+	"log1p":         {minArgs: 1, maxArgs: 1, numValues: []int{0}},
+	"sigmoid":       {minArgs: 1, maxArgs: 1, numValues: []int{0}},
+	"tanh":          {minArgs: 1, maxArgs: 1, numValues: []int{0}},
+	"clamp":         {minArgs: 1, maxArgs: 1, numValues: []int{2}},
+	"exp":           {minArgs: 1, maxArgs: 1, numValues: []int{0, 4}}, // (with no values, the exponential function)
+	"gauss":         {minArgs: 1, maxArgs: 1, numValues: []int{4}},
+	"linear":        {minArgs: 1, maxArgs: 1, numValues: []int{4}},
+	"geo_distance":  {numFields: 2, numValues: []int{2}},
+	"field":         {numFields: 1, numValues: []int{0, 1}},
+	"filter":        {minArgs: 1, maxArgs: -1, numValues: []int{0}},
+}
+
+var predicateShapes = map[string]exprShape{
+	"range":      {numFields: 1, numValues: []int{2}},
+	"eq":         {numFields: 1, numValues: []int{1}},
+	"in":         {numFields: 1},
+	"geo_within": {numFields: 2, numValues: []int{3}},
+	"geo_box":    {numFields: 2, numValues: []int{4}},
+}
+
+// Checks that an expression (and each of its sub-expressions) has the shape that ParseExpr would give it, and
+// arguments that ParseExpr would accept.  Errors give paths into the expression's JSON form (see ToJson), starting
+// with "expr".
+func (expr *Expr) Validate() error {
+	return expr.validate("expr", false)
+}
+
+func (expr *Expr) validate(path string, isPredicate bool) error {
+	kind, shapes := "scoring function", scoringFunctionShapes
+	if isPredicate {
+		kind, shapes = "filter predicate", predicateShapes
+	}
+	if expr == nil {
+		return exprErrorf(path, "Expected a %s; found nothing instead", kind)
+	}
+	shape, ok := shapes[expr.Op]
+	if !ok {
+		if isPredicate {
+			return exprErrorf(path+"[0]", "Filter predicate '%s' is not recognized", expr.Op)
+		}
+		return exprErrorf(path+"[0]", "Scoring function '%s' is not recognized", expr.Op)
+	}
+	wrongArgs := exprErrorf(path, "Wrong number of arguments to %s function", expr.Op)
+	if isPredicate {
+		wrongArgs = exprErrorf(path, "Wrong number of arguments to %s predicate", expr.Op)
+	}
+	numValuesOk := shape.numValues == nil
+	for _, numValues := range shape.numValues {
+		numValuesOk = numValuesOk || len(expr.Values) == numValues
+	}
+	if !numValuesOk || len(expr.Fields) != shape.numFields || (len(expr.Points) > 0 && !shape.points) ||
+		len(expr.Args) < shape.minArgs || (shape.maxArgs >= 0 && len(expr.Args) > shape.maxArgs) {
+		return wrongArgs
+	}
+	if err := expr.checkValues(path); err != nil {
+		return err
+	}
+	// (sub-expressions follow the fields, values, and points in the JSON form; except for pow's, which comes first)
+	firstArgIdx := len(expr.Fields) + len(expr.Values)
+	if shape.points {
+		firstArgIdx++
+	}
+	if expr.Op == "pow" {
+		firstArgIdx = 0
+	}
+	for idx, arg := range expr.Args {
+		if err := arg.validate(argPath(path, firstArgIdx+idx), expr.Op == "filter" && idx > 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks the numeric arguments of an expression that has the right shape (these come first in the JSON forms
+// that have restrictions on them)
+func (expr *Expr) checkValues(path string) error {
+	switch expr.Op {
+	case "clamp":
+		if lo, hi := expr.Values[0], expr.Values[1]; lo > hi {
+			return exprErrorf(path, "The low end (%v) given to clamp function is above its high end (%v)", lo, hi)
+		}
+	case "exp", "gauss", "linear":
+		if len(expr.Values) == 0 { // (the exponential function)
+			return nil
+		}
+		if scale := expr.Values[1]; !(scale > 0) {
+			return exprErrorf(argPath(path, 1), "Invalid scale (%v) given to %s function, must be positive", scale, expr.Op)
+		}
+		if offset := expr.Values[2]; !(offset >= 0) {
+			return exprErrorf(argPath(path, 2), "Invalid offset (%v) given to %s function, must not be negative", offset, expr.Op)
+		}
+		if decay := expr.Values[3]; !(decay > 0 && decay < 1) {
+			return exprErrorf(argPath(path, 3), "Invalid decay (%v) given to %s function, must be between 0 and 1", decay, expr.Op)
+		}
+	case "geo_within", "geo_box":
+		var latIdxs, lngIdxs []int
+		if expr.Op == "geo_within" {
+			latIdxs, lngIdxs = []int{0}, []int{1}
+			if radius := expr.Values[2]; !(radius >= 0) {
+				return exprErrorf(argPath(path, 2), "Invalid radius (%v) given to geo_within predicate, must not be negative", radius)
+			}
+		} else {
+			latIdxs, lngIdxs = []int{0, 2}, []int{1, 3}
+			if south, north := expr.Values[0], expr.Values[2]; south > north {
+				return exprErrorf(path, "The south edge (%v) given to geo_box predicate is north of its north edge (%v)", south, north)
+			}
+		}
+		for _, idx := range latIdxs {
+			if lat := expr.Values[idx]; !(-90 <= lat && lat <= 90) {
+				return exprErrorf(argPath(path, idx), "Invalid latitude (%v) given to %s predicate, must be between -90 and 90", lat, expr.Op)
+			}
+		}
+		for _, idx := range lngIdxs {
+			if lng := expr.Values[idx]; !(-180 <= lng && lng <= 180) {
+				return exprErrorf(argPath(path, idx), "Invalid longitude (%v) given to %s predicate, must be between -180 and 180", lng, expr.Op)
+			}
+		}
+	}
+	return nil
+}
+
+// Splits an expression's JSON form into its name and arguments
+func parseCall(input interface{}, path string, kind string) (string, []interface{}, error) {
+	parts, ok := input.([]interface{})
+	if !ok || len(parts) == 0 {
+		return "", nil, exprErrorf(path, "Expected a %s (an array starting with its name); found: '%v' instead", kind, input)
+	}
+	name, ok := parts[0].(string)
+	if !ok {
+		return "", nil, exprErrorf(path+"[0]", "Expected the name of a %s; found: '%v' instead", kind, parts[0])
+	}
+	return name, parts[1:], nil
+}
+
+func argPath(path string, argIdx int) string {
+	return fmt.Sprintf("%s[%d]", path, argIdx+1)
+}
+
+func parseNumber(args []interface{}, argIdx int, path string) (float32, error) {
+	value, err := ToFloat32(args[argIdx])
+	if err != nil {
+		return 0.0, &ExprError{Path: argPath(path, argIdx), Message: err.Error()}
+	}
+	return value, nil
+}
+
+func parseFieldName(args []interface{}, argIdx int, path string, name string) (string, error) {
+	field, ok := args[argIdx].(string)
+	if !ok {
+		return "", exprErrorf(argPath(path, argIdx), "Invalid field name ('%v') given to %s, must be a string", args[argIdx], name)
+	}
+	return field, nil
+}
+
+func parseExpr(input interface{}, path string) (*Expr, error) {
+	name, args, err := parseCall(input, path, "scoring function")
+	if err != nil {
+		return nil, err
+	}
+	expr := &Expr{Op: name}
+	wrongArgs := exprErrorf(path, "Wrong number of arguments to %s function", name)
+	// the usual case: a number (at the given position) and a sub-expression
+	parseNumberAndArg := func(numberIdx int) error {
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		for idx := range args {
+			if idx == numberIdx {
+				value, err := parseNumber(args, idx, path)
+				if err != nil {
+					return err
+				}
+				expr.Values = append(expr.Values, value)
+			} else {
+				arg, err := parseExpr(args[idx], argPath(path, idx))
+				if err != nil {
+					return err
+				}
+				expr.Args = append(expr.Args, arg)
+			}
+		}
+		return nil
+	}
+	switch name {
+	case "sum", "product", "min", "max":
+		if len(args) == 0 {
+			return nil, wrongArgs
+		}
+		expr.Args = make([]*Expr, len(args))
+		for idx := range args {
+			expr.Args[idx], err = parseExpr(args[idx], argPath(path, idx))
+			if err != nil {
+				return nil, err
+			}
+		}
+	case "scale", "offset", "diff", "default":
+		err = parseNumberAndArg(0)
+	case "const":
+		if len(args) != 1 {
+			return nil, wrongArgs
+		}
+		value, err := parseNumber(args, 0, path)
+		if err != nil {
+			return nil, err
+		}
+		expr.Values = []float32{value}
+	case "pow":
+		err = parseNumberAndArg(1)
+	case "custom_map", "custom_linear":
+		// [points, default, expr] or [points, expr]
+		numArgs := map[string]int{"custom_map": 3, "custom_linear": 2}[name]
+		if len(args) != numArgs {
+			return nil, wrongArgs
+		}
+		expr.Points, err = parsePoints(args[0], argPath(path, 0))
+		if err != nil {
+			return nil, err
+		}
+		if name == "custom_map" {
+			deflt, err := parseNumber(args, 1, path)
+			if err != nil {
+				return nil, err
+			}
+			expr.Values = []float32{deflt}
+		}
+		arg, err := parseExpr(args[numArgs-1], argPath(path, numArgs-1))
+		if err != nil {
+			return nil, err
+		}
+		expr.Args = []*Expr{arg}
+	case "log", "log1p", "sigmoid", "tanh":
+		if len(args) != 1 {
+			return nil, wrongArgs
+		}
+		expr.Args = make([]*Expr, 1)
+		expr.Args[0], err = parseExpr(args[0], argPath(path, 0))
+	case "clamp":
+		if len(args) != 3 {
+			return nil, wrongArgs
+		}
+		for idx := 0; idx < 2; idx++ {
+			value, err := parseNumber(args, idx, path)
+			if err != nil {
+				return nil, err
+			}
+			expr.Values = append(expr.Values, value)
+		}
+		if err := expr.checkValues(path); err != nil {
+			return nil, err
+		}
+		expr.Args = make([]*Expr, 1)
+		expr.Args[0], err = parseExpr(args[2], argPath(path, 2))
+	case "exp", "gauss", "linear":
+		if name == "exp" && len(args) == 1 { // (the exponential function, rather than exponential decay)
+			expr.Args = make([]*Expr, 1)
+			expr.Args[0], err = parseExpr(args[0], argPath(path, 0))
+			break
+		}
+		// [origin, scale, offset, decay, expr] or [origin, scale, expr] (no offset, and a decay of 0.5)
+		if len(args) != 3 && len(args) != 5 {
+			return nil, wrongArgs
+		}
+		expr.Values = []float32{0.0, 0.0, 0.0, 0.5}
+		for idx := 0; idx < len(args)-1; idx++ {
+			expr.Values[idx], err = parseNumber(args, idx, path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := expr.checkValues(path); err != nil {
+			return nil, err
+		}
+		arg, err := parseExpr(args[len(args)-1], argPath(path, len(args)-1))
+		if err != nil {
+			return nil, err
+		}
+		expr.Args = []*Expr{arg}
+	case "geo_distance":
+		if len(args) != 4 {
+			return nil, wrongArgs
+		}
+		for idx := 0; idx < 2; idx++ {
+			value, err := parseNumber(args, idx, path)
+			if err != nil {
+				return nil, err
+			}
+			expr.Values = append(expr.Values, value)
+		}
+		for idx := 2; idx < 4; idx++ {
+			field, err := parseFieldName(args, idx, path, "geo_distance function")
+			if err != nil {
+				return nil, err
+			}
+			expr.Fields = append(expr.Fields, field)
+		}
+	case "field":
+		if len(args) != 1 && len(args) != 2 {
+			return nil, wrongArgs
+		}
+		field, err := parseFieldName(args, 0, path, "field function")
+		if err != nil {
+			return nil, err
+		}
+		expr.Fields = []string{field}
+		if len(args) == 2 {
+			deflt, err := parseNumber(args, 1, path)
+			if err != nil {
+				return nil, err
+			}
+			expr.Values = []float32{deflt}
+		}
+	case "filter":
+		if len(args) < 1 {
+			return nil, wrongArgs
+		}
+		expr.Args = make([]*Expr, len(args))
+		expr.Args[0], err = parseExpr(args[0], argPath(path, 0))
+		for idx := 1; err == nil && idx < len(args); idx++ {
+			expr.Args[idx], err = parsePredicate(args[idx], argPath(path, idx))
+		}
+	default:
+		return nil, exprErrorf(path+"[0]", "Scoring function '%s' is not recognized", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+func parsePredicate(input interface{}, path string) (*Expr, error) {
+	name, args, err := parseCall(input, path, "filter predicate")
+	if err != nil {
+		return nil, err
+	}
+	expr := &Expr{Op: name}
+	numArgs := map[string]int{"range": 3, "eq": 2, "in": 2, "geo_within": 5, "geo_box": 6}[name]
+	if numArgs == 0 {
+		return nil, exprErrorf(path+"[0]", "Filter predicate '%s' is not recognized", name)
+	}
+	if len(args) != numArgs {
+		return nil, exprErrorf(path, "Wrong number of arguments to %s predicate", name)
+	}
+	if name == "geo_within" || name == "geo_box" {
+		return parseGeoPredicate(expr, args, path)
+	}
+	field, err := parseFieldName(args, 0, path, name+" predicate")
+	if err != nil {
+		return nil, err
+	}
+	expr.Fields = []string{field}
+	switch name {
+	case "range":
+		for idx, unbounded := range []float32{NegativeInfinity, PositiveInfinity} {
+			bound, err := ToBound(args[idx+1], unbounded)
+			if err != nil {
+				return nil, &ExprError{Path: argPath(path, idx+1), Message: err.Error()}
+			}
+			expr.Values = append(expr.Values, bound)
+		}
+	case "eq":
+		value, err := parseNumber(args, 1, path)
+		if err != nil {
+			return nil, err
+		}
+		expr.Values = []float32{value}
+	case "in":
+		valuesPath := argPath(path, 1)
+		inputValues, ok := args[1].([]interface{})
+		if !ok {
+			return nil, exprErrorf(valuesPath, "Expected an array of values for in predicate; found: '%v' instead", args[1])
+		}
+		expr.Values = make([]float32, len(inputValues))
+		for idx, inputValue := range inputValues {
+			expr.Values[idx], err = ToFloat32(inputValue)
+			if err != nil {
+				return nil, &ExprError{Path: fmt.Sprintf("%s[%d]", valuesPath, idx), Message: err.Error()}
+			}
+		}
+	}
+	return expr, nil
+}
+
+// Numbers (coordinates in degrees, and a radius in km), then the latitude and longitude fields
+func parseGeoPredicate(expr *Expr, args []interface{}, path string) (*Expr, error) {
+	numValues := len(args) - 2
+	for idx := 0; idx < numValues; idx++ {
+		value, err := parseNumber(args, idx, path)
+		if err != nil {
+			return nil, err
+		}
+		expr.Values = append(expr.Values, value)
+	}
+	for idx := numValues; idx < len(args); idx++ {
+		field, err := parseFieldName(args, idx, path, expr.Op+" predicate")
+		if err != nil {
+			return nil, err
+		}
+		expr.Fields = append(expr.Fields, field)
+	}
+	if err := expr.checkValues(path); err != nil {
+		return nil, err
+	}
+	return expr, nil
+}
+
+func parsePoints(input interface{}, path string) ([]CustomPoint, error) {
+	inputPoints, ok := input.([]interface{})
+	if !ok {
+		return nil, exprErrorf(path, "Expected array of (x,y) points; found: '%v' instead", input)
+	}
+	points := make([]CustomPoint, len(inputPoints))
+	for idx, inputPoint := range inputPoints {
+		pointPath := fmt.Sprintf("%s[%d]", path, idx)
+		pair, ok := inputPoint.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, exprErrorf(pointPath, "Invalid (x,y) point; found: '%v' instead", inputPoint)
+		}
+		for coordIdx, coord := range pair {
+			value, err := ToFloat32(coord)
+			if err != nil {
+				return nil, &ExprError{Path: fmt.Sprintf("%s[%d]", pointPath, coordIdx), Message: err.Error()}
+			}
+			if coordIdx == 0 {
+				points[idx].X = value
+			} else {
+				points[idx].Y = value
+			}
+		}
+	}
+	return points, nil
+}
+
+// The JSON array form of the expression (the inverse of ParseExpr and ParsePredicate)
+func (expr *Expr) ToJson() []interface{} {
+	out := []interface{}{expr.Op}
+	number := func(value float32) interface{} {
+		if math.IsInf(float64(value), 0) { // only a range's missing bound can be infinite
+			return nil
+		}
+		return value
+	}
+	args := func() {
+		for _, arg := range expr.Args {
+			out = append(out, arg.ToJson())
+		}
+	}
+	points := func() interface{} {
+		pairs := make([]interface{}, len(expr.Points))
+		for idx, point := range expr.Points {
+			pairs[idx] = []interface{}{point.X, point.Y}
+		}
+		return pairs
+	}
+	switch expr.Op {
+	case "scale", "offset", "diff", "default":
+		out = append(out, number(expr.Values[0]))
+		args()
+	case "pow":
+		args()
+		out = append(out, number(expr.Values[0]))
+	case "custom_map":
+		out = append(out, points(), number(expr.Values[0]))
+		args()
+	case "custom_linear":
+		out = append(out, points())
+		args()
+	case "gauss", "exp", "linear", "clamp":
+		for _, value := range expr.Values {
+			out = append(out, number(value))
+		}
+		args()
+	case "geo_distance", "geo_within", "geo_box":
+		for _, value := range expr.Values {
+			out = append(out, number(value))
+		}
+		out = append(out, expr.Fields[0], expr.Fields[1])
+	case "in":
+		values := make([]interface{}, len(expr.Values))
+		for idx, value := range expr.Values {
+			values[idx] = number(value)
+		}
+		out = append(out, expr.Fields[0], values)
+	default: // sum, product, min, max, filter, field, const, range, eq, and the monotonic functions
+		for _, field := range expr.Fields {
+			out = append(out, field)
+		}
+		for _, value := range expr.Values {
+			out = append(out, number(value))
+		}
+		args()
+	}
+	return out
+}
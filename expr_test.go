@@ -0,0 +1,179 @@
+package scoredb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func parseJson(t *testing.T, text string) interface{} {
+	var input interface{}
+	err := json.Unmarshal([]byte(text), &input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input
+}
+
+func TestParseExprRoundTrip(t *testing.T) {
+	for _, text := range []string{
+		`["sum",["field","age"],["scale",2,["field","height"]]]`,
+		`["product",["pow",["field","age"],0.5],["diff",30,["field","age"]]]`,
+		`["min",["field","age",0],["default",1.5,["max",["field","a"],["field","b"]]]]`,
+		`["custom_map",[[1,2],[3,4]],0,["custom_linear",[[0,0],[30,1]],["field","age"]]]`,
+		`["geo_distance",40.7,-74,"lat","lng"]`,
+		`["product",["offset",1,["field","a"]],["sum",["const",2.5],["field","b"]]]`,
+		`["sum",["log",["field","a"]],["log1p",["field","b"]],["exp",["field","c"]],["sigmoid",["tanh",["clamp",-1,1,["field","d"]]]]]`,
+		`["sum",["gauss",20000,5000,1000,0.5,["field","price"]],["exp",0,30,0,0.25,["field","age"]],["linear",5,2,1,0.1,["field","size"]]]`,
+		`["filter",["field","year"],["range","price",null,20000],["eq","color",3],["in","color",[1,2]]]`,
+		`["filter",["field","price"],["geo_within",40.7,-74,50,"lat","lng"],["geo_box",40,-75,41.5,-73,"lat","lng"]]`,
+	} {
+		expr, err := ParseExpr(parseJson(t, text))
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		out, err := json.Marshal(expr.ToJson())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != text {
+			t.Fatalf("expected: %s found: %s", text, out)
+		}
+		if err := expr.Validate(); err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+	}
+}
+
+func TestExprValidateErrors(t *testing.T) {
+	for _, test := range []struct {
+		expr *Expr
+		path string
+	}{
+		{&Expr{Op: "scale", Args: []*Expr{Field("age")}}, "expr"},
+		{&Expr{Op: "summ", Args: []*Expr{Field("age")}}, "expr[0]"},
+		{Sum(Field("age"), nil), "expr[2]"},
+		{Scale(2.0, &Expr{Op: "field"}), "expr[2]"},
+		{PowOf(&Expr{Op: "log"}, 2.0), "expr[1]"},
+		{Decay("gauss", 0, 0, 0, 0.5, Field("age")), "expr[2]"},
+		{Filter(Field("age"), &Expr{Op: "like", Fields: []string{"color"}}), "expr[2][0]"},
+		{Filter(Eq("color", 1), Field("age")), "expr[1][0]"},
+		{Filter(Field("age"), Eq("color", 1), &Expr{Op: "range", Fields: []string{"price"}, Values: []float32{0}}), "expr[3]"},
+		{Filter(Field("age"), GeoBox(40, -75, 41, 190, "lat", "lng")), "expr[2][4]"},
+		{CustomMap([]CustomPoint{{0, 0}}, 0, Clamp(0, 1, &Expr{Op: "geo_distance", Values: []float32{40, -74}})), "expr[3][3]"},
+	} {
+		expr, path := test.expr, test.path
+		err := expr.Validate()
+		exprErr, ok := err.(*ExprError)
+		if !ok {
+			t.Fatalf("%v: expected an ExprError, found: %v", path, err)
+		}
+		if exprErr.Path != path {
+			t.Fatalf("expected an error at %s, found: %v", path, exprErr)
+		}
+	}
+}
+
+func TestParseExprBuilders(t *testing.T) {
+	built := Filter(Sum(Field("age"), Scale(2.0, FieldWithDefault("height", 1.0))), Range("price", NegativeInfinity, 20000), In("color", 1, 2))
+	parsed, err := ParseExpr(parseJson(t, `["filter", ["sum", ["field", "age"], ["scale", 2.0, ["field", "height", 1.0]]], ["range", "price", null, 20000], ["in", "color", [1, 2]]]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(built, parsed) {
+		t.Fatalf("expected: %+v found: %+v", built, parsed)
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for text, path := range map[string]string{
+		`"age"`:                      "scorer",
+		`[]`:                         "scorer",
+		`[3, ["field", "age"]]`:      "scorer[0]",
+		`["summ", ["field", "age"]]`: "scorer[0]",
+		`["sum"]`:                    "scorer",
+		`["sum", ["field", "age"], ["field", 3]]`:                "scorer[2][1]",
+		`["sum", ["field", "age"], "height"]`:                    "scorer[2]",
+		`["scale", "2", ["field", "age"]]`:                       "scorer[1]",
+		`["scale", 2.0]`:                                         "scorer",
+		`["pow", ["field", "age"], ["field", "age"]]`:            "scorer[2]",
+		`["custom_linear", [[0, 0], [30]], ["field", "a"]]`:      "scorer[1][1]",
+		`["custom_linear", [[0, 0], [30, "x"]], ["field", "a"]]`: "scorer[1][1][1]",
+		`["gauss", 0, 0, ["field", "age"]]`:                      "scorer[2]",
+		`["exp", 0, 10, 0, 1.5, ["field", "age"]]`:               "scorer[4]",
+		`["linear", 0, 10, 0, ["field", "age"]]`:                 "scorer",
+		`["log", ["field", "age"], ["field", "age"]]`:            "scorer",
+		`["const"]`:                                               "scorer",
+		`["const", "1"]`:                                          "scorer[1]",
+		`["offset", 1]`:                                           "scorer",
+		`["clamp", 5, 1, ["field", "age"]]`:                       "scorer",
+		`["clamp", 0, "1", ["field", "age"]]`:                     "scorer[2]",
+		`["geo_distance", 40.7, -74, "lat", 5]`:                   "scorer[4]",
+		`["filter", ["field", "age"], ["like", "color", 1]]`:      "scorer[2][0]",
+		`["filter", ["field", "age"], ["in", "color", [1, "2"]]]`: "scorer[2][2][1]",
+		`["filter", ["field", "age"], ["range", "price", 1]]`:     "scorer[2]",
+		`["filter", ["field", "age"], ["geo_within", 40.7, -74, -5, "lat", "lng"]]`: "scorer[2][3]",
+		`["filter", ["field", "age"], ["geo_within", 40.7, -74, 50, "lat", 5]]`:     "scorer[2][5]",
+		`["filter", ["field", "age"], ["geo_box", 40, -75, 41, 190, "lat", "lng"]]`: "scorer[2][4]",
+		`["filter", ["field", "age"], ["geo_box", 42, -75, 41, -73, "lat", "lng"]]`: "scorer[2]",
+		`["filter", ["field", "age"], ["geo_box", 40, -75, 41, "lat", "lng"]]`:      "scorer[2]",
+	} {
+		_, err := ParseExpr(parseJson(t, text))
+		exprErr, ok := err.(*ExprError)
+		if !ok {
+			t.Fatalf("%s: expected an ExprError, found: %v", text, err)
+		}
+		if exprErr.Path != path {
+			t.Fatalf("%s: expected an error at %s, found: %v", text, path, exprErr)
+		}
+	}
+
+	_, err := Query{Scorer: []interface{}{"field", "age"}, Filters: []interface{}{[]interface{}{"eq", "color", 1.0}, "color"}}.ToExpr()
+	if exprErr, ok := err.(*ExprError); !ok || exprErr.Path != "filters[1]" {
+		t.Fatalf("expected an error at filters[1], found: %v", err)
+	}
+}
+
+func TestQueryWithExpr(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	db.Index("r1", map[string]float32{"age": 32, "height": 2.0})
+	db.Index("r2", map[string]float32{"age": 25, "height": 1.5})
+	db.Index("r3", map[string]float32{"age": 16, "height": 2.5})
+
+	result, err := db.Query(Query{Limit: 2, MinScore: NegativeInfinity, Expr: Sum(Scale(-1.0, Field("age")), Scale(10.0, Field("height")))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Ids, []string{"r3", "r2"}) {
+		t.Fatalf("expected: [r3 r2] found: %v", result.Ids)
+	}
+}
+
+func TestQueryWithInvalidExpr(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	db.Index("r1", map[string]float32{"age": 32, "height": 2.0})
+
+	_, err := db.Query(Query{Limit: 1, Expr: &Expr{Op: "scale", Args: []*Expr{Field("age")}}})
+	if exprErr, ok := err.(*ExprError); !ok || exprErr.Path != "expr" {
+		t.Fatalf("expected an error at expr, found: %v", err)
+	}
+}
+
+func TestHttpInvalidScorer(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	server := &ScoreDbServer{Db: db}
+	for scorer, status := range map[string]int{
+		`["field", "age"]`:              http.StatusOK,
+		`["sum", ["field", "age"], 12]`: http.StatusBadRequest,
+		`["scale", ["field", "age"]]`:   http.StatusBadRequest,
+	} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", "/?score="+url.QueryEscape(scorer), nil))
+		if recorder.Code != status {
+			t.Fatalf("%s: expected status %d, found %d (%s)", scorer, status, recorder.Code, recorder.Body.String())
+		}
+	}
+}
@@ -13,6 +13,9 @@ type FieldDocItr struct {
 	docId    int64
 	min, max float32
 	lists    FieldDocItrs
+	release  func() // (optional) called once, when the iterator is closed
+	err      error  // the first error from a list that has been closed
+	profile  FieldProfile
 }
 
 func NewFieldDocItr(field string, lists FieldDocItrs) *FieldDocItr {
@@ -22,6 +25,7 @@ func NewFieldDocItr(field string, lists FieldDocItrs) *FieldDocItr {
 		docId: -1,
 		lists: lists,
 	}
+	itr.profile = FieldProfile{Field: field, Buckets: len(lists)}
 	min, max := float32(math.Inf(1)), float32(math.Inf(-1))
 	for _, docItr := range lists {
 		curMin, curMax := docItr.GetBounds()
@@ -57,7 +61,18 @@ func (so FieldDocItrs) Swap(i, j int) {
 	so[i], so[j] = so[j], so[i]
 }
 
-func (op *FieldDocItr) Name() string { return "FieldDocItr" }
+func (op *FieldDocItr) Name() string      { return "FieldDocItr" }
+func (op *FieldDocItr) FieldName() string { return op.field }
+func (op *FieldDocItr) FieldProfile() FieldProfile {
+	profile := op.profile
+	for _, list := range op.lists { // (lists that are still open)
+		if opener, ok := list.(OpeningDocItr); ok && opener.Opened() {
+			profile.Opened++
+		}
+	}
+	profile.Skipped = profile.Buckets - profile.Opened
+	return profile
+}
 func (op *FieldDocItr) Cur() (int64, float32) {
 	return op.docId, op.score
 }
@@ -74,7 +89,8 @@ func (op *FieldDocItr) SetBounds(min, max float32) bool {
 			if subOp.SetBounds(min, max) {
 				anyMore = true
 			} else {
-				subOp.Close()
+				op.closeList(subOp)
+				op.profile.Eliminated++
 				lists := op.lists
 				lists[idx] = lists[len(lists)-1]
 				op.lists = lists[:len(lists)-1]
@@ -90,13 +106,42 @@ func (op *FieldDocItr) SetBounds(min, max float32) bool {
 	}
 }
 
+// Closes a list that is no longer needed, keeping its error (if any)
+func (op *FieldDocItr) closeList(list DocItr) {
+	if opener, ok := list.(OpeningDocItr); ok && opener.Opened() {
+		op.profile.Opened++
+	}
+	list.Close()
+	if op.err == nil {
+		op.err = list.Err()
+	}
+}
+
+func (op *FieldDocItr) Err() error {
+	if op.err != nil {
+		return op.err
+	}
+	for _, list := range op.lists {
+		if err := list.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (op *FieldDocItr) Close() {
 	for _, list := range op.lists {
-		list.Close()
+		op.closeList(list)
+	}
+	op.lists = op.lists[:0]
+	if op.release != nil {
+		op.release()
+		op.release = nil
 	}
 }
 
 func (op *FieldDocItr) Next(minId int64) bool {
+	op.profile.NextCalls++
 	if len(op.lists) == 0 {
 		return false
 	}
@@ -108,8 +153,11 @@ func (op *FieldDocItr) Next(minId int64) bool {
 			break
 		}
 		if !op.lists[0].Next(minId) {
-			op.lists[0].Close()
+			op.closeList(op.lists[0])
 			heap.Remove(&op.lists, 0)
+			if op.err != nil { // a damaged list would silently drop results; stop instead
+				return false
+			}
 			if len(op.lists) == 0 {
 				//fmt.Printf("FieldDocItr Next(%v) %v END\n", minId, op.field)
 				return false
@@ -0,0 +1,133 @@
+package scoredb
+
+import ()
+
+// Produces the values of a field that satisfy a predicate (a range, and optionally a set of allowed values).
+// The range is applied to the field's iterator up front, so buckets entirely outside of it are never read.
+type PredicateDocItr struct {
+	min, max float32
+	values   map[float32]bool // if non-nil, only these values are accepted
+	itr      DocItr
+}
+
+func NewPredicateDocItr(itr DocItr, min, max float32, values map[float32]bool) *PredicateDocItr {
+	itr.SetBounds(min, max)
+	return &PredicateDocItr{min: min, max: max, values: values, itr: itr}
+}
+
+func (op *PredicateDocItr) Accepts(value float32) bool {
+	if value < op.min || value > op.max {
+		return false
+	}
+	return op.values == nil || op.values[value]
+}
+
+func (op *PredicateDocItr) Name() string       { return "PredicateDocItr" }
+func (op *PredicateDocItr) Children() []DocItr { return []DocItr{op.itr} }
+func (op *PredicateDocItr) Cur() (int64, float32) {
+	return op.itr.Cur()
+}
+func (op *PredicateDocItr) GetBounds() (min, max float32) {
+	return op.min, op.max
+}
+func (op *PredicateDocItr) SetBounds(min, max float32) bool {
+	op.min = Max(op.min, min)
+	op.max = Min(op.max, max)
+	if op.min > op.max {
+		return false
+	}
+	return op.itr.SetBounds(op.min, op.max)
+}
+func (op *PredicateDocItr) Close() {
+	op.itr.Close()
+}
+func (op *PredicateDocItr) Err() error {
+	return op.itr.Err()
+}
+func (op *PredicateDocItr) Next(minId int64) bool {
+	for {
+		if !op.itr.Next(minId) {
+			return false
+		}
+		docId, value := op.itr.Cur()
+		if op.Accepts(value) {
+			return true
+		}
+		minId = docId + 1
+	}
+}
+
+// Produces the scores of one iterator, for only those documents that every one of a set of predicates accepts
+type FilterDocItr struct {
+	docId      int64
+	score      float32
+	itr        DocItr
+	predicates []DocItr
+}
+
+func NewFilterDocItr(itr DocItr, predicates []DocItr) *FilterDocItr {
+	return &FilterDocItr{docId: -1, itr: itr, predicates: predicates}
+}
+
+func (op *FilterDocItr) Name() string { return "FilterDocItr" }
+func (op *FilterDocItr) Children() []DocItr {
+	return append([]DocItr{op.itr}, op.predicates...)
+}
+func (op *FilterDocItr) Cur() (int64, float32) {
+	return op.docId, op.score
+}
+func (op *FilterDocItr) GetBounds() (min, max float32) {
+	return op.itr.GetBounds()
+}
+func (op *FilterDocItr) SetBounds(min, max float32) bool {
+	return op.itr.SetBounds(min, max)
+}
+func (op *FilterDocItr) Close() {
+	op.itr.Close()
+	for _, predicate := range op.predicates {
+		predicate.Close()
+	}
+}
+func (op *FilterDocItr) Err() error {
+	if err := op.itr.Err(); err != nil {
+		return err
+	}
+	for _, predicate := range op.predicates {
+		if err := predicate.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *FilterDocItr) Next(minId int64) bool {
+	if !op.itr.Next(minId) {
+		return false
+	}
+	docId, score := op.itr.Cur()
+	for {
+		matched := true
+		for _, predicate := range op.predicates {
+			predicateDocId, _ := predicate.Cur()
+			if predicateDocId < docId {
+				if !predicate.Next(docId) {
+					return false
+				}
+				predicateDocId, _ = predicate.Cur()
+			}
+			if predicateDocId > docId { // skip the scoring iterator ahead to the next candidate
+				if !op.itr.Next(predicateDocId) {
+					return false
+				}
+				docId, score = op.itr.Cur()
+				matched = false
+				break
+			}
+		}
+		if matched {
+			op.docId = docId
+			op.score = score
+			return true
+		}
+	}
+}
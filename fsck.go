@@ -0,0 +1,313 @@
+package scoredb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// Consistency checks (and repairs) for the on-disk state of a FsScoreDb.
+// These operate directly on the files, so the shard must not be open while they run.
+
+type FsckProblem struct {
+	Path     string
+	Offset   int64 // byte offset within Path, or -1 if the problem is not at a particular location
+	Message  string
+	Repaired bool
+}
+
+func (problem FsckProblem) String() string {
+	location := problem.Path
+	if problem.Offset >= 0 {
+		location = fmt.Sprintf("%v @ byte %v", problem.Path, problem.Offset)
+	}
+	if problem.Repaired {
+		return fmt.Sprintf("%v: %v (repaired)", location, problem.Message)
+	}
+	return fmt.Sprintf("%v: %v", location, problem.Message)
+}
+
+type FsckResult struct {
+	Problems []FsckProblem
+	LiveIds  []int64 // every id in the shard that is not deleted, in order
+}
+
+// Checks every posting list in the shard at dataDir.
+// If repair is set, damaged posting lists are truncated to their last valid entry, and their headers are rewritten.
+func FsckShard(dataDir string, repair bool) (*FsckResult, error) {
+	result := &FsckResult{Problems: make([]FsckProblem, 0), LiveIds: make([]int64, 0)}
+	walPath := path.Join(dataDir, WAL_FILENAME)
+	if Exists(walPath) {
+		problem := FsckProblem{Path: walPath, Offset: -1, Message: "uncommitted batch in write-ahead log"}
+		if repair {
+			err := RecoverWriteAheadLog(dataDir)
+			if err != nil {
+				return nil, err
+			}
+			problem.Repaired = true
+		}
+		result.Problems = append(result.Problems, problem)
+	}
+	deleted, err := LoadDeletionBitmap(path.Join(dataDir, DELETION_BITMAP_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	fieldNames, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	allIds := make(map[int64]bool)
+	for _, fieldName := range fieldNames {
+		if !fieldName.IsDir() {
+			continue
+		}
+		fieldDir := path.Join(dataDir, fieldName.Name())
+		generation, _, err := readGenerationFile(fieldDir)
+		if err != nil {
+			generationPath := path.Join(fieldDir, GENERATION_FILENAME)
+			result.Problems = append(result.Problems, FsckProblem{Path: generationPath, Offset: -1, Message: "invalid generation number; the field cannot be checked"})
+			continue
+		}
+		dir := GenerationDir(fieldDir, generation)
+		dataFiles, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, dataFile := range dataFiles {
+			prefix, err := strconv.ParseUint(dataFile.Name(), 2, 32)
+			if err != nil || dataFile.IsDir() {
+				continue
+			}
+			numVarBits := uint(32 - len(dataFile.Name()))
+			problems, docIds, err := FsckPostingList(dir, uint32(prefix<<numVarBits), numVarBits, repair)
+			if err != nil {
+				return nil, err
+			}
+			result.Problems = append(result.Problems, problems...)
+			for _, docId := range docIds {
+				allIds[docId] = true
+			}
+		}
+	}
+	for docId := range allIds {
+		if !deleted.Contains(docId) {
+			result.LiveIds = append(result.LiveIds, docId)
+		}
+	}
+	sort.Slice(result.LiveIds, func(i, j int) bool { return result.LiveIds[i] < result.LiveIds[j] })
+	return result, nil
+}
+
+type fsckEntry struct {
+	docId int64
+	value float32
+}
+
+// Reads bits in the same order that BitWriter writes them, stopping at a given bit position
+type fsckBitCursor struct {
+	words []uint64
+	pos   uint64
+	end   uint64
+}
+
+func (cursor *fsckBitCursor) read(numBits uint) (uint64, bool) {
+	if numBits == 0 {
+		return 0, true
+	}
+	if cursor.pos+uint64(numBits) > cursor.end {
+		return 0, false
+	}
+	word, offset := cursor.pos/64, uint(cursor.pos%64)
+	val := cursor.words[word] << offset
+	if offset+numBits > 64 {
+		val |= cursor.words[word+1] >> (64 - offset)
+	}
+	cursor.pos += uint64(numBits)
+	return val >> (64 - numBits), true
+}
+
+// Checks a single posting list file, given the value range that its name describes.
+// Returns the problems found and the doc ids of the (valid) entries.
+func FsckPostingList(dir string, prefix uint32, numVarBits uint, repair bool) ([]FsckProblem, []int64, error) {
+	filename := PostingListFileName(dir, math.Float32frombits(prefix), numVarBits)
+	problems := make([]FsckProblem, 0)
+	report := func(offset int64, format string, args ...interface{}) {
+		problems = append(problems, FsckProblem{Path: filename, Offset: offset, Message: fmt.Sprintf(format, args...)})
+	}
+	inBucket := func(value float32) bool {
+		return math.Float32bits(value)>>numVarBits == prefix>>numVarBits
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var header PostingListHeader
+	if int64(len(buf)) < HEADER_SIZE {
+		report(0, "file is too short (%v bytes) to hold a header", len(buf))
+	} else {
+		binary.Read(bytes.NewReader(buf), binary.LittleEndian, &header)
+		if header.Version != 1 {
+			report(0, "unknown file version %v", header.Version)
+		} else if header.FirstDocId < 0 || !inBucket(header.FirstDocScore) {
+			report(0, "invalid first entry (doc id %v, value %v) in header", header.FirstDocId, header.FirstDocScore)
+		}
+	}
+	if len(problems) > 0 { // nothing in the file can be trusted
+		return fsckRepair(filename, problems, nil, repair)
+	}
+
+	// Decode the entries, stopping at the first invalid one
+	entries := []fsckEntry{fsckEntry{docId: header.FirstDocId, value: header.FirstDocScore}}
+	data := buf[HEADER_SIZE:]
+	cursor := &fsckBitCursor{words: make([]uint64, len(data)/8)}
+	for idx := range cursor.words {
+		cursor.words[idx] = ReadNativeLong(data[idx*8:])
+	}
+	footerOk := len(data)%8 == 0 && len(cursor.words) >= 2
+	if footerOk {
+		bitsUsed := cursor.words[len(cursor.words)-1]
+		footerOk = bitsUsed <= 64
+		cursor.end = uint64(len(cursor.words)-2)*64 + bitsUsed
+	}
+	if !footerOk {
+		report(HEADER_SIZE+int64(len(data)/8*8), "missing or invalid footer")
+		cursor.end = uint64(len(cursor.words)) * 64 // the entries run to the end of the file (but are probably truncated)
+	}
+	docId := header.FirstDocId
+	for cursor.pos < cursor.end {
+		offset := HEADER_SIZE + int64(cursor.pos/8)
+		sizeFactor, ok := cursor.read(2)
+		var pair, valueBits uint64
+		if ok {
+			pair, ok = cursor.read(uint(4 << sizeFactor))
+		}
+		if ok && pair&1 == 1 {
+			valueBits, ok = cursor.read(numVarBits)
+		}
+		if !ok {
+			report(offset, "truncated entry after doc id %v", docId)
+			break
+		}
+		docIncr := int64(pair >> 1)
+		if docIncr == 0 {
+			report(offset, "doc ids are not increasing after doc id %v", docId)
+			break
+		}
+		docId += docIncr
+		entries = append(entries, fsckEntry{docId: docId, value: math.Float32frombits(prefix | uint32(valueBits))})
+	}
+
+	// Compare the header to the entries that were found
+	last := entries[len(entries)-1]
+	minVal, maxVal := float32(math.Inf(1)), float32(math.Inf(-1))
+	for _, entry := range entries {
+		minVal, maxVal = Min(minVal, entry.value), Max(maxVal, entry.value)
+	}
+	if header.NumDocs != int64(len(entries)) {
+		report(0, "header has %v docs; found %v", header.NumDocs, len(entries))
+	}
+	if header.LastDocId != last.docId {
+		report(0, "header has last doc id %v; found %v", header.LastDocId, last.docId)
+	}
+	if header.MinVal != minVal || header.MaxVal != maxVal {
+		report(0, "header has values in [%v, %v]; found [%v, %v]", header.MinVal, header.MaxVal, minVal, maxVal)
+	}
+	return fsckRepair(filename, problems, entries, repair)
+}
+
+// Rewrites a damaged posting list from its valid entries (removing it if there are none)
+func fsckRepair(filename string, problems []FsckProblem, entries []fsckEntry, repair bool) ([]FsckProblem, []int64, error) {
+	docIds := make([]int64, len(entries))
+	for idx, entry := range entries {
+		docIds[idx] = entry.docId
+	}
+	if !repair || len(problems) == 0 {
+		return problems, docIds, nil
+	}
+	dir, name := path.Split(filename)
+	if len(entries) == 0 {
+		err := os.Remove(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		tmpDir, err := ioutil.TempDir(dir, ".fsck")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer os.RemoveAll(tmpDir)
+		numVarBits := uint(32 - len(name))
+		fileInfo, err := MakeFileInfo(tmpDir, entries[0].value, numVarBits, entries[0].docId)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, entry := range entries[1:] {
+			WritePostingListEntry(fileInfo, entry.docId, entry.value)
+		}
+		err = CloseWriter(fileInfo)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = SyncPath(fileInfo.path)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = os.Rename(fileInfo.path, filename)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for idx := range problems {
+		problems[idx].Repaired = true
+	}
+	return problems, docIds, SyncPath(dir)
+}
+
+// Checks that every live id in the given shards (as found by FsckShard) has a client id.
+// If repair is set, ids without a client id are deleted, since they can never be returned in query results.
+func FsckIdDb(idDb *BoltIdDb, shardDirs []string, results []*FsckResult, repair bool) ([]FsckProblem, error) {
+	problems := make([]FsckProblem, 0)
+	for shardNum, result := range results {
+		extIds := make([]int64, len(result.LiveIds))
+		for idx, docId := range result.LiveIds {
+			extIds[idx] = ShardIdToExt(docId, shardNum)
+		}
+		missing, err := idDb.FindMissing(extIds)
+		if err != nil {
+			return nil, err
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		idsInShard := make([]int64, len(missing))
+		for idx, extId := range missing {
+			idsInShard[idx], _ = ShardIdFromExt(extId)
+		}
+		if repair {
+			deleted, err := LoadDeletionBitmap(path.Join(shardDirs[shardNum], DELETION_BITMAP_FILENAME))
+			if err != nil {
+				return nil, err
+			}
+			err = deleted.Add(idsInShard)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for _, docId := range idsInShard {
+			problems = append(problems, FsckProblem{
+				Path:     shardDirs[shardNum],
+				Offset:   -1,
+				Message:  fmt.Sprintf("no client id for doc id %v", docId),
+				Repaired: repair,
+			})
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,139 @@
+package scoredb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func CheckFsck(t *testing.T, dataDir string, repair bool, numProblems int) *FsckResult {
+	result, err := FsckShard(dataDir, repair)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Problems) != numProblems {
+		t.Fatalf("Expected %v problems; found %v", numProblems, result.Problems)
+	}
+	for _, problem := range result.Problems {
+		if problem.Repaired != repair {
+			t.Fatalf("Unexpected repair status: %v", problem)
+		}
+	}
+	return result
+}
+
+func TestFsckHeader(t *testing.T) {
+	testdir := RmAllTestData()("fsck.1")
+	defer RmAllTestData()
+	fsDb := OpenFsScoreDb(t, testdir)
+	db := BaseDb{StreamingDb: BaseStreamingDb{fsDb}, IdDb: NewMemoryIdDb()}
+	for i := 0; i < 10; i++ {
+		db.Index(fmt.Sprintf("r%d", i), map[string]float32{"age": float32(100 + i)})
+	}
+	db.Delete("r3")
+	result := CheckFsck(t, testdir, false, 0)
+	if len(result.LiveIds) != 9 || result.LiveIds[0] != 1 || result.LiveIds[3] != 5 {
+		t.Fatalf("Unexpected live ids: %v", result.LiveIds)
+	}
+
+	// a header that was not rewritten after its entries were appended
+	filename := fsDb.fields["age"].files[0].path
+	fd, err := os.OpenFile(filename, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := PostingListHeader{}
+	binary.Read(fd, binary.LittleEndian, &header)
+	header.NumDocs, header.LastDocId, header.MaxVal = 5, 5, 104
+	fd.Seek(0, 0)
+	binary.Write(fd, binary.LittleEndian, &header)
+	fd.Close()
+
+	problems := CheckFsck(t, testdir, false, 3).Problems
+	if problems[0].Path != filename || problems[0].Offset != 0 {
+		t.Fatalf("Unexpected problem location: %v", problems[0])
+	}
+	CheckFsck(t, testdir, true, 3)
+	CheckFsck(t, testdir, false, 0)
+	reloaded := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: db.IdDb}
+	CallAndCheck(reloaded, t, []string{"r9", "r8"}, 2, []interface{}{"field", "age"})
+}
+
+func TestFsckTruncated(t *testing.T) {
+	testdir := RmAllTestData()("fsck.2")
+	defer RmAllTestData()
+	fsDb := OpenFsScoreDb(t, testdir)
+	db := BaseDb{StreamingDb: BaseStreamingDb{fsDb}, IdDb: NewMemoryIdDb()}
+	for i := 0; i < 100; i++ {
+		db.Index(fmt.Sprintf("r%d", i), map[string]float32{"age": float32(100 + i)})
+	}
+
+	filename := fsDb.fields["age"].files[0].path
+	err := os.Truncate(filename, HEADER_SIZE+24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the footer, the entry that spans the end of the file, and the header's doc count, last doc id and values
+	problems := CheckFsck(t, testdir, false, 5).Problems
+	if problems[1].Offset <= HEADER_SIZE || problems[1].Offset >= HEADER_SIZE+24 {
+		t.Fatalf("Unexpected problem location: %v", problems[1])
+	}
+	CheckFsck(t, testdir, true, 5)
+	result := CheckFsck(t, testdir, false, 0)
+
+	// the valid entries remain
+	numLive := len(result.LiveIds)
+	if numLive < 2 || numLive >= 100 {
+		t.Fatalf("Unexpected live ids: %v", result.LiveIds)
+	}
+	reloaded := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: db.IdDb}
+	CallAndCheck(reloaded, t, []string{"r99", "r98"}, 2, []interface{}{"field", "age"})
+	queryResult, err := reloaded.Query(Query{Limit: 100, Scorer: []interface{}{"field", "age"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queryResult.Ids) != numLive {
+		t.Fatalf("Expected %v results after repair; found %v", numLive, len(queryResult.Ids))
+	}
+}
+
+func TestFsckIdDb(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	idDb, err := NewBoltIdDb(pathmaker("fsck_ids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardDirs := []string{pathmaker("fsck_shard_1"), pathmaker("fsck_shard_2")}
+	db := BaseDb{
+		StreamingDb: ShardedDb{
+			Shards: []StreamingDb{
+				BaseStreamingDb{OpenFsScoreDb(t, shardDirs[0])},
+				BaseStreamingDb{OpenFsScoreDb(t, shardDirs[1])},
+			},
+		},
+		IdDb: idDb,
+	}
+	for i := 0; i < 10; i++ {
+		db.Index(fmt.Sprintf("r%d", i), map[string]float32{"age": float32(100 + i)})
+	}
+	idDb.Delete([]string{"r9"}) // (as if the process died between indexing and storing the client id)
+
+	results := []*FsckResult{CheckFsck(t, shardDirs[0], false, 0), CheckFsck(t, shardDirs[1], false, 0)}
+	problems, err := FsckIdDb(idDb, shardDirs, results, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !problems[0].Repaired {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+	results = []*FsckResult{CheckFsck(t, shardDirs[0], false, 0), CheckFsck(t, shardDirs[1], false, 0)}
+	problems, err = FsckIdDb(idDb, shardDirs, results, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected problems after repair: %v", problems)
+	}
+}
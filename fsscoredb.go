@@ -8,73 +8,229 @@ import (
 	"math"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	//"time"
 )
 
-func NewFsScoreDb(dataDir string) *FsScoreDb {
+func NewFsScoreDb(dataDir string) (*FsScoreDb, error) {
 	err := EnsureDirectory(dataDir)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	err = RecoverWriteAheadLog(dataDir)
+	if err != nil {
+		return nil, err
 	}
-	fields := make(map[string]OrderedFileInfos)
+	fields := make(map[string]*FieldFiles)
 
 	// Load pre-existing file headers
-	highestId := int64(0)
 	fieldNames, err := ioutil.ReadDir(dataDir)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	for _, fieldName := range fieldNames {
-		fieldPath := path.Join(dataDir, fieldName.Name())
-		fields[fieldPath] = make(OrderedFileInfos, 0)
-		dataFiles, err := ioutil.ReadDir(fieldPath)
+		if !fieldName.IsDir() { // (the deletion bitmap lives alongside the field directories)
+			continue
+		}
+		fieldDir := path.Join(dataDir, fieldName.Name())
+		fieldFiles, err := LoadFieldFiles(fieldDir)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		for _, dataFile := range dataFiles {
-			numVarBits := 32 - len(dataFile.Name())
-			prefixVal, err := strconv.ParseInt(dataFile.Name(), 2, 32)
-			if err != nil {
-				continue
-			}
-			dataFilePath := path.Join(fieldPath, dataFile.Name())
-			fd, err := os.OpenFile(dataFilePath, os.O_RDONLY, 0)
-			if err != nil {
-				panic(err)
-			}
-			var header PostingListHeader
-			err = binary.Read(fd, binary.LittleEndian, &header)
-			if err != nil {
-				panic(err)
-			}
-			fd.Close()
-			if header.LastDocId > highestId {
-				highestId = header.LastDocId
-			}
-			fileInfo := &FileInfo{
-				header:          &header,
-				path:            dataFilePath,
-				numVariableBits: uint(numVarBits),
-				minVal:          math.Float32frombits(uint32(prefixVal << uint(numVarBits))),
-			}
-			fields[fieldName.Name()] = append(fields[fieldName.Name()], fileInfo)
+		err = RemoveStaleGenerations(fieldDir, fieldFiles.generation)
+		if err != nil {
+			return nil, err
 		}
+		fields[fieldName.Name()] = fieldFiles
+	}
 
+	deleted, err := LoadDeletionBitmap(path.Join(dataDir, DELETION_BITMAP_FILENAME))
+	if err != nil {
+		return nil, err
 	}
 
-	//fmt.Printf("INIT fs score db %v (highest id %d)\n", dataDir, highestId)
-	return &FsScoreDb{
+	db := &FsScoreDb{
 		dataDir: dataDir,
 		fields:  fields,
-		nextId:  highestId + 1,
+		deleted: deleted,
 	}
+	db.nextId = db.highestId() + 1
+	db.committedId = db.nextId - 1
+	//fmt.Printf("INIT fs score db %v (highest id %d)\n", dataDir, db.nextId-1)
+	return db, nil
 }
 
+func (db *FsScoreDb) highestId() int64 {
+	highestId := db.deleted.HighestId() // (compaction may have removed every other trace of the highest ids)
+	for _, fieldFiles := range db.fields {
+		for _, fileInfo := range fieldFiles.files {
+			if fileInfo.header != nil && fileInfo.header.LastDocId > highestId {
+				highestId = fileInfo.header.LastDocId
+			}
+		}
+	}
+	return highestId
+}
+
+// Any number of queries may run alongside a single writer:
+//
+// Writes (indexing, deletion, and compaction) are serialized by writeLock.
+// Queries only take the read side of fieldsLock, long enough to capture the current files of a field, and their headers.
+// A batch writes new headers privately (see FileInfo.pending), and publishes them under fieldsLock once it commits,
+// so queries see each posting list as of the last committed batch (its LastDocId does not move under them).
+// Posting lists are only appended to, so the committed entries can be read while a batch writes more.
+// Deletions are the exception: they apply immediately, even to queries in progress.
 type FsScoreDb struct {
-	dataDir string
-	fields  map[string]OrderedFileInfos
-	nextId  int64
+	// If set, the values of newly indexed documents are also kept in a forward store, so that FieldValues() can return them.
+	// This should be set (or not) for the whole life of the database; documents indexed while it is unset have no stored values.
+	StoreValues bool
+
+	dataDir      string
+	fields       map[string]*FieldFiles
+	nextId       int64
+	committedId  int64 // the highest id in a committed batch (accessed atomically, since queries read it)
+	deleted      *DeletionBitmap
+	wal          *WriteAheadLog          // non-nil while a batch is being written
+	valueWriters map[string]*ValueWriter // open while a batch is being written
+	writeLock    sync.Mutex
+	fieldsLock   sync.RWMutex
+	closed       bool // (guarded by writeLock) see Close()
+}
+
+var ErrClosed = errors.New("The database has been closed")
+
+// The set of posting list files that make up a field.
+// Compaction replaces the whole set with a new generation, stored in a new directory.
+// Files from a replaced generation are removed once the last query reading them is closed.
+type FieldFiles struct {
+	fieldDir   string
+	generation int
+	files      OrderedFileInfos
+
+	deletionsAtCompaction int // the number of deleted ids when these files were written by compaction (see GENERATION_FILENAME)
+
+	lock    sync.Mutex // guards the fields below
+	readers int
+	retired bool
+}
+
+// Holds the generation of a field in use, and the number of deleted ids when compaction wrote it
+var GENERATION_FILENAME = "GENERATION"
+
+func GenerationDir(fieldDir string, generation int) string {
+	if generation == 0 { // the original layout, with posting lists directly inside the field directory
+		return fieldDir
+	}
+	return path.Join(fieldDir, fmt.Sprintf("gen.%d", generation))
+}
+
+func (fieldFiles *FieldFiles) Dir() string {
+	return GenerationDir(fieldFiles.fieldDir, fieldFiles.generation)
+}
+
+func LoadFieldFiles(fieldDir string) (*FieldFiles, error) {
+	generation, deletionsAtCompaction, err := readGenerationFile(fieldDir)
+	if err != nil {
+		return nil, err
+	}
+	fieldFiles := &FieldFiles{
+		fieldDir:              fieldDir,
+		generation:            generation,
+		files:                 make(OrderedFileInfos, 0),
+		deletionsAtCompaction: deletionsAtCompaction,
+	}
+	dir := fieldFiles.Dir()
+	dataFiles, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dataFile := range dataFiles {
+		numVarBits := 32 - len(dataFile.Name())
+		prefixVal, err := strconv.ParseInt(dataFile.Name(), 2, 32)
+		if err != nil {
+			continue
+		}
+		dataFilePath := path.Join(dir, dataFile.Name())
+		header, err := readPostingListHeader(dataFilePath)
+		if err != nil {
+			return nil, err
+		}
+		fileInfo := &FileInfo{
+			header:          header,
+			path:            dataFilePath,
+			numVariableBits: uint(numVarBits),
+			minVal:          math.Float32frombits(uint32(prefixVal << uint(numVarBits))),
+		}
+		fieldFiles.files = append(fieldFiles.files, fileInfo)
+	}
+	return fieldFiles, nil
+}
+
+// Removes the files of every generation other than the given one.
+// These are either replaced generations that were still being read at shutdown, or the output of an interrupted compaction.
+func RemoveStaleGenerations(fieldDir string, generation int) error {
+	entries, err := ioutil.ReadDir(fieldDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		var stale bool
+		if entry.IsDir() {
+			stale = strings.HasPrefix(name, "gen.") && name != path.Base(GenerationDir(fieldDir, generation))
+		} else {
+			_, parseErr := strconv.ParseInt(name, 2, 32)
+			stale = parseErr == nil && generation != 0
+		}
+		if stale {
+			err = os.RemoveAll(path.Join(fieldDir, name))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Registers a new query reading these files; the returned function must be called when it is done
+func (fieldFiles *FieldFiles) Acquire() func() {
+	fieldFiles.lock.Lock()
+	fieldFiles.readers += 1
+	fieldFiles.lock.Unlock()
+	return func() {
+		fieldFiles.lock.Lock()
+		fieldFiles.readers -= 1
+		removeNow := fieldFiles.retired && fieldFiles.readers == 0
+		fieldFiles.lock.Unlock()
+		if removeNow {
+			fieldFiles.remove()
+		}
+	}
+}
+
+// Marks these files as replaced, removing them as soon as no query is reading them
+func (fieldFiles *FieldFiles) Retire() {
+	fieldFiles.lock.Lock()
+	fieldFiles.retired = true
+	removeNow := fieldFiles.readers == 0
+	fieldFiles.lock.Unlock()
+	if removeNow {
+		fieldFiles.remove()
+	}
+}
+
+func (fieldFiles *FieldFiles) remove() {
+	if fieldFiles.generation != 0 {
+		os.RemoveAll(fieldFiles.Dir())
+		return
+	}
+	for _, fileInfo := range fieldFiles.files {
+		os.Remove(fileInfo.path)
+	}
 }
 
 type PostingListHeader struct {
@@ -91,7 +247,8 @@ type PostingListHeader struct {
 }
 
 type FileInfo struct {
-	header          *PostingListHeader
+	header          *PostingListHeader // as of the last committed batch (nil for a new file until then); replaced, but never modified
+	pending         *PostingListHeader // the header that the current batch is writing, if any
 	writer          *BitWriter
 	path            string
 	numVariableBits uint    // number of bits at the bottom of the float that are variable (smaller means it is a more specific bucket)
@@ -114,13 +271,20 @@ func (a OrderedFileInfos) Less(i, j int) bool {
 
 func MaxDocsForFile(fileInfo *FileInfo) int64 {
 	header := fileInfo.header
+	if fileInfo.pending != nil {
+		header = fileInfo.pending
+	}
 	if header.MinVal == header.MaxVal { // do not split single-valued lists
 		return math.MaxInt64
 	}
-	if fileInfo.numVariableBits <= 0 { // do not split lists at full precision
+	return MaxDocsForBucket(fileInfo.numVariableBits)
+}
+
+func MaxDocsForBucket(numVariableBits uint) int64 {
+	if numVariableBits <= 0 { // do not split lists at full precision
 		return math.MaxInt64
 	}
-	fixedFractionBits := 23 - fileInfo.numVariableBits // 23 bits is size of the fraction part
+	fixedFractionBits := 23 - numVariableBits // 23 bits is size of the fraction part
 	return 20*1568 + (1 << (fixedFractionBits))
 }
 
@@ -140,18 +304,21 @@ func EnsureDirectory(dir string) error {
 }
 
 var INITIAL_VAR_BITS = uint(23 - 0)
+var DELETION_BITMAP_FILENAME = ".deleted"
 var HEADER_SIZE = int64(binary.Size(PostingListHeader{}))
-var numOpenFiles = 0
+var numOpenFiles = int64(0) // (accessed atomically)
 
 func FindPostingListFileForWrite(db *FsScoreDb, docId int64, key string, value float32) (*FileInfo, error) {
 	var err error
-	fieldDir := path.Join(db.dataDir, key)
-	files, ok := db.fields[key]
+	fieldFiles, ok := db.fields[key]
 	if !ok {
-		db.fields[key] = make(OrderedFileInfos, 0)
-		files = db.fields[key]
-		EnsureDirectory(fieldDir)
+		fieldFiles = &FieldFiles{fieldDir: path.Join(db.dataDir, key), files: make(OrderedFileInfos, 0)}
+		EnsureDirectory(fieldFiles.Dir())
+		db.fieldsLock.Lock()
+		db.fields[key] = fieldFiles
+		db.fieldsLock.Unlock()
 	}
+	files := fieldFiles.files
 	var fileInfo *FileInfo = nil
 	bestVarBits := uint(32)
 	// TODO idea here is that we should be able to use the ordering of OrderedFileInfos to
@@ -166,32 +333,43 @@ func FindPostingListFileForWrite(db *FsScoreDb, docId int64, key string, value f
 		}
 	}
 	if fileInfo == nil { // no matching posting list found
-		fileInfo, err = MakeFileInfo(fieldDir, value, INITIAL_VAR_BITS, docId)
+		err = db.logFileWrite(PostingListFileName(fieldFiles.Dir(), value, INITIAL_VAR_BITS))
 		if err != nil {
 			return nil, err
 		}
-		files = append(files, fileInfo)
-		db.fields[key] = files
+		fileInfo, err = MakeFileInfo(fieldFiles.Dir(), value, INITIAL_VAR_BITS, docId)
 		if err != nil {
 			return nil, err
 		}
+		db.fieldsLock.Lock()
+		fieldFiles.files = append(files, fileInfo)
+		db.fieldsLock.Unlock()
 	} else {
-		if fileInfo.header.NumDocs >= MaxDocsForFile(fileInfo) {
+		if fileInfo.writeHeader().NumDocs >= MaxDocsForFile(fileInfo) {
 			newBits := uint(fileInfo.numVariableBits - 3)
 			if newBits < 0 {
 				newBits = 0
 			}
-			fileInfo, err = MakeFileInfo(fieldDir, value, newBits, docId)
+			err = db.logFileWrite(PostingListFileName(fieldFiles.Dir(), value, newBits))
 			if err != nil {
 				return nil, err
 			}
-			files = append(files, fileInfo)
-			db.fields[key] = files
+			fileInfo, err = MakeFileInfo(fieldFiles.Dir(), value, newBits, docId)
+			if err != nil {
+				return nil, err
+			}
+			db.fieldsLock.Lock()
+			fieldFiles.files = append(files, fileInfo)
+			db.fieldsLock.Unlock()
 		}
 	}
 
 	if fileInfo.writer == nil {
-		numOpenFiles += 1
+		err = db.logFileWrite(fileInfo.path)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&numOpenFiles, 1)
 		fd, err := os.OpenFile(fileInfo.path, os.O_RDWR, 0666)
 		if err != nil {
 			return nil, err
@@ -201,7 +379,7 @@ func FindPostingListFileForWrite(db *FsScoreDb, docId int64, key string, value f
 		if err != nil {
 			return nil, err
 		}
-		fileInfo.header = &header
+		fileInfo.pending = &header
 		writer, err := NewBitWriter(fd)
 		if err != nil {
 			return nil, err
@@ -211,6 +389,27 @@ func FindPostingListFileForWrite(db *FsScoreDb, docId int64, key string, value f
 	return fileInfo, nil
 }
 
+// Records that the given file is about to be modified by the current batch
+func (db *FsScoreDb) logFileWrite(filePath string) error {
+	if db.wal == nil {
+		return nil
+	}
+	relPath, err := filepath.Rel(db.dataDir, filePath)
+	if err != nil {
+		return err
+	}
+	return db.wal.LogFile(relPath)
+}
+
+// The posting list file for the bucket with the given number of variable bits that includes value
+func PostingListFileName(fieldDir string, value float32, numVarBits uint) string {
+	scoreBits := math.Float32bits(value)
+	numFixedBits := 32 - numVarBits
+	scoreBitString := fmt.Sprintf("%032b", int64(scoreBits))
+	fixedBits := scoreBitString[:numFixedBits]
+	return path.Join(fieldDir, fixedBits)
+}
+
 func MakeFileInfo(fieldDir string, value float32, numVarBits uint, docId int64) (*FileInfo, error) {
 	var fd *os.File
 	var err error
@@ -218,13 +417,11 @@ func MakeFileInfo(fieldDir string, value float32, numVarBits uint, docId int64)
 
 	scoreBits := math.Float32bits(value)
 	minVal := math.Float32frombits((scoreBits >> numVarBits) << numVarBits)
-	numFixedBits := 32 - numVarBits
-	scoreBitString := fmt.Sprintf("%032b", int64(scoreBits))
-	fixedBits := scoreBitString[:numFixedBits]
-	filename := path.Join(fieldDir, fixedBits)
+	filename := PostingListFileName(fieldDir, value, numVarBits)
 
+	var committed *PostingListHeader
 	if Exists(filename) {
-		numOpenFiles += 1
+		atomic.AddInt64(&numOpenFiles, 1)
 		fd, err = os.OpenFile(filename, os.O_RDWR, 0666)
 		if err != nil {
 			return nil, err
@@ -233,9 +430,11 @@ func MakeFileInfo(fieldDir string, value float32, numVarBits uint, docId int64)
 		if err != nil {
 			return nil, err
 		}
+		committedHeader := header
+		committed = &committedHeader
 		fd.Seek(0, 2) // Goto EOF (whence=2 means "relative to end")
 	} else {
-		numOpenFiles += 1
+		atomic.AddInt64(&numOpenFiles, 1)
 		fd, err = os.Create(filename)
 		if err != nil {
 			return nil, err
@@ -262,7 +461,8 @@ func MakeFileInfo(fieldDir string, value float32, numVarBits uint, docId int64)
 		return nil, err
 	}
 	return &FileInfo{
-		header:          &header,
+		header:          committed,
+		pending:         &header,
 		writer:          writer,
 		path:            filename,
 		numVariableBits: numVarBits,
@@ -270,8 +470,23 @@ func MakeFileInfo(fieldDir string, value float32, numVarBits uint, docId int64)
 	}, nil
 }
 
+// The header as of the current batch
+func (fileInfo *FileInfo) writeHeader() *PostingListHeader {
+	if fileInfo.pending != nil {
+		return fileInfo.pending
+	}
+	return fileInfo.header
+}
+
+// Makes the header written by the current batch visible to queries (once the batch has committed)
+func (fileInfo *FileInfo) publish() {
+	if fileInfo.pending != nil {
+		fileInfo.header, fileInfo.pending = fileInfo.pending, nil
+	}
+}
+
 func WritePostingListEntry(fileInfo *FileInfo, docId int64, score float32) {
-	header := fileInfo.header
+	header := fileInfo.pending
 	docIncr := docId - header.LastDocId
 
 	if docIncr == 0 {
@@ -301,63 +516,83 @@ func WritePostingListEntry(fileInfo *FileInfo, docId int64, score float32) {
 
 }
 
+func (op *PostingListDocItr) Err() error {
+	return op.err
+}
+
 func (op *PostingListDocItr) Close() {
 	if op.reader != nil {
-		numOpenFiles -= 1
+		atomic.AddInt64(&numOpenFiles, -1)
 		err := op.reader.Close()
-		if err != nil {
-			panic(fmt.Sprintf("%v", err))
+		op.reader = nil
+		if err != nil && op.err == nil {
+			op.err = err
 		}
 	}
 }
 
+// Records an error and stops the iterator
+func (op *PostingListDocItr) fail(err error) bool {
+	op.err = err
+	return false
+}
+
 func (op *PostingListDocItr) Next(minId int64) bool {
+	if op.err != nil {
+		return false
+	}
 	reader := op.reader
+	docId := op.docId
 	if reader == nil {
-		if op.docId == -1 && minId <= op.header.FirstDocId {
+		if op.docId == -1 && minId <= op.header.FirstDocId && !op.deleted.Contains(op.header.FirstDocId) {
 			op.docId = op.header.FirstDocId
 			op.score = op.header.FirstDocScore
 			return true
 		} else {
 			//fmt.Printf("%08d Open       @doc %08d %s\n", time.Now().UnixNano() % 100000000, minId, op.path)
 			fd, err := os.OpenFile(op.path, os.O_RDONLY, 0)
-			numOpenFiles += 1
 			if err != nil {
-				panic(fmt.Sprintf("%v", err))
+				return op.fail(err)
 			}
 			_, err = fd.Seek(HEADER_SIZE, 0)
 			if err != nil {
-				panic(fmt.Sprintf("%v", err))
+				fd.Close()
+				return op.fail(err)
 			}
 			reader, err = NewBitReader(fd)
 			if err != nil {
-				panic(fmt.Sprintf("%v", err))
+				fd.Close()
+				return op.fail(fmt.Errorf("%v: %v", op.path, err))
 			}
+			atomic.AddInt64(&numOpenFiles, 1)
 			op.reader = reader
+			op.opened = true
+			if docId == -1 { // entries are stored as increments from the first doc id in the header
+				docId = op.header.FirstDocId
+			}
 		}
 	}
-	docId := op.docId
 	for {
 		if docId == op.maxDocId {
 			return false
 		}
 		pair, err := reader.ReadVarUInt32()
 		if err != nil {
-			panic(fmt.Sprintf("%v", err))
+			return op.fail(fmt.Errorf("%v: %v", op.path, err))
 		}
 		docIncr := pair >> 1
 		var valueBits uint64
 		if pair&1 == 1 {
 			valueBits, err = reader.ReadBits(op.numVarBits)
 			if err != nil {
-				panic(fmt.Sprintf("%v", err))
+				return op.fail(fmt.Errorf("%v: %v", op.path, err))
 			}
 		}
-		if docIncr == 0 {
-			panic(fmt.Sprintf("Inconsistent file data @ %v %v", reader.MmapPtr*8, op.path))
+		if docIncr == 0 || docId+int64(docIncr) > op.maxDocId {
+			return op.fail(fmt.Errorf("Inconsistent file data @ %v %v", reader.MmapPtr*8, op.path))
 		}
 		docId += int64(docIncr)
-		if docId < minId {
+		if docId < minId || op.deleted.Contains(docId) {
 			continue
 		}
 		score := math.Float32frombits(op.rangePrefix | uint32(valueBits))
@@ -367,7 +602,46 @@ func (op *PostingListDocItr) Next(minId int64) bool {
 	}
 }
 
+// Each batch is atomic: if it fails (or the process crashes) partway through, none of it is visible.
 func (db *FsScoreDb) BulkIndex(records []map[string]float32) ([]int64, error) {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	wal, err := OpenWriteAheadLog(db.dataDir)
+	if err != nil {
+		return nil, err
+	}
+	db.wal = wal
+	defer func() { db.wal = nil }()
+
+	ids, err := db.writeRecords(records)
+	if err == nil {
+		err = CloseWriters(db)
+	}
+	if err == nil {
+		err = wal.Commit()
+	}
+	if err != nil {
+		rollbackErr := db.rollback()
+		if rollbackErr != nil {
+			return nil, fmt.Errorf("%v (and then rollback failed: %v)", err, rollbackErr)
+		}
+		return nil, err
+	}
+	db.fieldsLock.Lock()
+	for _, fieldFiles := range db.fields {
+		for _, fileInfo := range fieldFiles.files {
+			fileInfo.publish()
+		}
+	}
+	db.fieldsLock.Unlock()
+	atomic.StoreInt64(&db.committedId, db.nextId-1)
+	return ids, nil
+}
+
+func (db *FsScoreDb) writeRecords(records []map[string]float32) ([]int64, error) {
 	ids := make([]int64, len(records))
 	for idx, record := range records {
 		docid := db.nextId
@@ -378,71 +652,226 @@ func (db *FsScoreDb) BulkIndex(records []map[string]float32) ([]int64, error) {
 				return nil, err
 			}
 			WritePostingListEntry(fileInfo, docid, value)
-			ids[idx] = docid
+			if db.StoreValues {
+				err = db.writeValue(docid, key, value)
+				if err != nil {
+					return nil, err
+				}
+			}
 		}
+		ids[idx] = docid
 	}
-	CloseWriters(db)
 	return ids, nil
 }
 
-func CloseWriters(db *FsScoreDb) error {
-	for _, fieldIndex := range db.fields {
-		for idx, fileInfo := range fieldIndex {
-			writer := fileInfo.writer
-			if writer == nil {
-				continue
-			}
-			origPos, err := writer.File.Seek(0, 1) // save position to restore later
-			if err != nil {
-				return err
+func (db *FsScoreDb) writeValue(docId int64, field string, value float32) error {
+	valueWriter, ok := db.valueWriters[field]
+	if !ok {
+		valuesPath := path.Join(db.dataDir, field, VALUES_FILENAME)
+		err := db.logFileWrite(valuesPath)
+		if err != nil {
+			return err
+		}
+		valueWriter, err = OpenValueWriter(valuesPath)
+		if err != nil {
+			return err
+		}
+		if db.valueWriters == nil {
+			db.valueWriters = make(map[string]*ValueWriter)
+		}
+		db.valueWriters[field] = valueWriter
+	}
+	return valueWriter.Write(docId, value)
+}
+
+// Abandons the current batch: restores the files it modified, drops the files it created, and reloads the
+// headers of the files it touched.  Each field keeps its FieldFiles, since queries in progress hold them.
+func (db *FsScoreDb) rollback() error {
+	for _, fieldFiles := range db.fields {
+		for _, fileInfo := range fieldFiles.files {
+			if fileInfo.writer != nil {
+				fileInfo.writer.File.Close()
+				atomic.AddInt64(&numOpenFiles, -1)
+				fileInfo.writer = nil
 			}
-			_, err = writer.File.Seek(0, 0)
-			if err != nil {
-				return err
+		}
+	}
+	for field, valueWriter := range db.valueWriters {
+		valueWriter.file.Close() // (discarding anything still buffered)
+		delete(db.valueWriters, field)
+	}
+	db.wal.file.Close()
+	err := RecoverWriteAheadLog(db.dataDir)
+	if err != nil {
+		return err
+	}
+	db.fieldsLock.Lock()
+	defer db.fieldsLock.Unlock()
+	for _, fieldFiles := range db.fields {
+		files := make(OrderedFileInfos, 0, len(fieldFiles.files))
+		for _, fileInfo := range fieldFiles.files {
+			if fileInfo.header == nil { // (created by the batch, and removed again by the log)
+				continue
 			}
-			err = binary.Write(writer.File, binary.LittleEndian, fileInfo.header)
-			if err != nil {
-				return err
+			if fileInfo.pending != nil {
+				fileInfo.pending = nil
+				header, err := readPostingListHeader(fileInfo.path)
+				if err != nil {
+					return err
+				}
+				fileInfo.header = header
 			}
-			_, err = writer.File.Seek(origPos, 0)
-			if err != nil {
-				return err
+			files = append(files, fileInfo)
+		}
+		fieldFiles.files = files
+	}
+	db.nextId = db.highestId() + 1
+	atomic.StoreInt64(&db.committedId, db.nextId-1)
+	return nil
+}
+
+func readPostingListHeader(filePath string) (*PostingListHeader, error) {
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	var header PostingListHeader
+	err = binary.Read(fd, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, err
+	}
+	return &header, nil
+}
+
+func CloseWriters(db *FsScoreDb) error {
+	for field, valueWriter := range db.valueWriters {
+		delete(db.valueWriters, field)
+		err := valueWriter.Close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, fieldFiles := range db.fields {
+		for _, fileInfo := range fieldFiles.files {
+			if fileInfo.writer == nil {
+				continue
 			}
-			err = writer.Close()
+			err := CloseWriter(fileInfo)
 			if err != nil {
 				return err
 			}
-			numOpenFiles -= 1
-			fieldIndex[idx].writer = nil
 		}
 	}
 	return nil
 }
 
-func (db *FsScoreDb) Index(record map[string]float32) (int64, error) {
-	docid := db.nextId
-	db.nextId += 1
-	for key, value := range record {
-		fileInfo, err := FindPostingListFileForWrite(db, docid, key, value)
+// Saves the header of a posting list that was opened for writing, and closes it
+func CloseWriter(fileInfo *FileInfo) error {
+	writer := fileInfo.writer
+	origPos, err := writer.File.Seek(0, 1) // save position to restore later
+	if err != nil {
+		return err
+	}
+	_, err = writer.File.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(writer.File, binary.LittleEndian, fileInfo.pending)
+	if err != nil {
+		return err
+	}
+	_, err = writer.File.Seek(origPos, 0)
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&numOpenFiles, -1)
+	fileInfo.writer = nil
+	return nil
+}
+
+// Returns the stored values (see StoreValues) of the given fields for each of the given documents.
+// Fields that a document has no value for (and every field of a deleted document) are absent from its map.
+func (db *FsScoreDb) FieldValues(ids []int64, fields []string) ([]map[string]float32, error) {
+	if !db.StoreValues {
+		return nil, fmt.Errorf("The database at %v does not store field values", db.dataDir)
+	}
+	results := make([]map[string]float32, len(ids))
+	for idx := range results {
+		results[idx] = make(map[string]float32)
+	}
+	for _, field := range fields {
+		db.fieldsLock.RLock()
+		fieldFiles, ok := db.fields[field]
+		db.fieldsLock.RUnlock()
+		if !ok {
+			continue
+		}
+		values, err := ReadValues(path.Join(fieldFiles.fieldDir, VALUES_FILENAME), ids)
 		if err != nil {
-			return -1, err
+			return nil, err
+		}
+		for idx, value := range values {
+			if !math.IsNaN(float64(value)) && !db.deleted.Contains(ids[idx]) {
+				results[idx][field] = value
+			}
 		}
-		WritePostingListEntry(fileInfo, docid, value)
 	}
-	CloseWriters(db)
-	return docid, nil
+	return results, nil
+}
+
+func (db *FsScoreDb) Index(record map[string]float32) (int64, error) {
+	ids, err := db.BulkIndex([]map[string]float32{record})
+	if err != nil {
+		return -1, err
+	}
+	return ids[0], nil
+}
+
+// Deleted ids are recorded in a per-shard bitmap; their entries remain in the posting lists but are skipped over.
+func (db *FsScoreDb) Delete(ids []int64) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.deleted.Add(ids)
+}
+
+// Waits for any change in progress, then refuses later ones (and stops CompactPeriodically()).
+// No files are held open between changes, so queries that have already started may finish.
+func (db *FsScoreDb) Close() error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	db.closed = true
+	return nil
+}
+
+func (db *FsScoreDb) AllDocsItr() DocItr {
+	return NewAllDocsItr(1, atomic.LoadInt64(&db.committedId), db.deleted.Contains)
 }
 
 func (db *FsScoreDb) FieldDocItr(fieldName string) DocItr {
-	files, ok := db.fields[fieldName]
+	db.fieldsLock.RLock()
+	defer db.fieldsLock.RUnlock()
+	fieldFiles, ok := db.fields[fieldName]
 	if !ok {
 		return NewMemoryScoreDocItr([]float32{})
 	}
-	itrs := make([]DocItr, len(files))
-	for fileIdx, fileInfo := range files {
-		itrs[fileIdx] = NewPostingListDocItr(math.Float32bits(fileInfo.minVal), fileInfo.path, fileInfo.header, fileInfo.numVariableBits)
+	itrs := make([]DocItr, 0, len(fieldFiles.files))
+	for _, fileInfo := range fieldFiles.files {
+		if fileInfo.header == nil { // (created by a batch that has not committed yet)
+			continue
+		}
+		itrs = append(itrs, NewPostingListDocItr(math.Float32bits(fileInfo.minVal), fileInfo.path, fileInfo.header, fileInfo.numVariableBits, db.deleted))
 	}
-	return NewFieldDocItr(fieldName, itrs)
+	itr := NewFieldDocItr(fieldName, itrs)
+	itr.release = fieldFiles.Acquire()
+	return itr
 }
 
 type PostingListDocItr struct {
@@ -455,9 +884,12 @@ type PostingListDocItr struct {
 	path        string
 	reader      *BitReader
 	header      *PostingListHeader
+	deleted     *DeletionBitmap
+	opened      bool
+	err         error
 }
 
-func NewPostingListDocItr(rangePrefix uint32, path string, header *PostingListHeader, numVarBits uint) DocItr {
+func NewPostingListDocItr(rangePrefix uint32, path string, header *PostingListHeader, numVarBits uint, deleted *DeletionBitmap) DocItr {
 	itr := &PostingListDocItr{
 		score:       0.0,
 		docId:       -1,
@@ -468,11 +900,13 @@ func NewPostingListDocItr(rangePrefix uint32, path string, header *PostingListHe
 		rangePrefix: rangePrefix,
 		path:        path,
 		header:      header,
+		deleted:     deleted,
 	}
 	return itr
 }
 
 func (op *PostingListDocItr) Name() string { return "PostingListDocItr" }
+func (op *PostingListDocItr) Opened() bool { return op.opened }
 func (op *PostingListDocItr) Cur() (int64, float32) {
 	return op.docId, op.score
 }
@@ -2,20 +2,186 @@ package scoredb
 
 import (
 	"fmt"
+	"os"
+	"reflect"
+	"sync"
 	"testing"
 )
 
+func OpenFsScoreDb(t *testing.T, dataDir string) *FsScoreDb {
+	db, err := NewFsScoreDb(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
 func TestFsScore(t *testing.T) {
 	testdir := RmAllTestData()("fsscoredb.1")
 	defer RmAllTestData()
-	db := BaseDb{StreamingDb: BaseStreamingDb{NewFsScoreDb(testdir)}, IdDb: NewMemoryIdDb()}
+	db := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: NewMemoryIdDb()}
 	DbBasicsTest(db, t)
 }
 
+func TestFsScoreDelete(t *testing.T) {
+	testdir := RmAllTestData()("fsscoredb.3")
+	defer RmAllTestData()
+	db := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: NewMemoryIdDb()}
+	DbDeleteTest(db, t)
+
+	// deletions survive a reload
+	reloaded := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: db.IdDb}
+	CallAndCheck(reloaded, t, []string{"d1", "d2"}, 3, []interface{}{"field", "age"})
+}
+
+func TestFsScoreDefaults(t *testing.T) {
+	testdir := RmAllTestData()("fsscoredb.6")
+	defer RmAllTestData()
+	db := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: NewMemoryIdDb()}
+	DbDefaultsTest(db, t)
+}
+
+func TestFsScoreExplain(t *testing.T) {
+	testdir := RmAllTestData()("fsscoredb.8")
+	defer RmAllTestData()
+	db := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: NewMemoryIdDb()}
+	DbExplainTest(db, t)
+}
+
+func TestFsScoreProfile(t *testing.T) {
+	testdir := RmAllTestData()("fsscoredb.9")
+	defer RmAllTestData()
+	db := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: NewMemoryIdDb()}
+	// the highest ages come first, so that a query for them can quickly rule out the other buckets
+	records := make([]Record, 1000)
+	for idx := range records {
+		records[idx] = Record{Id: fmt.Sprintf("%d", idx), Values: map[string]float32{"age": float32(1000 - idx)}}
+	}
+	err := db.BulkIndex(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := db.Query(Query{Limit: 1, Scorer: []interface{}{"field", "age"}, Profile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := result.Profile
+	if profile == nil || len(profile.Fields) != 1 {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+	field := profile.Fields[0]
+	if field.Field != "age" || field.Buckets < 2 || field.Eliminated == 0 || field.Opened+field.Skipped != field.Buckets || field.NextCalls == 0 {
+		t.Fatalf("unexpected field profile: %+v", field)
+	}
+	if field.Opened == field.Buckets {
+		t.Fatalf("expected some buckets to be skipped: %+v", field)
+	}
+	if profile.Candidates == 0 || profile.Candidates >= 1000 || len(profile.Timeline) == 0 {
+		t.Fatalf("unexpected profile: %+v", profile)
+	}
+	for idx := 1; idx < len(profile.Timeline); idx++ {
+		if profile.Timeline[idx].MinScore < profile.Timeline[idx-1].MinScore {
+			t.Fatalf("the minimum score decreased: %+v", profile.Timeline)
+		}
+	}
+}
+
+func TestFsScoreFilters(t *testing.T) {
+	testdir := RmAllTestData()("fsscoredb.7")
+	defer RmAllTestData()
+	fsDb := OpenFsScoreDb(t, testdir)
+	db := BaseDb{StreamingDb: BaseStreamingDb{fsDb}, IdDb: NewMemoryIdDb()}
+	DbFiltersTest(db, t)
+
+	// buckets outside of the range are never read
+	itr := fsDb.FieldDocItr("price").(*FieldDocItr)
+	numBuckets := len(itr.lists)
+	NewPredicateDocItr(itr, NegativeInfinity, 10000, nil)
+	if numBuckets < 2 || len(itr.lists) != 1 {
+		t.Fatalf("Expected one of %v buckets to remain; found %v", numBuckets, len(itr.lists))
+	}
+	itr.Close()
+
+	// nor are the latitude buckets of the southern hemisphere, for a box in the north
+	result, err := db.Query(Query{Limit: 10, Scorer: []interface{}{"field", "pop"}, Profile: true,
+		Filters: []interface{}{[]interface{}{"geo_box", 39.0, -76.0, 41.0, -73.0, "lat", "lng"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped := false
+	for _, field := range result.Profile.Fields {
+		if field.Field == "lat" {
+			skipped = field.Opened < field.Buckets
+		}
+	}
+	if !skipped {
+		t.Fatalf("expected some latitude buckets to be skipped: %+v", result.Profile.Fields)
+	}
+}
+
+func TestFsScoreFieldValues(t *testing.T) {
+	testdir := RmAllTestData()("fsscoredb.5")
+	defer RmAllTestData()
+	fsDb := OpenFsScoreDb(t, testdir)
+	fsDb.StoreValues = true
+	db := BaseDb{StreamingDb: BaseStreamingDb{fsDb}, IdDb: NewMemoryIdDb()}
+	DbFieldValuesTest(db, t)
+
+	// values survive a reload; a batch that never committed leaves none behind
+	writeUncommittedBatch(t, fsDb, []map[string]float32{map[string]float32{"age": 99}})
+	reloadedDb := OpenFsScoreDb(t, testdir)
+	reloadedDb.StoreValues = true
+	values, err := reloadedDb.FieldValues([]int64{1, 2, 5}, []string{"age"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []map[string]float32{map[string]float32{}, map[string]float32{"age": 20}, map[string]float32{}}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected: %v found: %v", expected, values)
+	}
+
+	// values cannot be requested from a database that does not store them
+	_, err = OpenFsScoreDb(t, testdir).FieldValues([]int64{2}, []string{"age"})
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+}
+
+func TestFsScoreCorruption(t *testing.T) {
+	testdir := RmAllTestData()("fsscoredb.4")
+	defer RmAllTestData()
+	fsDb := OpenFsScoreDb(t, testdir)
+	db := BaseDb{StreamingDb: BaseStreamingDb{fsDb}, IdDb: NewMemoryIdDb()}
+	for i := 0; i < 10; i++ {
+		db.Index(fmt.Sprintf("r%d", i), map[string]float32{"age": float32(100 + i)})
+	}
+
+	// lose the entries (and the footer) that follow the header
+	err := os.Truncate(fsDb.fields["age"].files[0].path, HEADER_SIZE+8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Query(Query{Limit: 10, Scorer: []interface{}{"field", "age"}})
+	if err == nil {
+		t.Fatalf("Expected an error when querying a damaged posting list")
+	}
+
+	// the header no longer matches the file
+	err = os.Truncate(fsDb.fields["age"].files[0].path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewFsScoreDb(testdir)
+	if err == nil {
+		t.Fatalf("Expected an error when opening a damaged database")
+	}
+}
+
 func TestFsScoreLarge(t *testing.T) {
 	testdir := RmAllTestData()("fsscoredb.2")
 	defer RmAllTestData()
-	db := BaseDb{StreamingDb: BaseStreamingDb{NewFsScoreDb(testdir)}, IdDb: NewMemoryIdDb()}
+	db := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: NewMemoryIdDb()}
 
 	for i := 0; i < 100; i++ {
 		db.Index(fmt.Sprintf("r%d", i), map[string]float32{"age": float32(1000 + 100 - i), "height": 100 + 1.0 + float32(i%10)/10.0})
@@ -25,3 +191,10 @@ func TestFsScoreLarge(t *testing.T) {
 		[]interface{}{"field", "age"},
 		[]interface{}{"field", "height"}})
 }
+
+func TestFsScoreConcurrency(t *testing.T) {
+	testdir := RmAllTestData()("fsscoredb.10")
+	defer RmAllTestData()
+	db := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: NewMemoryIdDb(), WriteLock: &sync.Mutex{}}
+	DbConcurrencyTest(db, t)
+}
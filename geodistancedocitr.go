@@ -0,0 +1,226 @@
+package scoredb
+
+import (
+	"math"
+)
+
+var EARTH_RADIUS_KM = 6371.0
+
+// Slack (in degrees) added to the field bounds derived from a distance, so that rounding never prunes a document
+// that is within it
+var GEO_BOUNDS_SLACK = 1e-3
+
+// Great-circle distance (in km) between two points, given in degrees
+func HaversineDistance(lat1, lng1, lat2, lng2 float64) float64 {
+	phi1, phi2 := lat1*math.Pi/180.0, lat2*math.Pi/180.0
+	sinHalfLat := math.Sin((phi2 - phi1) / 2)
+	sinHalfLng := math.Sin((lng2 - lng1) * math.Pi / 360.0)
+	a := sinHalfLat*sinHalfLat + math.Cos(phi1)*math.Cos(phi2)*sinHalfLng*sinHalfLng
+	return 2 * EARTH_RADIUS_KM * math.Asin(math.Min(1.0, math.Sqrt(a)))
+}
+
+// Scores each document by its great-circle distance (in km) from a fixed point, using a pair of latitude and
+// longitude fields (in degrees).  A document must have both fields.
+//
+// A maximum distance bounds latitudes to a band around the point, and longitudes to a window that widens toward
+// the poles (the window is unbounded when the distance reaches a pole).  When the window crosses the antimeridian,
+// the part beyond it is read with a second iterator over the longitude field (wrapItr), which is otherwise unused.
+type GeoDistanceDocItr struct {
+	lat, lng float32 // the fixed point
+	latItr   DocItr
+	lngItr   DocItr
+	wrapItr  DocItr
+	lngParts []DocItr // the longitude iterators in use, which may still produce documents
+	wrapping bool     // whether wrapItr has been put in use
+	score    float32
+	docId    int64
+	min, max float32
+}
+
+// lngItr and wrapItr must each iterate over the longitude field
+func NewGeoDistanceDocItr(lat, lng float32, latItr, lngItr, wrapItr DocItr) *GeoDistanceDocItr {
+	op := &GeoDistanceDocItr{
+		lat:      lat,
+		lng:      lng,
+		latItr:   latItr,
+		lngItr:   lngItr,
+		wrapItr:  wrapItr,
+		lngParts: []DocItr{lngItr},
+		docId:    -1,
+	}
+	op.min, op.max = op.distanceBounds()
+	return op
+}
+
+// Bounds on the distance to any point within the bounds of the fields
+func (op *GeoDistanceDocItr) distanceBounds() (min, max float32) {
+	latMin, latMax := op.latItr.GetBounds()
+	lngMin, lngMax := op.lngItr.GetBounds()
+	farthest := float32(math.Pi * EARTH_RADIUS_KM)
+	for _, bound := range []float32{latMin, latMax, lngMin, lngMax} {
+		if math.IsInf(float64(bound), 0) || math.IsNaN(float64(bound)) {
+			return 0.0, farthest
+		}
+	}
+	lat, lng := float64(op.lat), float64(op.lng)
+	// no path between two latitudes is shorter than the one along a meridian
+	latGap := 0.0
+	if lat < float64(latMin) {
+		latGap = float64(latMin) - lat
+	} else if lat > float64(latMax) {
+		latGap = lat - float64(latMax)
+	}
+	min = float32(latGap * math.Pi / 180.0 * EARTH_RADIUS_KM)
+	// nor is any path longer than one along a meridian and then along a parallel
+	latSpan := math.Max(math.Abs(lat-float64(latMin)), math.Abs(lat-float64(latMax)))
+	lngSpan := math.Max(lngDifference(lng, float64(lngMin)), lngDifference(lng, float64(lngMax)))
+	antipode := lng + 180.0
+	if antipode > 180.0 {
+		antipode -= 360.0
+	}
+	if float64(lngMin) <= antipode && antipode <= float64(lngMax) {
+		lngSpan = 180.0
+	}
+	max = Min(farthest, float32((latSpan+lngSpan)*math.Pi/180.0*EARTH_RADIUS_KM))
+	return min, max
+}
+
+// The difference between two longitudes (in degrees, going the shorter way around)
+func lngDifference(lng1, lng2 float64) float64 {
+	diff := math.Mod(math.Abs(lng1-lng2), 360.0)
+	if diff > 180.0 {
+		diff = 360.0 - diff
+	}
+	return diff
+}
+
+func (op *GeoDistanceDocItr) Name() string { return "GeoDistanceDocItr" }
+func (op *GeoDistanceDocItr) Children() []DocItr {
+	if op.wrapping {
+		return []DocItr{op.latItr, op.lngItr, op.wrapItr}
+	}
+	return []DocItr{op.latItr, op.lngItr}
+}
+func (op *GeoDistanceDocItr) Cur() (int64, float32) {
+	return op.docId, op.score
+}
+func (op *GeoDistanceDocItr) GetBounds() (min, max float32) { return op.min, op.max }
+func (op *GeoDistanceDocItr) Close() {
+	op.latItr.Close()
+	op.lngItr.Close()
+	op.wrapItr.Close()
+}
+func (op *GeoDistanceDocItr) Err() error {
+	for _, itr := range []DocItr{op.latItr, op.lngItr, op.wrapItr} {
+		if err := itr.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *GeoDistanceDocItr) removeLngPart(part DocItr) {
+	for idx, other := range op.lngParts {
+		if other == part {
+			op.lngParts = append(op.lngParts[:idx], op.lngParts[idx+1:]...)
+			return
+		}
+	}
+}
+
+// The first document at or after minId that has a longitude
+func (op *GeoDistanceDocItr) nextLng(minId int64) (int64, float32, bool) {
+	docId, lng := int64(-1), float32(0.0)
+	for _, part := range append([]DocItr{}, op.lngParts...) {
+		curDocId, curLng := part.Cur()
+		if curDocId < minId {
+			if !part.Next(minId) {
+				op.removeLngPart(part)
+				continue
+			}
+			curDocId, curLng = part.Cur()
+		}
+		if docId == -1 || curDocId < docId {
+			docId, lng = curDocId, curLng
+		}
+	}
+	return docId, lng, docId != -1
+}
+
+func (op *GeoDistanceDocItr) Next(minId int64) bool {
+	for {
+		latDocId, lat := op.latItr.Cur()
+		if latDocId < minId {
+			if !op.latItr.Next(minId) {
+				return false
+			}
+			latDocId, lat = op.latItr.Cur()
+		}
+		lngDocId, lng, ok := op.nextLng(latDocId)
+		if !ok {
+			return false
+		}
+		if lngDocId != latDocId {
+			minId = lngDocId
+			continue
+		}
+		score := float32(HaversineDistance(float64(op.lat), float64(op.lng), float64(lat), float64(lng)))
+		if score < op.min || score > op.max {
+			minId = latDocId + 1
+			continue
+		}
+		op.docId, op.score = latDocId, score
+		return true
+	}
+}
+
+func (op *GeoDistanceDocItr) SetBounds(min, max float32) bool {
+	op.min, op.max = min, max
+	if min > max {
+		return false
+	}
+	angle := float64(max) / EARTH_RADIUS_KM
+	if angle >= math.Pi {
+		return true
+	}
+	lat, lng := float64(op.lat), float64(op.lng)
+	latDelta := angle*180.0/math.Pi + GEO_BOUNDS_SLACK
+	if !op.latItr.SetBounds(float32(lat-latDelta), float32(lat+latDelta)) {
+		return false
+	}
+	if lat+latDelta >= 90.0 || lat-latDelta <= -90.0 {
+		return true // (every longitude is within reach by way of the pole)
+	}
+	ratio := math.Sin(angle) / math.Cos(lat*math.Pi/180.0)
+	if ratio >= 1.0 {
+		return true
+	}
+	lngDelta := math.Asin(ratio)*180.0/math.Pi + GEO_BOUNDS_SLACK
+	if lngDelta >= 180.0 {
+		return true
+	}
+	lngMin, lngMax := lng-lngDelta, lng+lngDelta
+	wrapMin, wrapMax := PositiveInfinity, NegativeInfinity // (nothing, unless the window crosses the antimeridian)
+	if lngMax > 180.0 {
+		wrapMin, wrapMax = -180.0, float32(lngMax-360.0)
+		lngMax = 180.0
+	} else if lngMin < -180.0 {
+		wrapMin, wrapMax = float32(lngMin+360.0), 180.0
+		lngMin = -180.0
+	}
+	if !op.lngItr.SetBounds(float32(lngMin), float32(lngMax)) {
+		op.removeLngPart(op.lngItr)
+	}
+	if wrapMin <= wrapMax {
+		if !op.wrapping {
+			op.wrapping = true
+			op.lngParts = append(op.lngParts, op.wrapItr)
+		}
+		if !op.wrapItr.SetBounds(wrapMin, wrapMax) {
+			op.removeLngPart(op.wrapItr)
+		}
+	} else if op.wrapping {
+		op.removeLngPart(op.wrapItr) // (the window no longer crosses the antimeridian)
+	}
+	return len(op.lngParts) > 0
+}
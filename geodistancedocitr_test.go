@@ -0,0 +1,99 @@
+package scoredb
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHaversineDistance(t *testing.T) {
+	cases := []struct {
+		lat1, lng1, lat2, lng2, km float64
+	}{
+		{0, 0, 0, 0, 0},
+		{0, 0, 0, 180, math.Pi * EARTH_RADIUS_KM},
+		{90, 0, -90, 0, math.Pi * EARTH_RADIUS_KM},
+		{40.7, -74.0, 51.5, -0.13, 5570},   // New York to London
+		{0, 179.5, 0, -179.5, 111.2},       // across the antimeridian
+		{-33.9, 151.2, 21.3, -157.9, 8165}, // Sydney to Honolulu
+	}
+	for _, c := range cases {
+		if km := HaversineDistance(c.lat1, c.lng1, c.lat2, c.lng2); math.Abs(km-c.km) > c.km*0.005+0.01 {
+			t.Fatalf("(%v, %v) to (%v, %v): expected %v km, found %v", c.lat1, c.lng1, c.lat2, c.lng2, c.km, km)
+		}
+	}
+}
+
+func TestGeoDistanceDocItr(t *testing.T) {
+	lngs := []float32{-179.5, 170.0, -170.0, 179.5, 0.0}
+	lats := []float32{0.0, 0.0, 0.0, 10.0, 0.0}
+	lngItr := NewMemoryScoreDocItr(lngs)
+	wrapItr := NewMemoryScoreDocItr(lngs)
+	itr := NewGeoDistanceDocItr(0.0, 179.5, NewMemoryScoreDocItr(lats), lngItr, wrapItr)
+	if min, max := itr.GetBounds(); min != 0.0 || max < 20015 || max > 20016 {
+		t.Fatalf("%v %v", min, max)
+	}
+
+	expected := []float32{111.19, 1056.35, 1167.55, 1111.95, 19959.49}
+	for idx, km := range expected {
+		if !itr.Next(int64(idx + 1)) {
+			t.Fatalf("Expected doc %v", idx+1)
+		}
+		if docId, score := itr.Cur(); docId != int64(idx+1) || Abs(score-km) > 0.05 {
+			t.Fatalf("%v %v", docId, score)
+		}
+	}
+	if itr.Next(6) {
+		t.FailNow()
+	}
+
+	// a window that crosses the antimeridian is split in two
+	lngItr = NewMemoryScoreDocItr(lngs)
+	wrapItr = NewMemoryScoreDocItr(lngs)
+	itr = NewGeoDistanceDocItr(0.0, 179.5, NewMemoryScoreDocItr(lats), lngItr, wrapItr)
+	if !itr.SetBounds(0.0, 500.0) {
+		t.FailNow()
+	}
+	if min, max := lngItr.GetBounds(); min < 174.9 || min > 175.1 || max != 179.5 {
+		t.Fatalf("%v %v", min, max)
+	}
+	if min, max := wrapItr.GetBounds(); min != -179.5 || max < -176.1 || max > -175.9 {
+		t.Fatalf("%v %v", min, max)
+	}
+	if !itr.Next(0) {
+		t.FailNow()
+	}
+	if docId, _ := itr.Cur(); docId != 1 {
+		t.Fatalf("%v", docId)
+	}
+	if itr.Next(2) {
+		t.FailNow()
+	}
+
+	// longitudes are unbounded when the distance reaches a pole
+	lngItr = NewMemoryScoreDocItr(lngs)
+	itr = NewGeoDistanceDocItr(85.0, 0.0, NewMemoryScoreDocItr(lats), lngItr, NewMemoryScoreDocItr(lngs))
+	itr.SetBounds(0.0, 1000.0)
+	if min, max := lngItr.GetBounds(); min != -179.5 || max != 179.5 {
+		t.Fatalf("%v %v", min, max)
+	}
+}
+
+func TestGeoDistanceNearestAcrossAntimeridian(t *testing.T) {
+	testdir := RmAllTestData()("geodistance.1")
+	defer RmAllTestData()
+	db := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: NewMemoryIdDb()}
+	records := []Record{
+		Record{Id: "suva", Values: map[string]float32{"lat": -18.1, "lng": 178.4}},
+		Record{Id: "apia", Values: map[string]float32{"lat": -13.8, "lng": -171.8}},
+		Record{Id: "nukualofa", Values: map[string]float32{"lat": -21.1, "lng": -175.2}},
+		Record{Id: "auckland", Values: map[string]float32{"lat": -36.8, "lng": 174.8}},
+		Record{Id: "london", Values: map[string]float32{"lat": 51.5, "lng": -0.1}},
+		Record{Id: "lima", Values: map[string]float32{"lat": -12.0, "lng": -77.0}},
+	}
+	if err := db.BulkIndex(records); err != nil {
+		t.Fatal(err)
+	}
+	// nearest first, from the Lau Islands (just west of the antimeridian)
+	scorer := []interface{}{"scale", -1.0, []interface{}{"geo_distance", -18.0, 179.9, "lat", "lng"}}
+	CallAndCheck(db, t, []string{"suva", "nukualofa", "apia"}, 3, scorer)
+}
@@ -1,18 +1,35 @@
 package scoredb
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type ScoreDbServer struct {
 	Db                    Db
+	StreamingDb           StreamingDb // (optional) the Db's StreamingDb, served under /_stream/ for RemoteStreamingDb
+	StreamWrites          bool        // also accept changes under /_stream/ (which bypass the Db and its id mapping)
 	ReadOnly, AutoMigrate bool
+	ReplicationLog        *ReplicationLog // (optional, on a leader) served under /_replication/ for Followers
+	Follower              *Follower       // (optional, on a follower) its status is served at /_replication/status
+	SnapshotDir           string          // (optional) where POST /_admin/snapshot puts snapshots of the Db
+
+	sessionsLock sync.Mutex                // guards sessions, each session's lastUsed, and reaping
+	sessions     map[string]*streamSession // queries in progress for RemoteStreamingDbs
+	reaping      bool                      // whether reapSessions() is running (it runs while there are sessions)
 }
 
 func serializeIds(ids []int64) (string, error) {
@@ -50,6 +67,18 @@ func (sds *ScoreDbServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if p[0] == '/' {
 		p = p[1:]
 	}
+	if sds.StreamingDb != nil && req.Method == "POST" && strings.HasPrefix(p, "_stream/") {
+		sds.serveStream(w, req, strings.TrimPrefix(p, "_stream/"))
+		return
+	}
+	if req.Method == "POST" && p == "_admin/snapshot" && sds.SnapshotDir != "" {
+		sds.serveSnapshot(w, req)
+		return
+	}
+	if req.Method == "GET" && strings.HasPrefix(p, "_replication/") {
+		sds.serveReplication(w, req, strings.TrimPrefix(p, "_replication/"))
+		return
+	}
 
 	if req.Method == "PUT" && !sds.ReadOnly {
 
@@ -78,6 +107,15 @@ func (sds *ScoreDbServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+	} else if req.Method == "DELETE" && len(p) > 0 && !sds.ReadOnly {
+
+		err := sds.Db.Delete(p)
+		if err != nil {
+			fmt.Printf("Internal error. Delete %v:  %v\n", p, err)
+			http.Error(w, "Could not delete record", 500)
+			return
+		}
+
 	} else if req.Method == "GET" && len(p) == 0 {
 
 		queryParams := req.URL.Query()
@@ -112,15 +150,62 @@ func (sds *ScoreDbServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		filters := make([]interface{}, 0)
+		if filterStrings, ok := queryParams["filter"]; ok && len(filterStrings) > 0 {
+			err = json.Unmarshal([]byte(filterStrings[0]), &filters)
+			if err != nil {
+				http.Error(w, "Filter parameter is not a valid JSON array", 400)
+				return
+			}
+		}
+
+		fields := make([]string, 0)
+		for _, fieldList := range queryParams["fields"] { // comma separated, and/or repeated
+			for _, field := range strings.Split(fieldList, ",") {
+				if field != "" {
+					fields = append(fields, field)
+				}
+			}
+		}
+
+		explain := queryParams.Get("explain") == "true"
+		profile := queryParams.Get("profile") == "true"
+		allowPartial := queryParams.Get("partial") == "true"
+
+		ctx := req.Context() // cancelled if the client goes away
+		if timeoutStrings, ok := queryParams["timeout"]; ok && len(timeoutStrings) > 0 {
+			timeout, err := time.ParseDuration(timeoutStrings[0])
+			if err != nil {
+				http.Error(w, "Invalid value for timeout", 400)
+				return
+			}
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
 		query := Query{
-			Offset:   offset,
-			Limit:    limit,
-			MinScore: minScore,
-			Scorer:   *scorer,
+			Offset:       offset,
+			Limit:        limit,
+			MinScore:     minScore,
+			Scorer:       *scorer,
+			Fields:       fields,
+			Filters:      filters,
+			Explain:      explain,
+			Profile:      profile,
+			AllowPartial: allowPartial,
 		}
 
-		results, err := sds.Db.Query(query)
-		if err != nil {
+		results, err := sds.Db.QueryContext(ctx, query)
+		if exprErr, ok := err.(*ExprError); ok {
+			http.Error(w, fmt.Sprintf("Invalid query: %v", exprErr), 400)
+			return
+		} else if err == context.DeadlineExceeded {
+			http.Error(w, "Query timed out", 504)
+			return
+		} else if err == context.Canceled { // (nobody is listening)
+			return
+		} else if err != nil {
 			fmt.Printf("Internal error. %+v:  %v\n", query, err)
 			http.Error(w, "Internal Error in ScoreDB; please report", 500)
 			return
@@ -141,7 +226,340 @@ func (sds *ScoreDbServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func ServeHttp(addr string, db Db, readOnly bool) error {
-	scoreDbServer := ScoreDbServer{Db: db, ReadOnly: readOnly}
+// If streamingDb is given, it is also served (for queries only) for RemoteStreamingDbs
+func ServeHttp(addr string, db Db, streamingDb StreamingDb, readOnly bool) error {
+	scoreDbServer := ScoreDbServer{Db: db, StreamingDb: streamingDb, ReadOnly: readOnly}
 	return http.ListenAndServe(addr, &scoreDbServer)
 }
+
+// Sessions that go unused for this long are closed (by a check that runs four times as often)
+var STREAM_SESSION_TIMEOUT = time.Minute
+
+// The number of documents sent in each response to a RemoteDocItr
+const REMOTE_BATCH_SIZE = 256
+
+type streamSession struct {
+	lock     sync.Mutex // (one request at a time)
+	itr      DocItr
+	docId    int64
+	min, max float32   // the bounds last given to the iterator
+	lastUsed time.Time // when a request last finished with it (guarded by the server's sessionsLock)
+	closed   bool
+}
+
+func (sds *ScoreDbServer) addSession(itr DocItr) (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(randomBytes)
+	min, max := itr.GetBounds()
+	now := time.Now()
+	sds.sessionsLock.Lock()
+	defer sds.sessionsLock.Unlock()
+	if sds.sessions == nil {
+		sds.sessions = make(map[string]*streamSession)
+	}
+	sds.sessions[id] = &streamSession{itr: itr, docId: -1, min: min, max: max, lastUsed: now}
+	if !sds.reaping {
+		sds.reaping = true
+		go sds.reapSessions(STREAM_SESSION_TIMEOUT)
+	}
+	return id, nil
+}
+
+// Closes sessions that have gone unused for too long (the remote end may have gone away without closing them),
+// until there are none left
+func (sds *ScoreDbServer) reapSessions(timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		sds.sessionsLock.Lock()
+		for staleId, session := range sds.sessions {
+			if now.Sub(session.lastUsed) > timeout {
+				delete(sds.sessions, staleId)
+				go session.close() // (after any request that is using it)
+			}
+		}
+		if len(sds.sessions) == 0 {
+			sds.reaping = false
+			sds.sessionsLock.Unlock()
+			return
+		}
+		sds.sessionsLock.Unlock()
+	}
+}
+
+// Finds a session and locks it, or returns nil
+func (sds *ScoreDbServer) lockSession(id string) *streamSession {
+	sds.sessionsLock.Lock()
+	session := sds.sessions[id]
+	if session != nil {
+		session.lastUsed = time.Now() // (so that it is not reaped while the request waits for it)
+	}
+	sds.sessionsLock.Unlock()
+	if session != nil {
+		session.lock.Lock()
+	}
+	return session
+}
+
+// Unlocks a session locked by lockSession()
+func (sds *ScoreDbServer) unlockSession(session *streamSession) {
+	sds.sessionsLock.Lock()
+	session.lastUsed = time.Now()
+	sds.sessionsLock.Unlock()
+	session.lock.Unlock()
+}
+
+// Forgets a session, returning it (if it was still there) for the caller to close
+func (sds *ScoreDbServer) removeSession(id string) *streamSession {
+	sds.sessionsLock.Lock()
+	defer sds.sessionsLock.Unlock()
+	session := sds.sessions[id]
+	delete(sds.sessions, id)
+	return session
+}
+
+func (session *streamSession) close() {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if !session.closed {
+		session.itr.Close()
+		session.closed = true
+	}
+}
+
+// Produces the next batch of documents, with the given bounds applied first
+func (session *streamSession) next(min, max float32) remoteBatch {
+	batch := remoteBatch{DocIds: []int64{}, Scores: []float32{}}
+	if session.closed { // (it was idle for too long)
+		batch.Done, batch.Err = true, "Session expired"
+		return batch
+	}
+	more := true
+	if min > session.min || max < session.max {
+		session.min, session.max = Max(session.min, min), Min(session.max, max)
+		more = session.itr.SetBounds(session.min, session.max)
+	}
+	for more && len(batch.DocIds) < REMOTE_BATCH_SIZE {
+		more = session.itr.Next(session.docId + 1)
+		if more {
+			docId, score := session.itr.Cur()
+			session.docId = docId
+			batch.DocIds = append(batch.DocIds, docId)
+			batch.Scores = append(batch.Scores, score)
+		}
+	}
+	if !more {
+		session.itr.Close()
+		session.closed = true
+		batch.Done = true
+		if err := session.itr.Err(); err != nil {
+			batch.Err = err.Error()
+		}
+	}
+	return batch
+}
+
+// Serves the StreamingDb, for RemoteStreamingDb
+func (sds *ScoreDbServer) serveStream(w http.ResponseWriter, req *http.Request, command string) {
+	readJson := func(request interface{}) bool {
+		err := json.NewDecoder(req.Body).Decode(request)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not parse json: %v", err), 400)
+			return false
+		}
+		return true
+	}
+	var response interface{}
+	var err error
+	queryParams := req.URL.Query()
+	switch command {
+	case "index":
+		if sds.ReadOnly || !sds.StreamWrites {
+			http.NotFound(w, req)
+			return
+		}
+		var request remoteIndexRequest
+		if !readJson(&request) {
+			return
+		}
+		var ids []int64
+		ids, err = sds.StreamingDb.BulkIndex(request.ClientIds, request.Records)
+		response = remoteIndexResponse{Ids: ids}
+	case "delete":
+		if sds.ReadOnly || !sds.StreamWrites {
+			http.NotFound(w, req)
+			return
+		}
+		var ids []int64
+		if !readJson(&ids) {
+			return
+		}
+		err = sds.StreamingDb.Delete(ids)
+		response = struct{}{}
+	case "values":
+		var request remoteValuesRequest
+		if !readJson(&request) {
+			return
+		}
+		var values []map[string]float32
+		values, err = sds.StreamingDb.FieldValues(request.Ids, request.Fields)
+		response = remoteValuesResponse{Values: values}
+	case "query":
+		var scorer interface{}
+		if !readJson(&scorer) {
+			return
+		}
+		expr, parseErr := ParseExpr(scorer)
+		if parseErr != nil {
+			http.Error(w, fmt.Sprintf("Invalid query: %v", parseErr), 400)
+			return
+		}
+		// the iterator outlives this request, so it does not use the request's context
+		itr, queryErr := sds.StreamingDb.QueryItr(context.Background(), expr)
+		if queryErr != nil {
+			err = queryErr
+			break
+		}
+		min, max := itr.GetBounds()
+		id, sessionErr := sds.addSession(itr)
+		if sessionErr != nil {
+			itr.Close()
+			err = sessionErr
+			break
+		}
+		response = remoteQueryResponse{Session: id, Min: formatBound(min), Max: formatBound(max)}
+	case "next":
+		min, minErr := parseBound(queryParams.Get("min"))
+		max, maxErr := parseBound(queryParams.Get("max"))
+		if minErr != nil || maxErr != nil {
+			http.Error(w, "Invalid bounds", 400)
+			return
+		}
+		session := sds.lockSession(queryParams.Get("session"))
+		if session == nil {
+			http.Error(w, "Unknown session", 404)
+			return
+		}
+		batch := session.next(min, max)
+		sds.unlockSession(session)
+		if batch.Done {
+			sds.removeSession(queryParams.Get("session"))
+		}
+		response = batch
+	case "close":
+		session := sds.removeSession(queryParams.Get("session"))
+		if session != nil { // (it may have finished already)
+			session.close()
+		}
+		response = struct{}{}
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Internal error. %s:  %v\n", command, err)
+		http.Error(w, fmt.Sprintf("Internal Error in ScoreDB: %v", err), 500)
+		return
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Internal Error in ScoreDB: %v", err), 500)
+		return
+	}
+	w.Write(body)
+}
+
+type snapshotResponse struct {
+	Dir string
+}
+
+// Snapshots the Db into a new directory in SnapshotDir
+func (sds *ScoreDbServer) serveSnapshot(w http.ResponseWriter, req *http.Request) {
+	db, ok := sds.Db.(SnapshottingDb)
+	if !ok {
+		http.Error(w, "This database does not support snapshots", http.StatusNotImplemented)
+		return
+	}
+	dest := path.Join(sds.SnapshotDir, fmt.Sprintf("snapshot.%d", time.Now().UnixNano()))
+	err := EnsureDirectory(sds.SnapshotDir)
+	if err == nil {
+		err = db.Snapshot(dest)
+	}
+	if err != nil {
+		fmt.Printf("Internal error. Snapshot to %s:  %v\n", dest, err)
+		http.Error(w, fmt.Sprintf("Could not make snapshot: %v", err), 500)
+		return
+	}
+	body, err := json.Marshal(snapshotResponse{Dir: dest})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Internal Error in ScoreDB: %v", err), 500)
+		return
+	}
+	w.Write(body)
+}
+
+// Streams a copy of a leader's database (as a tar archive) to a Follower that is catching up
+func (sds *ScoreDbServer) serveReplicationSnapshot(w http.ResponseWriter) {
+	db, ok := sds.Db.(*ReplicatedDb)
+	if !ok {
+		http.Error(w, "This database is not replicated", http.StatusNotImplemented)
+		return
+	}
+	dest := db.Log.snapshotDir()
+	defer os.RemoveAll(dest)
+	status, err := db.SnapshotForFollower(dest)
+	if err != nil {
+		fmt.Printf("Internal error. Snapshot to %s:  %v\n", dest, err)
+		http.Error(w, fmt.Sprintf("Could not make snapshot: %v", err), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set(REPLICATION_EPOCH_HEADER, status.Epoch)
+	w.Header().Set(REPLICATION_SEQ_HEADER, strconv.FormatInt(status.Seq, 10))
+	err = writeTar(w, dest)
+	if err != nil {
+		fmt.Printf("Unable to send snapshot %s: %v\n", dest, err)
+		panic(http.ErrAbortHandler) // (cuts the response short, so that the follower sees that it is incomplete)
+	}
+}
+
+// Serves a leader's log to Followers, and the replication status of leaders and followers
+func (sds *ScoreDbServer) serveReplication(w http.ResponseWriter, req *http.Request, command string) {
+	var response interface{}
+	queryParams := req.URL.Query()
+	switch {
+	case command == "status" && sds.Follower != nil:
+		response = sds.Follower.Status()
+	case command == "status" && sds.ReplicationLog != nil:
+		response = sds.ReplicationLog.Status()
+	case command == "log" && sds.ReplicationLog != nil:
+		after, err := strconv.ParseInt(queryParams.Get("after"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid value for after", 400)
+			return
+		}
+		status := sds.ReplicationLog.Status()
+		entries, ok := sds.ReplicationLog.Since(after, REPLICATION_BATCH_ENTRIES)
+		if !ok || queryParams.Get("epoch") != status.Epoch {
+			http.Error(w, "Catch up from /_replication/snapshot", http.StatusGone)
+			return
+		}
+		response = replicationLogResponse{Epoch: status.Epoch, Seq: status.Seq, Entries: entries}
+	case command == "snapshot" && sds.ReplicationLog != nil:
+		sds.serveReplicationSnapshot(w)
+		return
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	body, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Internal Error in ScoreDB: %v", err), 500)
+		return
+	}
+	w.Write(body)
+}
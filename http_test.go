@@ -0,0 +1,28 @@
+package scoredb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHttpTimeout(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	db.Index("r1", map[string]float32{"age": 32})
+	server := &ScoreDbServer{Db: db}
+	scorer := url.QueryEscape(`["field", "age"]`)
+	for params, status := range map[string]int{
+		"":                          http.StatusOK,
+		"&timeout=1m":               http.StatusOK,
+		"&timeout=1ns":              http.StatusGatewayTimeout,
+		"&timeout=1ns&partial=true": http.StatusOK,
+		"&timeout=soon":             http.StatusBadRequest,
+	} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", "/?score="+scorer+params, nil))
+		if recorder.Code != status {
+			t.Fatalf("%s: expected status %d, found %d (%s)", params, status, recorder.Code, recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package scoredb
+
+import ()
+
+// Scores each document by the greatest score among its children.
+// Unlike sum, product, and min, a document need only be produced by one of the children.
+//
+// Bounds are weaker than for the other combinators: a child's score that is too high can not be ruled out
+// (another child may not produce the document at all), so only the lower bound is passed on.  Still, no child
+// needs to produce scores below the lower bound, since they could never raise a document's score above it.
+type MaxDocItr struct {
+	score    float32
+	docId    int64
+	min, max float32
+	parts    []DocItr
+	children []DocItr // all of the parts, including those that have been removed
+	err      error    // the first error from a part that has been closed
+}
+
+func NewMaxDocItr(itrs []DocItr) *MaxDocItr {
+	min, max := PositiveInfinity, NegativeInfinity
+	for _, part := range itrs {
+		curMin, curMax := part.GetBounds()
+		min = Min(min, curMin)
+		max = Max(max, curMax)
+	}
+	return &MaxDocItr{
+		score:    0.0,
+		docId:    -1,
+		min:      min,
+		max:      max,
+		parts:    itrs,
+		children: append([]DocItr{}, itrs...),
+	}
+}
+
+func (op *MaxDocItr) Name() string       { return "MaxDocItr" }
+func (op *MaxDocItr) Children() []DocItr { return op.children }
+func (op *MaxDocItr) Cur() (int64, float32) {
+	return op.docId, op.score
+}
+func (op *MaxDocItr) GetBounds() (min, max float32) { return op.min, op.max }
+
+// Closes (and stops using) a part that can produce no more documents
+func (op *MaxDocItr) removePart(idx int) {
+	part := op.parts[idx]
+	part.Close()
+	if op.err == nil {
+		op.err = part.Err()
+	}
+	op.parts[idx] = op.parts[len(op.parts)-1]
+	op.parts = op.parts[:len(op.parts)-1]
+}
+
+func (op *MaxDocItr) Close() {
+	for len(op.parts) > 0 {
+		op.removePart(0)
+	}
+}
+func (op *MaxDocItr) Err() error {
+	if op.err != nil {
+		return op.err
+	}
+	for _, part := range op.parts {
+		if err := part.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (op *MaxDocItr) Next(minId int64) bool {
+	for {
+		docId := int64(-1)
+		for idx := 0; idx < len(op.parts); {
+			part := op.parts[idx]
+			curDocId, _ := part.Cur()
+			if curDocId < minId {
+				if !part.Next(minId) {
+					op.removePart(idx)
+					continue
+				}
+				curDocId, _ = part.Cur()
+			}
+			if docId == -1 || curDocId < docId {
+				docId = curDocId
+			}
+			idx++
+		}
+		if docId == -1 || op.err != nil {
+			return false
+		}
+		score := NegativeInfinity
+		for _, part := range op.parts {
+			curDocId, curScore := part.Cur()
+			if curDocId == docId {
+				score = Max(score, curScore)
+			}
+		}
+		if op.min <= score && score <= op.max {
+			op.docId = docId
+			op.score = score
+			return true
+		}
+		minId = docId + 1
+	}
+}
+
+func (op *MaxDocItr) SetBounds(min, max float32) bool {
+	op.min = Max(op.min, min)
+	op.max = Min(op.max, max)
+	if op.min > op.max {
+		return false
+	}
+	for idx := 0; idx < len(op.parts); {
+		part := op.parts[idx]
+		curMin, curMax := part.GetBounds()
+		if curMin < op.min && !part.SetBounds(op.min, curMax) {
+			op.removePart(idx)
+			continue
+		}
+		idx++
+	}
+	return len(op.parts) > 0
+}
@@ -0,0 +1,49 @@
+package scoredb
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMaxDocItr(t *testing.T) {
+	nan := float32(math.NaN())
+	i1 := NewMemoryScoreDocItr([]float32{0.2, nan, 0.5, 0.1})
+	i2 := NewMemoryScoreDocItr([]float32{0.9, 0.3, nan, 0.05})
+	itr := NewMaxDocItr([]DocItr{i1, i2})
+
+	if min, max := itr.GetBounds(); min != 0.05 || max != 0.9 {
+		t.Fatalf("%v %v", min, max)
+	}
+
+	// the union of both children
+	expected := []DocScore{DocScore{1, 0.9}, DocScore{2, 0.3}, DocScore{3, 0.5}, DocScore{4, 0.1}}
+	for _, e := range expected {
+		if !itr.Next(e.DocId) {
+			t.Fatalf("Expected doc %v", e.DocId)
+		}
+		if docId, score := itr.Cur(); docId != e.DocId || score != e.Score {
+			t.Fatalf("%v %v", docId, score)
+		}
+	}
+	if itr.Next(5) {
+		t.FailNow()
+	}
+
+	// only the lower bound is passed along
+	i1 = NewMemoryScoreDocItr([]float32{0.2, 0.8})
+	i2 = NewMemoryScoreDocItr([]float32{0.9, 0.3})
+	itr = NewMaxDocItr([]DocItr{i1, i2})
+	itr.SetBounds(0.4, 0.85)
+	if min, max := i1.GetBounds(); min != 0.4 || max != 0.8 {
+		t.Fatalf("%v %v", min, max)
+	}
+	if min, max := i2.GetBounds(); min != 0.4 || max != 0.9 {
+		t.Fatalf("%v %v", min, max)
+	}
+	if !itr.Next(0) {
+		t.FailNow()
+	}
+	if docId, score := itr.Cur(); docId != 2 || score != 0.8 { // doc 1 scores 0.9, above the upper bound
+		t.Fatalf("%v %v", docId, score)
+	}
+}
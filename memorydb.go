@@ -1,53 +1,94 @@
 package scoredb
 
 import (
-	"fmt"
 	"math"
+	"sync"
 )
 
 func NewMemoryIdDb() MemoryIdDb {
-	return MemoryIdDb{make(map[int64]string)}
+	return MemoryIdDb{make(map[int64]string), make(map[string]int64), &sync.RWMutex{}}
 }
 
 type MemoryIdDb struct {
-	bindings map[int64]string
+	bindings        map[int64]string
+	reverseBindings map[string]int64
+	lock            *sync.RWMutex
 }
 
 func (db MemoryIdDb) Put(scoreIds []int64, clientIds []string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
 	for idx, scoreId := range scoreIds {
+		if oldId, ok := db.reverseBindings[clientIds[idx]]; ok && oldId != scoreId {
+			delete(db.bindings, oldId)
+		}
 		db.bindings[scoreId] = clientIds[idx]
+		db.reverseBindings[clientIds[idx]] = scoreId
 	}
 	return nil
 }
 
-func (db MemoryIdDb) Get(scoreIds []int64) ([]string, error) {
-	result := make([]string, len(scoreIds))
-	for idx, scoreId := range scoreIds {
-		clientId, ok := db.bindings[scoreId]
+func (db MemoryIdDb) Lookup(clientIds []string) ([]int64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	result := make([]int64, len(clientIds))
+	for idx, clientId := range clientIds {
+		scoreId, ok := db.reverseBindings[clientId]
 		if !ok {
-			return nil, fmt.Errorf("Unable to find client id for internal id %d", scoreId)
+			scoreId = -1
+		}
+		result[idx] = scoreId
+	}
+	return result, nil
+}
 
+func (db MemoryIdDb) Delete(clientIds []string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, clientId := range clientIds {
+		scoreId, ok := db.reverseBindings[clientId]
+		if ok {
+			delete(db.bindings, scoreId)
+			delete(db.reverseBindings, clientId)
 		}
-		result[idx] = clientId
+	}
+	return nil
+}
+
+func (db MemoryIdDb) Get(scoreIds []int64) ([]string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	result := make([]string, len(scoreIds))
+	for idx, scoreId := range scoreIds {
+		result[idx] = db.bindings[scoreId]
 	}
 	return result, nil
 }
 
+// Queries may run alongside a single writer.
+// Indexing only appends to the slices in Fields, so the part of a slice that a query captured never changes
+// under it; deletion only adds to the set of deleted ids, which queries check as they go.
 type MemoryScoreDb struct {
-	Fields map[string][]float32
-	nextId int64
+	Fields  map[string][]float32
+	nextId  int64
+	lock    sync.RWMutex // guards the fields above
+	deleted *idBitset
 }
 
 func NewMemoryScoreDb() *MemoryScoreDb {
 	return &MemoryScoreDb{
-		Fields: make(map[string][]float32),
-		nextId: 1,
+		Fields:  make(map[string][]float32),
+		nextId:  1,
+		deleted: newIdBitset(),
 	}
 }
 
 func (db *MemoryScoreDb) BulkIndex(records []map[string]float32) ([]int64, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
 	fields := db.Fields
 	ids := make([]int64, len(records))
+	nan := float32(math.NaN())
 	for idx, record := range records {
 		ids[idx] = db.nextId
 		db.nextId += 1
@@ -56,15 +97,53 @@ func (db *MemoryScoreDb) BulkIndex(records []map[string]float32) ([]int64, error
 			if !ok {
 				fields[key] = make([]float32, 0, 64)
 			}
+			for int64(len(fields[key])) < ids[idx]-1 { // documents without this field
+				fields[key] = append(fields[key], nan)
+			}
 			fields[key] = append(fields[key], value)
 		}
 	}
 	return ids, nil
 }
 
+func (db *MemoryScoreDb) FieldValues(ids []int64, fields []string) ([]map[string]float32, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	results := make([]map[string]float32, len(ids))
+	for idx, id := range ids {
+		results[idx] = make(map[string]float32)
+		for _, field := range fields {
+			scores := db.Fields[field]
+			scoreIdx := int(id - 1)
+			if scoreIdx >= 0 && scoreIdx < len(scores) && !math.IsNaN(float64(scores[scoreIdx])) && !db.deleted.Contains(id) {
+				results[idx][field] = scores[scoreIdx]
+			}
+		}
+	}
+	return results, nil
+}
+
+// Deleted ids are kept in a set, which MemoryScoreDocItr skips over (their values stay in place)
+func (db *MemoryScoreDb) Delete(ids []int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.deleted.set(db.deleted.unset(ids))
+	return nil
+}
+
+func (db *MemoryScoreDb) AllDocsItr() DocItr {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return NewAllDocsItr(1, db.nextId-1, db.deleted.Contains)
+}
+
 func (db *MemoryScoreDb) FieldDocItr(fieldName string) DocItr {
-	scores := db.Fields[fieldName]
-	return NewMemoryScoreDocItr(scores)
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	itr := NewMemoryScoreDocItr(db.Fields[fieldName])
+	itr.field = fieldName
+	itr.deleted = db.deleted
+	return itr
 }
 
 func NewMemoryScoreDocItr(scores []float32) *MemoryScoreDocItr {
@@ -86,12 +165,15 @@ func NewMemoryScoreDocItr(scores []float32) *MemoryScoreDocItr {
 }
 
 type MemoryScoreDocItr struct {
+	field    string    // (optional) for explanations
+	deleted  *idBitset // (optional) ids to skip over
 	scores   []float32
 	idx      int
 	min, max float32
 }
 
-func (op *MemoryScoreDocItr) Name() string { return "MemoryScoreDocItr" }
+func (op *MemoryScoreDocItr) Name() string      { return "MemoryScoreDocItr" }
+func (op *MemoryScoreDocItr) FieldName() string { return op.field }
 func (op *MemoryScoreDocItr) Cur() (int64, float32) {
 	idx := op.idx
 	if idx < 0 || idx >= len(op.scores) {
@@ -112,10 +194,20 @@ func (op *MemoryScoreDocItr) SetBounds(min, max float32) bool {
 func (op *MemoryScoreDocItr) Close() {
 }
 
+func (op *MemoryScoreDocItr) Err() error {
+	return nil
+}
+
 func (op *MemoryScoreDocItr) Next(minId int64) bool {
 	if minId == 0 {
 		minId = 1
 	}
-	op.idx = int(minId - 1)
-	return op.idx < len(op.scores)
+	for idx := int(minId - 1); idx < len(op.scores); idx++ {
+		if !math.IsNaN(float64(op.scores[idx])) && !op.deleted.Contains(int64(idx+1)) {
+			op.idx = idx
+			return true
+		}
+	}
+	op.idx = len(op.scores)
+	return false
 }
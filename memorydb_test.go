@@ -1,6 +1,8 @@
 package scoredb
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 )
 
@@ -8,3 +10,59 @@ func TestMemoryScoreDb(t *testing.T) {
 	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
 	DbBasicsTest(db, t)
 }
+
+func TestMemoryScoreDbFieldValues(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	DbFieldValuesTest(db, t)
+}
+
+func TestMemoryScoreDbDefaults(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	DbDefaultsTest(db, t)
+}
+
+func TestMemoryScoreDbFilters(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	DbFiltersTest(db, t)
+}
+
+func TestMemoryScoreDbDelete(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	DbDeleteTest(db, t)
+}
+
+func TestMemoryScoreDbExplain(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	DbExplainTest(db, t)
+}
+
+func TestMemoryScoreDbCancel(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	DbCancelTest(db, t)
+}
+
+func TestMemoryScoreDbConcurrency(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb(), WriteLock: &sync.Mutex{}}
+	DbConcurrencyTest(db, t)
+}
+
+func TestMemoryScoreDbUnmappedDocs(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	for _, age := range []float32{10, 20, 30} {
+		if err := db.Index(fmt.Sprintf("r%v", age), map[string]float32{"age": age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// documents without client ids (as left by a change that is still being made) outscore every other one
+	_, err := db.StreamingDb.BulkIndex([]string{"x1", "x2"}, []map[string]float32{{"age": 50}, {"age": 40}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := db.Query(Query{Offset: 1, Limit: 2, Scorer: []interface{}{"field", "age"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprintf("%v", result.Ids) != "[r20 r10]" {
+		t.Errorf("expected a full page after the unmapped documents were dropped, got %v", result.Ids)
+	}
+}
@@ -43,6 +43,7 @@ func (op *MemoryDocItr) SetBounds(min, max float32) bool {
 }
 func (op *MemoryDocItr) Name() string { return "MemoryDocItr" }
 func (op *MemoryDocItr) Close()       {}
+func (op *MemoryDocItr) Err() error   { return nil }
 func (op *MemoryDocItr) Next(minId int64) bool {
 	for {
 		op.index += 1
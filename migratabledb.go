@@ -1,23 +1,113 @@
 package scoredb
 
 import (
+	"context"
 	"fmt"
-	"time"
+	"sync"
 )
 
+// A Db that can be replaced with another while it is in use.
+// Each call uses the database that is current when it starts, and Swap() waits for the calls still using the one it
+// replaces, so that the old database can then be closed.
 type MigratableDb struct {
-	Current Db
+	lock    sync.Mutex
+	current *migratableVersion
+}
+
+type migratableVersion struct {
+	db    Db
+	users sync.WaitGroup // calls that are using db
+}
+
+// The current database; nil if none has been swapped in yet
+func (db *MigratableDb) Current() Db {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.current == nil {
+		return nil
+	}
+	return db.current.db
+}
+
+// Makes next the current database, returning the old one (or nil) once no call is using it
+func (db *MigratableDb) Swap(next Db) Db {
+	db.lock.Lock()
+	old := db.current
+	db.current = &migratableVersion{db: next}
+	db.lock.Unlock()
+	if old == nil {
+		return nil
+	}
+	old.users.Wait() // (no call can start using it now)
+	return old.db
+}
+
+// The current database, and a function to call once done with it
+func (db *MigratableDb) acquire() (Db, func(), error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if db.current == nil {
+		return nil, nil, fmt.Errorf("No database has been loaded yet")
+	}
+	version := db.current
+	version.users.Add(1)
+	return version.db, version.users.Done, nil
 }
 
 func (db *MigratableDb) BulkIndex(records []Record) error {
-	return db.Current.BulkIndex(records)
+	current, release, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return current.BulkIndex(records)
 }
 
 func (db *MigratableDb) Index(id string, values map[string]float32) error {
-	return db.Current.Index(id, values)
+	current, release, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return current.Index(id, values)
+}
+
+func (db *MigratableDb) Delete(id string) error {
+	current, release, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	return current.Delete(id)
+}
+
+func (db *MigratableDb) Snapshot(dest string) error {
+	current, release, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+	snapshotting, ok := current.(SnapshottingDb)
+	if !ok {
+		return fmt.Errorf("%T does not support snapshots", current)
+	}
+	return snapshotting.Snapshot(dest)
 }
 
 func (db *MigratableDb) Query(query Query) (QueryResult, error) {
-	fmt.Printf("Query versus %v at %v", db.Current, time.Now().Unix())
-	return db.Current.Query(query)
+	current, release, err := db.acquire()
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer release()
+	return current.Query(query)
+}
+
+func (db *MigratableDb) QueryContext(ctx context.Context, query Query) (QueryResult, error) {
+	current, release, err := db.acquire()
+	if err != nil {
+		return QueryResult{}, err
+	}
+	defer release()
+	return current.QueryContext(ctx, query)
 }
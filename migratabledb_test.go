@@ -0,0 +1,74 @@
+package scoredb
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Blocks each query until released, and records when it is closed
+type blockingDb struct {
+	BaseDb
+	started chan bool
+	release chan bool
+	closed  bool
+}
+
+func (db *blockingDb) QueryContext(ctx context.Context, query Query) (QueryResult, error) {
+	db.started <- true
+	<-db.release
+	return db.BaseDb.QueryContext(ctx, query)
+}
+
+func (db *blockingDb) Close() error {
+	db.closed = true
+	return nil
+}
+
+func TestMigratableDbSwapWaitsForQueries(t *testing.T) {
+	migratable := &MigratableDb{}
+	if _, err := migratable.QueryContext(context.Background(), Query{Limit: 1}); err == nil {
+		t.Fatal("expected an error before a database is swapped in")
+	}
+	old := &blockingDb{
+		BaseDb:  BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()},
+		started: make(chan bool),
+		release: make(chan bool),
+	}
+	migratable.Swap(old)
+	queryDone := make(chan error)
+	go func() {
+		_, err := migratable.QueryContext(context.Background(), Query{Limit: 1, Scorer: []interface{}{"field", "age"}})
+		queryDone <- err
+	}()
+	<-old.started
+
+	next := &BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	swapped := make(chan Db)
+	go func() {
+		replaced := migratable.Swap(next)
+		CloseIfCloser(replaced)
+		swapped <- replaced
+	}()
+	for migratable.Current() != Db(next) {
+		time.Sleep(time.Millisecond)
+	}
+	// new queries use the new database while the old one is still in use
+	_, err := migratable.QueryContext(context.Background(), Query{Limit: 1, Scorer: []interface{}{"field", "age"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-swapped:
+		t.Fatal("expected Swap() to wait for the query using the old database")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	old.release <- true
+	if err := <-queryDone; err != nil {
+		t.Fatal(err)
+	}
+	if replaced := <-swapped; replaced != Db(old) || !old.closed {
+		t.Fatalf("expected the old database to be returned and closed, found %v", replaced)
+	}
+}
@@ -45,7 +45,8 @@ func NewMinDocItr(itrs []DocItr) *MinDocItr {
 	}
 }
 
-func (op *MinDocItr) Name() string { return "MinDocItr" }
+func (op *MinDocItr) Name() string       { return "MinDocItr" }
+func (op *MinDocItr) Children() []DocItr { return op.parts }
 func (op *MinDocItr) Cur() (int64, float32) {
 	return op.docId, op.score
 }
@@ -55,6 +56,14 @@ func (op *MinDocItr) Close() {
 		part.Close()
 	}
 }
+func (op *MinDocItr) Err() error {
+	for _, part := range op.parts {
+		if err := part.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 func (op *MinDocItr) Next(minId int64) bool {
 	min, max := op.min, op.max
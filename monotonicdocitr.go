@@ -0,0 +1,152 @@
+package scoredb
+
+import (
+	"math"
+)
+
+// An increasing function of one value, with its inverse
+type MonotonicFunction struct {
+	Apply   func(float64) float64
+	Inverse func(float64) float64
+	// the least and greatest results; a bound at (or beyond) one of these does not restrict the input
+	Low, High float64
+}
+
+var MonotonicFunctions = map[string]MonotonicFunction{
+	"log": MonotonicFunction{
+		Apply: func(x float64) float64 {
+			if x <= 0 {
+				return math.Inf(-1)
+			}
+			return math.Log(x)
+		},
+		Inverse: math.Exp,
+		Low:     math.Inf(-1),
+		High:    math.Inf(1),
+	},
+	"log1p": MonotonicFunction{
+		Apply: func(x float64) float64 {
+			if x <= -1 {
+				return math.Inf(-1)
+			}
+			return math.Log1p(x)
+		},
+		Inverse: math.Expm1,
+		Low:     math.Inf(-1),
+		High:    math.Inf(1),
+	},
+	"exp": MonotonicFunction{Apply: math.Exp, Inverse: math.Log, Low: 0, High: math.Inf(1)},
+	"sigmoid": MonotonicFunction{
+		Apply:   func(x float64) float64 { return 1.0 / (1.0 + math.Exp(-x)) },
+		Inverse: func(y float64) float64 { return math.Log(y / (1.0 - y)) },
+		Low:     0,
+		High:    1,
+	},
+	"tanh": MonotonicFunction{Apply: math.Tanh, Inverse: math.Atanh, Low: -1, High: 1},
+}
+
+// Applies an increasing function to a value.
+// Bounds map through the function directly; SetBounds() maps them back through its inverse, after widening them by
+// the smallest possible step (so that rounding never rules out a value whose score is exactly on a bound).
+type MonotonicDocItr struct {
+	name string
+	fn   MonotonicFunction
+	itr  DocItr
+}
+
+func NewMonotonicDocItr(name string, itr DocItr) *MonotonicDocItr {
+	return &MonotonicDocItr{name: name, fn: MonotonicFunctions[name], itr: itr}
+}
+
+func (op *MonotonicDocItr) apply(value float32) float32 {
+	return float32(op.fn.Apply(float64(value)))
+}
+
+// The inverse of a bound, widened (toward the given infinity) to include every value whose result rounds to it
+func (op *MonotonicDocItr) inverse(bound, toward float32) float32 {
+	widened := float64(math.Nextafter32(bound, toward))
+	return math.Nextafter32(float32(op.fn.Inverse(widened)), toward)
+}
+
+func (op *MonotonicDocItr) Name() string       { return "MonotonicDocItr(" + op.name + ")" }
+func (op *MonotonicDocItr) Children() []DocItr { return []DocItr{op.itr} }
+func (op *MonotonicDocItr) Cur() (int64, float32) {
+	docId, score := op.itr.Cur()
+	return docId, op.apply(score)
+}
+func (op *MonotonicDocItr) GetBounds() (min, max float32) {
+	min, max = op.itr.GetBounds()
+	return op.apply(min), op.apply(max)
+}
+func (op *MonotonicDocItr) Close() {
+	op.itr.Close()
+}
+func (op *MonotonicDocItr) Err() error {
+	return op.itr.Err()
+}
+func (op *MonotonicDocItr) Next(minId int64) bool {
+	return op.itr.Next(minId)
+}
+
+func (op *MonotonicDocItr) SetBounds(min, max float32) bool {
+	if float64(min) > op.fn.High || float64(max) < op.fn.Low || min > max {
+		return false
+	}
+	valueMin, valueMax := NegativeInfinity, PositiveInfinity
+	if float64(min) > op.fn.Low {
+		valueMin = op.inverse(min, NegativeInfinity)
+	}
+	if float64(max) < op.fn.High {
+		valueMax = op.inverse(max, PositiveInfinity)
+	}
+	return op.itr.SetBounds(valueMin, valueMax)
+}
+
+// Limits a value to a range
+type ClampDocItr struct {
+	lo, hi float32
+	itr    DocItr
+}
+
+func NewClampDocItr(lo, hi float32, itr DocItr) *ClampDocItr {
+	return &ClampDocItr{lo: lo, hi: hi, itr: itr}
+}
+
+func (op *ClampDocItr) clamp(value float32) float32 {
+	return Min(Max(value, op.lo), op.hi)
+}
+
+func (op *ClampDocItr) Name() string       { return "ClampDocItr" }
+func (op *ClampDocItr) Children() []DocItr { return []DocItr{op.itr} }
+func (op *ClampDocItr) Cur() (int64, float32) {
+	docId, score := op.itr.Cur()
+	return docId, op.clamp(score)
+}
+func (op *ClampDocItr) GetBounds() (min, max float32) {
+	min, max = op.itr.GetBounds()
+	return op.clamp(min), op.clamp(max)
+}
+func (op *ClampDocItr) Close() {
+	op.itr.Close()
+}
+func (op *ClampDocItr) Err() error {
+	return op.itr.Err()
+}
+func (op *ClampDocItr) Next(minId int64) bool {
+	return op.itr.Next(minId)
+}
+
+func (op *ClampDocItr) SetBounds(min, max float32) bool {
+	if min > op.hi || max < op.lo || min > max {
+		return false
+	}
+	// values beyond the range score the same as its ends, so a bound at an end does not restrict them
+	valueMin, valueMax := NegativeInfinity, PositiveInfinity
+	if min > op.lo {
+		valueMin = min
+	}
+	if max < op.hi {
+		valueMax = max
+	}
+	return op.itr.SetBounds(valueMin, valueMax)
+}
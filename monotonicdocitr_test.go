@@ -0,0 +1,96 @@
+package scoredb
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMonotonicDocItr(t *testing.T) {
+	values := []float32{0.5, 2.0, 8.0}
+	for name, fn := range map[string]func(float64) float64{
+		"log":     math.Log,
+		"log1p":   math.Log1p,
+		"exp":     math.Exp,
+		"sigmoid": func(x float64) float64 { return 1.0 / (1.0 + math.Exp(-x)) },
+		"tanh":    math.Tanh,
+	} {
+		itr := NewMonotonicDocItr(name, NewMemoryScoreDocItr(values))
+		if min, max := itr.GetBounds(); min != float32(fn(0.5)) || max != float32(fn(8.0)) {
+			t.Fatalf("%s: %v %v", name, min, max)
+		}
+		for idx, value := range values {
+			if !itr.Next(int64(idx + 1)) {
+				t.Fatalf("%s: expected doc %v", name, idx+1)
+			}
+			if docId, score := itr.Cur(); docId != int64(idx+1) || score != float32(fn(float64(value))) {
+				t.Fatalf("%s: %v %v", name, docId, score)
+			}
+		}
+
+		// bounds on the result become bounds on the value
+		child := NewMemoryScoreDocItr(values)
+		itr = NewMonotonicDocItr(name, child)
+		itr.SetBounds(float32(fn(1.0)), float32(fn(4.0)))
+		if min, max := child.GetBounds(); Abs(min-1.0) > 1e-4 || min > 1.0 || Abs(max-4.0) > 1e-4 || max < 4.0 {
+			t.Fatalf("%s: %v %v", name, min, max)
+		}
+	}
+
+	// bounds at (or beyond) the ends of a function's results do not restrict the value
+	child := NewMemoryScoreDocItr([]float32{-5.0, 5.0})
+	if !NewMonotonicDocItr("sigmoid", child).SetBounds(0.0, 1.0) {
+		t.FailNow()
+	}
+	if min, max := child.GetBounds(); min != -5.0 || max != 5.0 {
+		t.Fatalf("%v %v", min, max)
+	}
+	if NewMonotonicDocItr("tanh", NewMemoryScoreDocItr([]float32{1.0})).SetBounds(1.5, 2.0) {
+		t.Fatal("expected no value to reach a tanh above 1")
+	}
+
+	// log of a value that is not positive is negative infinity
+	itr := NewMonotonicDocItr("log", NewMemoryScoreDocItr([]float32{0.0, -1.0}))
+	for docId := int64(1); docId <= 2; docId++ {
+		itr.Next(docId)
+		if _, score := itr.Cur(); score != NegativeInfinity {
+			t.Fatalf("%v", score)
+		}
+	}
+}
+
+func TestClampDocItr(t *testing.T) {
+	child := NewMemoryScoreDocItr([]float32{-3.0, 0.5, 7.0})
+	itr := NewClampDocItr(0.0, 1.0, child)
+	if min, max := itr.GetBounds(); min != 0.0 || max != 1.0 {
+		t.Fatalf("%v %v", min, max)
+	}
+	for idx, expected := range []float32{0.0, 0.5, 1.0} {
+		itr.Next(int64(idx + 1))
+		if _, score := itr.Cur(); score != expected {
+			t.Fatalf("%v %v", idx, score)
+		}
+	}
+
+	itr.SetBounds(0.25, 1.0) // (any value above the range scores 1.0)
+	if min, max := child.GetBounds(); min != 0.25 || max != 7.0 {
+		t.Fatalf("%v %v", min, max)
+	}
+	if itr.SetBounds(1.5, 2.0) {
+		t.Fatal("expected no value to be clamped above 1")
+	}
+}
+
+func TestMonotonicQuery(t *testing.T) {
+	db := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	db.Index("viral", map[string]float32{"views": 1000000, "rating": 3.0})
+	db.Index("popular", map[string]float32{"views": 20000, "rating": 4.5})
+	db.Index("niche", map[string]float32{"views": 30, "rating": 5.0})
+	db.Index("new", map[string]float32{"views": 0, "rating": 3.0})
+	// damped popularity, plus a rating (that tops out at 4)
+	scorer := []interface{}{"sum",
+		[]interface{}{"log1p", []interface{}{"field", "views"}},
+		[]interface{}{"scale", 2.0, []interface{}{"clamp", 0.0, 4.0, []interface{}{"field", "rating"}}}}
+	CallAndCheck(db, t, []string{"viral", "popular", "niche", "new"}, 4, scorer)
+	CallAndCheck(db, t, []string{"niche"}, 1, []interface{}{"sigmoid", []interface{}{"field", "rating"}})
+	CallAndCheck(db, t, []string{"niche", "popular"}, 2, []interface{}{"exp", []interface{}{"field", "rating"}})
+}
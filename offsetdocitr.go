@@ -0,0 +1,33 @@
+package scoredb
+
+import ()
+
+// Adds a constant to a value
+type OffsetDocItr struct {
+	delta  float32
+	docItr DocItr
+}
+
+func (op *OffsetDocItr) Name() string       { return "OffsetDocItr" }
+func (op *OffsetDocItr) Children() []DocItr { return []DocItr{op.docItr} }
+func (op *OffsetDocItr) Cur() (int64, float32) {
+	docId, score := op.docItr.Cur()
+	return docId, score + op.delta
+}
+func (op *OffsetDocItr) GetBounds() (min, max float32) {
+	min, max = op.docItr.GetBounds()
+	return min + op.delta, max + op.delta
+}
+func (op *OffsetDocItr) Close() {
+	op.docItr.Close()
+}
+func (op *OffsetDocItr) Err() error {
+	return op.docItr.Err()
+}
+func (op *OffsetDocItr) Next(minId int64) bool {
+	return op.docItr.Next(minId)
+}
+
+func (op *OffsetDocItr) SetBounds(min, max float32) bool {
+	return op.docItr.SetBounds(min-op.delta, max-op.delta)
+}
@@ -19,7 +19,8 @@ func Pow(val, exp float32) float32 {
 	return float32(math.Pow(float64(val), float64(exp)))
 }
 
-func (op *PowDocItr) Name() string { return "PowDocItr" }
+func (op *PowDocItr) Name() string       { return "PowDocItr" }
+func (op *PowDocItr) Children() []DocItr { return []DocItr{op.itr} }
 func (op *PowDocItr) Cur() (int64, float32) {
 	docId, score := op.itr.Cur()
 	return docId, Pow(score, op.exp)
@@ -27,6 +28,9 @@ func (op *PowDocItr) Cur() (int64, float32) {
 func (op *PowDocItr) Close() {
 	op.itr.Close()
 }
+func (op *PowDocItr) Err() error {
+	return op.itr.Err()
+}
 func (op *PowDocItr) Next(minId int64) bool {
 	ret := op.itr.Next(minId)
 	return ret
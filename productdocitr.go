@@ -46,7 +46,8 @@ func NewProductDocItr(itrs []DocItr) *ProductDocItr {
 	}
 }
 
-func (op *ProductDocItr) Name() string { return "ProductDocItr" }
+func (op *ProductDocItr) Name() string       { return "ProductDocItr" }
+func (op *ProductDocItr) Children() []DocItr { return op.parts }
 func (op *ProductDocItr) Cur() (int64, float32) {
 	return op.docId, op.score
 }
@@ -56,6 +57,14 @@ func (op *ProductDocItr) Close() {
 		part.Close()
 	}
 }
+func (op *ProductDocItr) Err() error {
+	for _, part := range op.parts {
+		if err := part.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 func (op *ProductDocItr) Next(minId int64) bool {
 	min, max := op.min, op.max
 	keepGoing := true
@@ -0,0 +1,52 @@
+package scoredb
+
+import (
+	"time"
+)
+
+// What a query did: how much of each field's index it read, and how quickly the results improved
+type Profile struct {
+	Elapsed    time.Duration  // in nanoseconds, in JSON
+	Candidates int            // documents produced by the scorer (before offset, limit, and minimum score)
+	Fields     []FieldProfile // one for each field iterator in the query (on each shard)
+	Timeline   []ProfilePoint // each time the lowest score in the results rose
+}
+
+type FieldProfile struct {
+	Field      string
+	Buckets    int // posting lists (buckets) in the field's index
+	Opened     int // buckets whose file was read
+	Skipped    int // buckets that were never opened (answered entirely from their headers, or ruled out first)
+	Eliminated int // buckets ruled out by SetBounds, before reaching their end
+	NextCalls  int
+}
+
+type ProfilePoint struct {
+	Elapsed    time.Duration // since the query began
+	Candidates int           // documents produced by the scorer so far
+	MinScore   float32       // the lowest score that can still make it into the results
+}
+
+// Bucket iterators implement this, to report whether they needed to read their file
+type OpeningDocItr interface {
+	Opened() bool
+}
+
+// Iterators that read a field's buckets implement this
+type ProfilingDocItr interface {
+	FieldProfile() FieldProfile
+}
+
+// Collects the profiles of every field iterator in a (finished) iterator tree
+func ProfileFields(itr DocItr) []FieldProfile {
+	profiles := make([]FieldProfile, 0)
+	if profiling, ok := itr.(ProfilingDocItr); ok {
+		profiles = append(profiles, profiling.FieldProfile())
+	}
+	if parent, ok := itr.(ParentDocItr); ok {
+		for _, child := range parent.Children() {
+			profiles = append(profiles, ProfileFields(child)...)
+		}
+	}
+	return profiles
+}
@@ -0,0 +1,250 @@
+package scoredb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A StreamingDb on another scoredb server (see ScoreDbServer.StreamingDb), so that a ShardedDb can spread
+// its shards across machines.
+//
+// Remote servers must have only one shard of their own: ids from a sharded server would collide with the
+// ids of the coordinating ShardedDb (see ShardIdToExt).
+type RemoteStreamingDb struct {
+	BaseUrl string       // for example, "http://10.0.0.5:11625"
+	Client  *http.Client // (optional) defaults to http.DefaultClient
+}
+
+// The request and response bodies of the streaming protocol; bounds are strings so that they can be infinite
+
+type remoteIndexRequest struct {
+	ClientIds []string
+	Records   []map[string]float32
+}
+
+type remoteIndexResponse struct {
+	Ids []int64
+}
+
+type remoteValuesRequest struct {
+	Ids    []int64
+	Fields []string
+}
+
+type remoteValuesResponse struct {
+	Values []map[string]float32
+}
+
+type remoteQueryResponse struct {
+	Session  string
+	Min, Max string
+}
+
+type remoteBatch struct {
+	DocIds []int64
+	Scores []float32
+	Done   bool   // the remote iterator is finished (and its session is gone)
+	Err    string `json:",omitempty"`
+}
+
+func formatBound(bound float32) string {
+	return strconv.FormatFloat(float64(bound), 'g', -1, 32)
+}
+
+func parseBound(text string) (float32, error) {
+	bound, err := strconv.ParseFloat(text, 32)
+	return float32(bound), err
+}
+
+func (db RemoteStreamingDb) client() *http.Client {
+	if db.Client != nil {
+		return db.Client
+	}
+	return http.DefaultClient
+}
+
+// Posts a JSON request (or none, if request is nil) and decodes the JSON response (unless response is nil)
+func (db RemoteStreamingDb) call(ctx context.Context, path string, params url.Values, request interface{}, response interface{}) error {
+	body := []byte{}
+	if request != nil {
+		var err error
+		body, err = json.Marshal(request)
+		if err != nil {
+			return err
+		}
+	}
+	fullUrl := strings.TrimRight(db.BaseUrl, "/") + path
+	if len(params) > 0 {
+		fullUrl += "?" + params.Encode()
+	}
+	req, err := http.NewRequest("POST", fullUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := db.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Remote scoredb at %s failed (%d): %s", db.BaseUrl, resp.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(responseBody, response)
+}
+
+func (db RemoteStreamingDb) BulkIndex(clientIds []string, records []map[string]float32) ([]int64, error) {
+	var response remoteIndexResponse
+	err := db.call(context.Background(), "/_stream/index", nil, remoteIndexRequest{ClientIds: clientIds, Records: records}, &response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Ids) != len(records) {
+		return nil, fmt.Errorf("Remote scoredb at %s returned %d ids for %d records", db.BaseUrl, len(response.Ids), len(records))
+	}
+	for _, id := range response.Ids {
+		if idInShard, shardNum := ShardIdFromExt(id); shardNum != 0 {
+			db.Delete(response.Ids)
+			return nil, fmt.Errorf("Remote scoredb at %s gave id %d (%d in shard %d); remote servers must have only one shard", db.BaseUrl, id, idInShard, shardNum)
+		}
+	}
+	return response.Ids, nil
+}
+
+func (db RemoteStreamingDb) Delete(ids []int64) error {
+	return db.call(context.Background(), "/_stream/delete", nil, ids, nil)
+}
+
+func (db RemoteStreamingDb) FieldValues(ids []int64, fields []string) ([]map[string]float32, error) {
+	var response remoteValuesResponse
+	err := db.call(context.Background(), "/_stream/values", nil, remoteValuesRequest{Ids: ids, Fields: fields}, &response)
+	if err != nil {
+		return nil, err
+	}
+	return response.Values, nil
+}
+
+func (db RemoteStreamingDb) QueryItr(ctx context.Context, expr *Expr) (DocItr, error) {
+	var response remoteQueryResponse
+	err := db.call(ctx, "/_stream/query", nil, expr.ToJson(), &response)
+	if err != nil {
+		return nil, err
+	}
+	min, err := parseBound(response.Min)
+	if err != nil {
+		return nil, err
+	}
+	max, err := parseBound(response.Max)
+	if err != nil {
+		return nil, err
+	}
+	return &RemoteDocItr{
+		db:      db,
+		ctx:     ctx,
+		session: response.Session,
+		docId:   -1,
+		min:     min,
+		max:     max,
+	}, nil
+}
+
+// Iterates over a query that runs on a remote server.
+// Documents are fetched in batches; each fetch sends the current bounds, so that the remote iterator can prune.
+type RemoteDocItr struct {
+	db       RemoteStreamingDb
+	ctx      context.Context
+	session  string
+	score    float32
+	docId    int64
+	min, max float32
+	batch    remoteBatch
+	batchIdx int
+	err      error
+}
+
+func (op *RemoteDocItr) Name() string { return "RemoteDocItr" }
+func (op *RemoteDocItr) Cur() (int64, float32) {
+	return op.docId, op.score
+}
+func (op *RemoteDocItr) GetBounds() (min, max float32) {
+	return op.min, op.max
+}
+
+// The new bounds reach the remote server with the next fetch
+func (op *RemoteDocItr) SetBounds(min, max float32) bool {
+	op.min = Max(op.min, min)
+	op.max = Min(op.max, max)
+	return op.min <= op.max
+}
+
+func (op *RemoteDocItr) Err() error { return op.err }
+
+func (op *RemoteDocItr) Close() {
+	if op.session == "" {
+		return
+	}
+	params := url.Values{"session": []string{op.session}}
+	op.session = ""
+	// (the context may be done already; the remote server also gives up on idle sessions eventually)
+	err := op.db.call(context.Background(), "/_stream/close", params, nil, nil)
+	if err != nil && op.err == nil {
+		op.err = err
+	}
+}
+
+func (op *RemoteDocItr) fetch() error {
+	params := url.Values{
+		"session": []string{op.session},
+		"min":     []string{formatBound(op.min)},
+		"max":     []string{formatBound(op.max)},
+	}
+	op.batch = remoteBatch{}
+	op.batchIdx = 0
+	err := op.db.call(op.ctx, "/_stream/next", params, nil, &op.batch)
+	if err != nil {
+		return err
+	}
+	if op.batch.Done {
+		op.session = ""
+	}
+	if op.batch.Err != "" {
+		return fmt.Errorf("Remote scoredb at %s failed: %s", op.db.BaseUrl, op.batch.Err)
+	}
+	return nil
+}
+
+func (op *RemoteDocItr) Next(minId int64) bool {
+	for {
+		for ; op.batchIdx < len(op.batch.DocIds); op.batchIdx++ {
+			docId, score := op.batch.DocIds[op.batchIdx], op.batch.Scores[op.batchIdx]
+			if docId >= minId && op.min <= score && score <= op.max {
+				op.docId, op.score = docId, score
+				op.batchIdx++
+				return true
+			}
+		}
+		if op.session == "" || op.err != nil {
+			return false
+		}
+		err := op.fetch()
+		if err != nil {
+			op.err = err
+			return false
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package scoredb
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Starts servers for the given shards, returning a db that spreads its records across them
+func StartRemoteShards(t *testing.T, shards []StreamingDb) (BaseDb, []*ScoreDbServer, func()) {
+	servers := make([]*ScoreDbServer, len(shards))
+	httpServers := make([]*httptest.Server, len(shards))
+	remotes := make([]StreamingDb, len(shards))
+	for idx, shard := range shards {
+		servers[idx] = &ScoreDbServer{StreamingDb: shard, StreamWrites: true}
+		httpServers[idx] = httptest.NewServer(servers[idx])
+		remotes[idx] = RemoteStreamingDb{BaseUrl: httpServers[idx].URL}
+	}
+	db := BaseDb{StreamingDb: ShardedDb{Shards: remotes}, IdDb: NewMemoryIdDb()}
+	return db, servers, func() {
+		for _, httpServer := range httpServers {
+			httpServer.Close()
+		}
+	}
+}
+
+func TestRemoteDb(t *testing.T) {
+	db, _, stop := StartRemoteShards(t, []StreamingDb{BaseStreamingDb{NewMemoryScoreDb()}, BaseStreamingDb{NewMemoryScoreDb()}})
+	defer stop()
+	DbBasicsTest(db, t)
+}
+
+func TestRemoteDbDelete(t *testing.T) {
+	db, _, stop := StartRemoteShards(t, []StreamingDb{BaseStreamingDb{NewMemoryScoreDb()}, BaseStreamingDb{NewMemoryScoreDb()}})
+	defer stop()
+	DbDeleteTest(db, t)
+}
+
+func TestRemoteDbFilters(t *testing.T) {
+	db, _, stop := StartRemoteShards(t, []StreamingDb{BaseStreamingDb{NewMemoryScoreDb()}, BaseStreamingDb{NewMemoryScoreDb()}})
+	defer stop()
+	DbFiltersTest(db, t)
+}
+
+func TestRemoteDbFieldValues(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	shards := make([]StreamingDb, 2)
+	for idx := range shards {
+		fsDb := OpenFsScoreDb(t, pathmaker(fmt.Sprintf("remote_values_%d", idx)))
+		fsDb.StoreValues = true
+		shards[idx] = BaseStreamingDb{fsDb}
+	}
+	db, _, stop := StartRemoteShards(t, shards)
+	defer stop()
+	DbFieldValuesTest(db, t)
+}
+
+func TestRemoteDbMatchesLocal(t *testing.T) {
+	db, servers, stop := StartRemoteShards(t, []StreamingDb{BaseStreamingDb{NewMemoryScoreDb()}, BaseStreamingDb{NewMemoryScoreDb()}})
+	defer stop()
+	local := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	records := make([]Record, 2000) // (several batches per shard)
+	for idx := range records {
+		records[idx] = Record{Id: fmt.Sprintf("%d", idx), Values: map[string]float32{"age": float32((idx * 7919) % 2000)}}
+	}
+	for _, db := range []BaseDb{db, local} {
+		err := db.BulkIndex(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, query := range []Query{
+		Query{Limit: 10, MinScore: NegativeInfinity, Scorer: []interface{}{"field", "age"}},
+		Query{Offset: 5, Limit: 10, MinScore: NegativeInfinity, Scorer: []interface{}{"scale", -1.0, []interface{}{"field", "age"}}},
+		Query{Limit: 3000, MinScore: 1500, Scorer: []interface{}{"field", "age"}},
+	} {
+		expected, err := local.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := db.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, found) {
+			t.Fatalf("%+v: expected: %v found: %v", query, expected, found)
+		}
+	}
+
+	for idx, server := range servers {
+		server.sessionsLock.Lock()
+		numSessions := len(server.sessions)
+		server.sessionsLock.Unlock()
+		if numSessions != 0 {
+			t.Fatalf("server %d still has %d query sessions", idx, numSessions)
+		}
+	}
+}
+
+func TestRemoteWritesAreOptIn(t *testing.T) {
+	shard := BaseStreamingDb{NewMemoryScoreDb()}
+	httpServer := httptest.NewServer(&ScoreDbServer{StreamingDb: shard})
+	defer httpServer.Close()
+	remote := RemoteStreamingDb{BaseUrl: httpServer.URL}
+	if _, err := remote.BulkIndex([]string{"r1"}, []map[string]float32{{"age": 1.0}}); err == nil {
+		t.Fatalf("expected changes to be refused without StreamWrites")
+	}
+	if err := remote.Delete([]int64{1}); err == nil {
+		t.Fatalf("expected changes to be refused without StreamWrites")
+	}
+	itr, err := remote.QueryItr(context.Background(), Field("age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if itr.Next(0) {
+		t.Fatalf("expected no documents")
+	}
+	itr.Close()
+}
+
+func TestRemoteSessionsExpire(t *testing.T) {
+	defer func(timeout time.Duration) { STREAM_SESSION_TIMEOUT = timeout }(STREAM_SESSION_TIMEOUT)
+	STREAM_SESSION_TIMEOUT = 100 * time.Millisecond
+	server := &ScoreDbServer{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	remote := RemoteStreamingDb{BaseUrl: httpServer.URL}
+
+	// a query that is abandoned without being closed
+	_, err := remote.QueryItr(context.Background(), Field("age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		server.sessionsLock.Lock()
+		numSessions, reaping := len(server.sessions), server.reaping
+		server.sessionsLock.Unlock()
+		if numSessions == 0 && !reaping {
+			return
+		}
+	}
+	t.Fatalf("the abandoned session was not closed")
+}
+
+func TestRemoteDbRejectsShardedServers(t *testing.T) {
+	sharded := ShardedDb{Shards: []StreamingDb{BaseStreamingDb{NewMemoryScoreDb()}, BaseStreamingDb{NewMemoryScoreDb()}}}
+	db, _, stop := StartRemoteShards(t, []StreamingDb{sharded})
+	defer stop()
+	records := make([]Record, 20)
+	for idx := range records {
+		records[idx] = Record{Id: fmt.Sprintf("%d", idx), Values: map[string]float32{"age": float32(idx)}}
+	}
+	if err := db.BulkIndex(records); err == nil {
+		t.Fatal("expected an error when indexing on a sharded remote server")
+	}
+}
@@ -0,0 +1,626 @@
+package scoredb
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One change accepted by a leader, in the order that it was applied
+type ReplicationEntry struct {
+	Seq     int64
+	Records []Record `json:",omitempty"` // indexed, replacing any existing records with the same ids
+	Deletes []string `json:",omitempty"`
+}
+
+type ReplicationStatus struct {
+	Leader    string     `json:",omitempty"` // (followers only)
+	Epoch     string     // identifies the leader's log; followers whose epoch differs must catch up from a snapshot
+	Seq       int64      // the last entry applied
+	LeaderSeq int64      // the last entry that the leader had, when last asked
+	Lag       int64      // LeaderSeq - Seq
+	LastSync  *time.Time `json:",omitempty"` // (followers only) when the follower last heard from its leader
+	Error     string     `json:",omitempty"` // (followers only) why the last attempt to sync failed
+}
+
+type replicationLogHeader struct {
+	Epoch string
+	Seq   int64 // the entry before the first one in the file
+}
+
+type replicationLogResponse struct {
+	Epoch   string
+	Seq     int64
+	Entries []ReplicationEntry
+}
+
+// The changes that a leader has accepted, for followers to apply.
+//
+// The most recent MaxEntries entries are kept, in memory, for followers that are nearly up to date; those that
+// fall further behind start again from a snapshot of the leader's database (see ReplicatedDb). The file only needs
+// to hold the entries kept in memory, so it is rewritten with just those once it holds twice as many.
+type ReplicationLog struct {
+	Epoch      string
+	MaxEntries int
+
+	lock        sync.Mutex
+	fileName    string
+	file        *os.File
+	size        int64 // the length of the file's complete lines
+	fileEntries int   // the entries in the file, so that it is not rewritten too often
+	seq         int64
+	entries     []ReplicationEntry // the most recent entries, with consecutive sequence numbers
+}
+
+var REPLICATION_LOG_FILENAME = "replication.log"
+
+// Snapshots for followers are made in directories named this (plus a number) alongside the log, while they are sent
+var REPLICATION_SNAPSHOT_PREFIX = "replication.snapshot."
+
+// Entries sent to a follower in each response
+const REPLICATION_BATCH_ENTRIES = 100
+
+// Headers of a response to /_replication/snapshot, giving the position in the log that the snapshot is as of
+const REPLICATION_EPOCH_HEADER = "X-Replication-Epoch"
+const REPLICATION_SEQ_HEADER = "X-Replication-Seq"
+
+func newEpoch() (string, error) {
+	randomBytes := make([]byte, 8)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// Opens (or creates) the log file in the given directory
+func OpenReplicationLog(dataDir string, maxEntries int) (*ReplicationLog, error) {
+	err := EnsureDirectory(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	staleDirs, _ := filepath.Glob(path.Join(dataDir, REPLICATION_SNAPSHOT_PREFIX+"*"))
+	for _, staleDir := range staleDirs { // (left behind by a crash while sending a snapshot)
+		os.RemoveAll(staleDir)
+	}
+	fileName := path.Join(dataDir, REPLICATION_LOG_FILENAME)
+	log := &ReplicationLog{MaxEntries: maxEntries, fileName: fileName}
+	if !Exists(fileName) {
+		log.Epoch, err = newEpoch()
+		if err != nil {
+			return nil, err
+		}
+		err = log.rewrite()
+		if err != nil {
+			return nil, err
+		}
+		return log, nil
+	}
+
+	fd, err := os.OpenFile(fileName, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(fd)
+	offset := int64(0)
+	for lineNum := 0; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil { // (a partial line is an append that did not finish)
+			break
+		}
+		if lineNum == 0 {
+			var header replicationLogHeader
+			err = json.Unmarshal(line, &header)
+			if err != nil || header.Epoch == "" {
+				fd.Close()
+				return nil, fmt.Errorf("Invalid replication log header in %s", fileName)
+			}
+			log.Epoch, log.seq = header.Epoch, header.Seq
+		} else {
+			var entry ReplicationEntry
+			err = json.Unmarshal(line, &entry)
+			if err != nil || entry.Seq != log.seq+1 {
+				break
+			}
+			log.apply(entry)
+		}
+		offset += int64(len(line))
+	}
+	if log.Epoch == "" {
+		fd.Close()
+		return nil, fmt.Errorf("Invalid replication log header in %s", fileName)
+	}
+	log.file, log.size = fd, offset
+	return log, nil
+}
+
+// Updates the in-memory state with an entry (which must follow the last one) that is in the file
+func (log *ReplicationLog) apply(entry ReplicationEntry) {
+	log.entries = append(log.entries, entry)
+	if len(log.entries) > log.MaxEntries {
+		log.entries = append([]ReplicationEntry{}, log.entries[len(log.entries)-log.MaxEntries:]...)
+	}
+	log.fileEntries += 1
+	log.seq = entry.Seq
+}
+
+// Replaces the log's file with one that holds only the entries in memory
+func (log *ReplicationLog) rewrite() error {
+	fd, err := log.writeFile(log.fileName, log.Epoch, log.entries)
+	if fd == nil {
+		return err
+	}
+	// (once the new file is in place, appends must go to it, even if syncing its directory failed)
+	info, statErr := fd.Stat()
+	if statErr != nil {
+		fd.Close()
+		return statErr
+	}
+	if log.file != nil {
+		log.file.Close()
+	}
+	log.file, log.size = fd, info.Size()
+	log.fileEntries = len(log.entries)
+	return err
+}
+
+// Writes a log, with no entries, into destDir (for a snapshot that is as of this log's last entry).
+// The copy is a new epoch: once it is changed, its history differs from this one's.
+func (log *ReplicationLog) CopyTo(destDir string) error {
+	epoch, err := newEpoch()
+	if err != nil {
+		return err
+	}
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	fd, err := log.writeFile(path.Join(destDir, REPLICATION_LOG_FILENAME), epoch, nil)
+	if fd != nil {
+		fd.Close()
+	}
+	return err
+}
+
+// Atomically writes a log file with the given epoch and entries (which must end with the last one), returning it
+// open. The file is returned (with any error) once it has replaced fileName.
+func (log *ReplicationLog) writeFile(fileName string, epoch string, entries []ReplicationEntry) (*os.File, error) {
+	tmpName := fileName + ".tmp"
+	fd, err := os.Create(tmpName)
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(fd)
+	encoder := json.NewEncoder(writer)
+	err = encoder.Encode(replicationLogHeader{Epoch: epoch, Seq: log.seq - int64(len(entries))})
+	for _, entry := range entries {
+		if err == nil {
+			err = encoder.Encode(entry)
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = fd.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return fd, SyncPath(path.Dir(fileName))
+}
+
+// Adds (and syncs) an entry for some indexed records or deleted ids.
+// Nothing changes, in memory or in the file, unless this succeeds.
+func (log *ReplicationLog) Append(records []Record, deletes []string) (ReplicationEntry, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	entry := ReplicationEntry{Seq: log.seq + 1, Records: records, Deletes: deletes}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+	line = append(line, '\n')
+	// (an append that failed may have left part of a line, which is dropped)
+	err = log.file.Truncate(log.size)
+	if err == nil {
+		_, err = log.file.WriteAt(line, log.size)
+	}
+	if err == nil {
+		err = log.file.Sync()
+	}
+	if err != nil {
+		return entry, err
+	}
+	log.size += int64(len(line))
+	log.apply(entry)
+	if log.fileEntries > 2*log.MaxEntries {
+		// (the entry is already logged, so this is not its failure; the file is rewritten again after a later entry)
+		err = log.rewrite()
+		if err != nil {
+			fmt.Printf("Unable to rewrite %s: %v\n", log.fileName, err)
+		}
+	}
+	return entry, nil
+}
+
+// The most recent entry, if there are any
+func (log *ReplicationLog) Last() (ReplicationEntry, bool) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if len(log.entries) == 0 {
+		return ReplicationEntry{}, false
+	}
+	return log.entries[len(log.entries)-1], true
+}
+
+func (log *ReplicationLog) Seq() int64 {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return log.seq
+}
+
+// Up to limit entries after the given sequence number; false if the log no longer has them
+func (log *ReplicationLog) Since(after int64, limit int) ([]ReplicationEntry, bool) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if after > log.seq {
+		return nil, false
+	}
+	firstSeq := log.seq + 1
+	if len(log.entries) > 0 {
+		firstSeq = log.entries[0].Seq
+	}
+	if after < firstSeq-1 {
+		return nil, false
+	}
+	entries := log.entries[after-firstSeq+1:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return append([]ReplicationEntry{}, entries...), true
+}
+
+func (log *ReplicationLog) Status() ReplicationStatus {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return ReplicationStatus{Epoch: log.Epoch, Seq: log.seq, LeaderSeq: log.seq}
+}
+
+// A new directory name for a snapshot to send to a follower
+func (log *ReplicationLog) snapshotDir() string {
+	return path.Join(path.Dir(log.fileName), fmt.Sprintf("%s%d", REPLICATION_SNAPSHOT_PREFIX, time.Now().UnixNano()))
+}
+
+func (log *ReplicationLog) Close() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return log.file.Close()
+}
+
+// A Db (on the leader) that logs the changes made to it, for followers.
+//
+// Each change is logged (durably) before it is applied to Db, so followers never see a change that the leader could
+// lose. A logged change that could not be applied (because Db failed, or the process crashed) is applied again
+// before the next one; changes are replacements and deletions, so applying one twice does no harm.
+type ReplicatedDb struct {
+	Db  Db
+	Log *ReplicationLog
+
+	lock      sync.Mutex        // (so that changes are applied in the order that they were logged)
+	unapplied *ReplicationEntry // a logged change that Db may not have yet
+}
+
+// Opens a ReplicatedDb, applying the last logged change (which a crash may have kept from db) again
+func NewReplicatedDb(db Db, log *ReplicationLog) (*ReplicatedDb, error) {
+	replicated := &ReplicatedDb{Db: db, Log: log}
+	if last, ok := log.Last(); ok {
+		replicated.unapplied = &last
+	}
+	return replicated, replicated.applyUnapplied()
+}
+
+func (db *ReplicatedDb) applyUnapplied() error {
+	if db.unapplied == nil {
+		return nil
+	}
+	err := applyEntry(db.Db, *db.unapplied)
+	if err != nil {
+		return fmt.Errorf("Logged change %d could not be applied: %v", db.unapplied.Seq, err)
+	}
+	db.unapplied = nil
+	return nil
+}
+
+func applyEntry(db Db, entry ReplicationEntry) error {
+	if len(entry.Records) > 0 {
+		err := db.BulkIndex(entry.Records)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range entry.Deletes {
+		err := db.Delete(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *ReplicatedDb) change(records []Record, deletes []string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	err := db.applyUnapplied()
+	if err != nil {
+		return err
+	}
+	entry, err := db.Log.Append(records, deletes)
+	if err != nil {
+		return err
+	}
+	db.unapplied = &entry
+	return db.applyUnapplied()
+}
+
+func (db *ReplicatedDb) BulkIndex(records []Record) error {
+	return db.change(records, nil)
+}
+
+func (db *ReplicatedDb) Index(id string, values map[string]float32) error {
+	return db.BulkIndex([]Record{Record{Id: id, Values: values}})
+}
+
+func (db *ReplicatedDb) Delete(id string) error {
+	return db.change(nil, []string{id})
+}
+
+// Copies the database and the log, as of the same change
+func (db *ReplicatedDb) Snapshot(dest string) error {
+	snapshotting, ok := db.Db.(SnapshottingDb)
+	if !ok {
+		return fmt.Errorf("%T does not support snapshots", db.Db)
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	err := db.applyUnapplied()
+	if err != nil {
+		return err
+	}
+	err = snapshotting.Snapshot(dest)
+	if err != nil {
+		return err
+	}
+	err = db.Log.CopyTo(dest)
+	if err != nil {
+		os.RemoveAll(dest)
+	}
+	return err
+}
+
+// Copies the database to dest, for a follower to catch up from, returning the position in the log it is as of
+func (db *ReplicatedDb) SnapshotForFollower(dest string) (ReplicationStatus, error) {
+	snapshotting, ok := db.Db.(SnapshottingDb)
+	if !ok {
+		return ReplicationStatus{}, fmt.Errorf("%T does not support snapshots", db.Db)
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	err := db.applyUnapplied()
+	if err == nil {
+		err = snapshotting.Snapshot(dest)
+	}
+	if err != nil {
+		return ReplicationStatus{}, err
+	}
+	return db.Log.Status(), nil
+}
+
+func (db *ReplicatedDb) Query(query Query) (QueryResult, error) {
+	return db.Db.Query(query)
+}
+
+func (db *ReplicatedDb) QueryContext(ctx context.Context, query Query) (QueryResult, error) {
+	return db.Db.QueryContext(ctx, query)
+}
+
+// Applies a leader's changes to a (read only) copy of its database.
+// The copy starts from a snapshot of the leader's database, which is streamed into a new directory and opened;
+// when the follower falls too far behind (or the leader's log is replaced), a new snapshot is swapped in.
+type Follower struct {
+	LeaderUrl string                       // for example, "http://10.0.0.5:11625"
+	Client    *http.Client                 // (optional) defaults to http.DefaultClient
+	Db        *MigratableDb                // the database to serve
+	Dir       string                       // each snapshot is copied into a new directory here, named replica.<n>
+	OpenDb    func(dir string) (Db, error) // opens a snapshot that has been copied into dir
+
+	lock      sync.Mutex
+	dir       string // the directory of the snapshot in use
+	epoch     string
+	seq       int64
+	leaderSeq int64
+	lastSync  time.Time
+	lastErr   error
+}
+
+func (f *Follower) client() *http.Client {
+	if f.Client != nil {
+		return f.Client
+	}
+	return http.DefaultClient
+}
+
+// Gets a path from the leader; false (and no response) if the leader answered 410 (Gone)
+func (f *Follower) get(path string, params url.Values) (*http.Response, bool, error) {
+	fullUrl := strings.TrimRight(f.LeaderUrl, "/") + path
+	if len(params) > 0 {
+		fullUrl += "?" + params.Encode()
+	}
+	resp, err := f.client().Get(fullUrl)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, false, nil
+	}
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, false, fmt.Errorf("Leader at %s failed (%d): %s", f.LeaderUrl, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return resp, true, nil
+}
+
+// Fetches a path from the leader, decoding its JSON response; false if the leader answered 410 (Gone)
+func (f *Follower) fetch(path string, params url.Values, response interface{}) (bool, error) {
+	resp, found, err := f.get(path, params)
+	if !found {
+		return false, err
+	}
+	defer resp.Body.Close()
+	return true, json.NewDecoder(resp.Body).Decode(response)
+}
+
+func (f *Follower) catchUp() error {
+	resp, found, err := f.get("/_replication/snapshot", nil)
+	if !found {
+		if err == nil {
+			err = fmt.Errorf("Leader at %s has no snapshot", f.LeaderUrl)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	epoch := resp.Header.Get(REPLICATION_EPOCH_HEADER)
+	seq, err := strconv.ParseInt(resp.Header.Get(REPLICATION_SEQ_HEADER), 10, 64)
+	if epoch == "" || err != nil {
+		return fmt.Errorf("Leader at %s sent a snapshot without its position in the log", f.LeaderUrl)
+	}
+	dir := path.Join(f.Dir, fmt.Sprintf("replica.%d", time.Now().UnixNano()))
+	err = extractTar(resp.Body, dir)
+	if err != nil {
+		return err
+	}
+	db, err := f.OpenDb(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	old, oldDir := f.Db.Swap(db), f.dir
+	f.lock.Lock()
+	f.dir, f.epoch, f.seq, f.leaderSeq = dir, epoch, seq, seq
+	f.lock.Unlock()
+	if old != nil { // (Swap() waited for the queries using it)
+		err = CloseIfCloser(old)
+		if err != nil {
+			fmt.Printf("Unable to close the replica at %s: %v\n", oldDir, err)
+		}
+		os.RemoveAll(oldDir)
+	}
+	return nil
+}
+
+func (f *Follower) apply(entries []ReplicationEntry) error {
+	for _, entry := range entries {
+		if entry.Seq != f.seq+1 {
+			return fmt.Errorf("Leader at %s sent entry %d after %d", f.LeaderUrl, entry.Seq, f.seq)
+		}
+		err := applyEntry(f.Db, entry)
+		if err != nil {
+			return err
+		}
+		f.lock.Lock()
+		f.seq = entry.Seq
+		f.lock.Unlock()
+	}
+	return nil
+}
+
+func (f *Follower) sync() error {
+	if f.epoch == "" || f.Db.Current() == nil {
+		err := f.catchUp()
+		if err != nil {
+			return err
+		}
+	}
+	for {
+		params := url.Values{
+			"epoch": []string{f.epoch},
+			"after": []string{strconv.FormatInt(f.seq, 10)},
+		}
+		var response replicationLogResponse
+		found, err := f.fetch("/_replication/log", params, &response)
+		if err != nil {
+			return err
+		}
+		if !found { // (too far behind)
+			err = f.catchUp()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		f.lock.Lock()
+		f.leaderSeq = response.Seq
+		f.lock.Unlock()
+		err = f.apply(response.Entries)
+		if err != nil {
+			return err
+		}
+		if f.seq >= response.Seq || len(response.Entries) == 0 {
+			return nil
+		}
+	}
+}
+
+// Applies everything that is new on the leader
+func (f *Follower) Sync() error {
+	err := f.sync()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lastErr = err
+	if err == nil {
+		f.lastSync = time.Now()
+	}
+	return err
+}
+
+// Syncs at the given interval, forever
+func (f *Follower) Run(interval time.Duration) {
+	for {
+		err := f.Sync()
+		if err != nil {
+			fmt.Printf("Unable to replicate %s: %v\n", f.LeaderUrl, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (f *Follower) Status() ReplicationStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status := ReplicationStatus{Leader: f.LeaderUrl, Epoch: f.epoch, Seq: f.seq, LeaderSeq: f.leaderSeq, Lag: f.leaderSeq - f.seq}
+	if !f.lastSync.IsZero() {
+		lastSync := f.lastSync
+		status.LastSync = &lastSync
+	}
+	if f.lastErr != nil {
+		status.Error = f.lastErr.Error()
+	}
+	return status
+}
@@ -0,0 +1,219 @@
+package scoredb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReplicationLogReopen(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	dataDir := pathmaker("replication_log")
+	log, err := OpenReplicationLog(dataDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Append([]Record{Record{Id: "r1", Values: map[string]float32{"age": 32}}}, nil)
+	log.Append([]Record{Record{Id: "r2", Values: map[string]float32{"age": 25}}}, nil)
+	log.Append(nil, []string{"r1"})
+	log.Close()
+
+	// an append that did not finish is ignored
+	fd, err := os.OpenFile(path.Join(dataDir, REPLICATION_LOG_FILENAME), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString(`{"Seq":4,"Records":[{"Id":"r3"`)
+	fd.Close()
+
+	reopened, err := OpenReplicationLog(dataDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if reopened.Epoch != log.Epoch || reopened.Seq() != 3 {
+		t.Fatalf("expected epoch %s at 3, found epoch %s at %d", log.Epoch, reopened.Epoch, reopened.Seq())
+	}
+	if _, ok := reopened.Since(0, 10); ok {
+		t.Fatal("expected entries beyond MaxEntries to be gone")
+	}
+	entries, ok := reopened.Since(1, 10)
+	if !ok || len(entries) != 2 || entries[1].Deletes[0] != "r1" {
+		t.Fatalf("unexpected entries: %v", entries)
+	}
+	entry, err := reopened.Append(nil, []string{"r2"})
+	if err != nil || entry.Seq != 4 {
+		t.Fatalf("expected to append entry 4, found %d (%v)", entry.Seq, err)
+	}
+
+	// the file is rewritten with just the recent entries
+	for idx := 0; idx < 5; idx++ {
+		reopened.Append(nil, []string{fmt.Sprintf("r%d", idx)})
+	}
+	buf, err := ioutil.ReadFile(path.Join(dataDir, REPLICATION_LOG_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if numLines := strings.Count(string(buf), "\n"); numLines > 1+2*reopened.MaxEntries {
+		t.Fatalf("expected the file to be rewritten, found %d lines", numLines)
+	}
+	rewritten, err := OpenReplicationLog(dataDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rewritten.Close()
+	entries, ok = rewritten.Since(7, 10)
+	if rewritten.Seq() != 9 || !ok || len(entries) != 2 || entries[1].Deletes[0] != "r4" {
+		t.Fatalf("unexpected entries at %d: %v", rewritten.Seq(), entries)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	log, err := OpenReplicationLog(pathmaker("replication_leader"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	leaderDb := OpenSnapshotDb(t, pathmaker("replication_leader_db"), 2)
+	leaderDb.Index("r0", map[string]float32{"age": 40}) // (from before the log)
+	leader, err := NewReplicatedDb(leaderDb, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(&ScoreDbServer{Db: leader, ReplicationLog: log})
+	defer httpServer.Close()
+
+	followerDir := pathmaker("replication_follower")
+	numDbs := 0
+	follower := &Follower{LeaderUrl: httpServer.URL, Db: &MigratableDb{}, Dir: followerDir}
+	follower.OpenDb = func(dir string) (Db, error) {
+		numDbs++
+		return OpenSnapshotDb(t, dir, 2), nil
+	}
+	checkSync := func(expectedDbs int) {
+		err := follower.Sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numDbs != expectedDbs {
+			t.Fatalf("expected %d snapshots to be loaded, found %d", expectedDbs, numDbs)
+		}
+		status := follower.Status()
+		if status.Lag != 0 || status.Seq != log.Seq() || status.Error != "" {
+			t.Fatalf("unexpected status: %+v", status)
+		}
+		query := Query{Limit: 10, Scorer: []interface{}{"field", "age"}}
+		expected, err := leader.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := follower.Db.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, found) {
+			t.Fatalf("expected: %v found: %v", expected, found)
+		}
+		replicaDirs, _ := filepath.Glob(path.Join(followerDir, "replica.*"))
+		if len(replicaDirs) != 1 {
+			t.Fatalf("expected only the replica in use to remain, found %v", replicaDirs)
+		}
+	}
+
+	leader.Index("r1", map[string]float32{"age": 32})
+	checkSync(1)
+
+	leader.Index("r2", map[string]float32{"age": 25})
+	leader.Index("r1", map[string]float32{"age": 12})
+	leader.Delete("r2")
+	checkSync(1) // (from the log)
+
+	for idx := 0; idx < 5; idx++ {
+		leader.Index(fmt.Sprintf("r%d", idx+3), map[string]float32{"age": float32(idx)})
+	}
+	checkSync(2) // (too far behind; from a snapshot)
+
+	snapshotDirs, _ := filepath.Glob(path.Join(path.Dir(log.fileName), REPLICATION_SNAPSHOT_PREFIX+"*"))
+	if len(snapshotDirs) != 0 {
+		t.Fatalf("expected the leader's snapshots to be removed once sent, found %v", snapshotDirs)
+	}
+}
+
+// Fails every change while failing is set
+type failingDb struct {
+	Db
+	failing bool
+}
+
+func (db *failingDb) BulkIndex(records []Record) error {
+	if db.failing {
+		return fmt.Errorf("failing")
+	}
+	return db.Db.BulkIndex(records)
+}
+
+func TestReplicatedDbAppliesLoggedChanges(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	dataDir := pathmaker("replication_unapplied")
+	log, err := OpenReplicationLog(dataDir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &failingDb{Db: BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}}
+	leader, err := NewReplicatedDb(db, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := Query{Limit: 10, Scorer: []interface{}{"field", "age"}}
+
+	db.failing = true
+	if leader.Index("r1", map[string]float32{"age": 32}) == nil {
+		t.Fatal("expected the change to fail")
+	}
+	if log.Seq() != 1 {
+		t.Fatalf("expected the change to be logged, found seq %d", log.Seq())
+	}
+	if leader.Delete("r2") == nil {
+		t.Fatal("expected changes to fail until the logged one is applied")
+	}
+	if log.Seq() != 1 {
+		t.Fatalf("expected nothing more to be logged, found seq %d", log.Seq())
+	}
+
+	db.failing = false
+	err = leader.Index("r2", map[string]float32{"age": 25})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := leader.Query(query)
+	if err != nil || !reflect.DeepEqual(result.Ids, []string{"r1", "r2"}) {
+		t.Fatalf("expected both changes to be applied, found %v (%v)", result.Ids, err)
+	}
+	log.Close()
+
+	// a crash between logging a change and applying it
+	reopened, err := OpenReplicationLog(dataDir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	fresh := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	_, err = NewReplicatedDb(fresh, reopened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = fresh.Query(query)
+	if err != nil || !reflect.DeepEqual(result.Ids, []string{"r2"}) {
+		t.Fatalf("expected the last change to be applied again, found %v (%v)", result.Ids, err)
+	}
+}
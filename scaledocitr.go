@@ -8,7 +8,8 @@ type ScaleDocItr struct {
 	docItr DocItr
 }
 
-func (op *ScaleDocItr) Name() string { return "ScaleDocItr" }
+func (op *ScaleDocItr) Name() string       { return "ScaleDocItr" }
+func (op *ScaleDocItr) Children() []DocItr { return []DocItr{op.docItr} }
 func (op *ScaleDocItr) Cur() (int64, float32) {
 	docId, score := op.docItr.Cur()
 	return docId, score * op.factor
@@ -25,6 +26,9 @@ func (op *ScaleDocItr) GetBounds() (min, max float32) {
 func (op *ScaleDocItr) Close() {
 	op.docItr.Close()
 }
+func (op *ScaleDocItr) Err() error {
+	return op.docItr.Err()
+}
 func (op *ScaleDocItr) Next(minId int64) bool {
 	return op.docItr.Next(minId)
 }
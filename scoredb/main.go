@@ -6,16 +6,33 @@ import (
 	"flag"
 	"fmt"
 	"github.com/pschanely/scoredb"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 )
 
-func MakeStandardDb(dataDir string, numShards int) (*scoredb.BaseDb, error) {
+// If compactInterval is nonzero, each shard is compacted in the background at that interval.
+// If storeValues is set, field values are stored so that queries can return them.
+func MakeStandardDb(dataDir string, numShards int, compactInterval time.Duration, storeValues bool) (*scoredb.BaseDb, error) {
 	var shards []scoredb.StreamingDb
+	makeShard := func(shardDir string) (scoredb.StreamingDb, error) {
+		fsDb, err := scoredb.NewFsScoreDb(shardDir)
+		if err != nil {
+			return nil, err
+		}
+		fsDb.StoreValues = storeValues
+		if compactInterval > 0 {
+			go fsDb.CompactPeriodically(compactInterval)
+		}
+		return scoredb.BaseStreamingDb{Backend: fsDb}, nil
+	}
 
 	if scoredb.Exists(dataDir) && scoredb.Exists(path.Join(dataDir, "shard.0")) {
 		i := 0
@@ -23,7 +40,11 @@ func MakeStandardDb(dataDir string, numShards int) (*scoredb.BaseDb, error) {
 		for {
 			shardDir := path.Join(dataDir, fmt.Sprintf("shard.%d", i))
 			if scoredb.Exists(shardDir) {
-				shards = append(shards, scoredb.BaseStreamingDb{scoredb.NewFsScoreDb(shardDir)})
+				shard, err := makeShard(shardDir)
+				if err != nil {
+					return nil, err
+				}
+				shards = append(shards, shard)
 			} else {
 				break
 			}
@@ -33,7 +54,11 @@ func MakeStandardDb(dataDir string, numShards int) (*scoredb.BaseDb, error) {
 		shards = make([]scoredb.StreamingDb, numShards)
 		for i := range shards {
 			shardDir := path.Join(dataDir, fmt.Sprintf("shard.%d", i))
-			shards[i] = scoredb.BaseStreamingDb{scoredb.NewFsScoreDb(shardDir)}
+			shard, err := makeShard(shardDir)
+			if err != nil {
+				return nil, err
+			}
+			shards[i] = shard
 		}
 	}
 	idDb, err := scoredb.NewBoltIdDb(path.Join(dataDir, "iddb"))
@@ -44,7 +69,31 @@ func MakeStandardDb(dataDir string, numShards int) (*scoredb.BaseDb, error) {
 		StreamingDb: scoredb.ShardedDb{
 			Shards: shards,
 		},
-		IdDb: idDb,
+		IdDb:      idDb,
+		WriteLock: &sync.Mutex{},
+	}, nil
+}
+
+// Shards across other scoredb servers; only the mapping of ids is kept locally, in dataDir.
+func MakeRemoteDb(dataDir string, baseUrls []string) (*scoredb.BaseDb, error) {
+	shards := make([]scoredb.StreamingDb, len(baseUrls))
+	for i, baseUrl := range baseUrls {
+		shards[i] = scoredb.RemoteStreamingDb{BaseUrl: strings.TrimSpace(baseUrl)}
+	}
+	err := os.MkdirAll(dataDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	idDb, err := scoredb.NewBoltIdDb(path.Join(dataDir, "iddb"))
+	if err != nil {
+		return nil, err
+	}
+	return &scoredb.BaseDb{
+		StreamingDb: scoredb.ShardedDb{
+			Shards: shards,
+		},
+		IdDb:      idDb,
+		WriteLock: &sync.Mutex{},
 	}, nil
 }
 
@@ -74,12 +123,18 @@ func watchDir(db *scoredb.MigratableDb, baseDir string, namePrefix string) {
 			if newDbName > lastName {
 				fmt.Printf("Detected database at %s%s\n", baseDir, newDbName)
 				fullDbName := path.Join(baseDir, newDbName)
-				newDb, err := MakeStandardDb(fullDbName, 1)
+				newDb, err := MakeStandardDb(fullDbName, 1, 0, false)
 				if err != nil {
-					log.Printf("Unable to load database at %s%s (%v); ignoring\n", dir, fullDbName, err)
+					log.Printf("Unable to load database at %s (%v); ignoring\n", fullDbName, err)
 				} else {
 					fmt.Printf("The database at %s%s is live at %v\n", baseDir, fullDbName, time.Now().Unix())
-					db.Current = newDb
+					old := db.Swap(newDb) // (once no query is using it)
+					if old != nil {
+						err = scoredb.CloseIfCloser(old)
+						if err != nil {
+							log.Printf("Unable to close the database replaced by %s: %v\n", fullDbName, err)
+						}
+					}
 					lastName = newDbName
 				}
 			}
@@ -88,12 +143,27 @@ func watchDir(db *scoredb.MigratableDb, baseDir string, namePrefix string) {
 	}
 }
 
+// Replicates the leader, copying each snapshot that it needs into a new directory in dataDir
+func SetupFollower(dataDir string, leaderUrl string, storeValues bool, interval time.Duration) *scoredb.Follower {
+	staleDirs, _ := filepath.Glob(path.Join(dataDir, "replica.*"))
+	for _, staleDir := range staleDirs { // (copies from earlier runs start over, from a snapshot)
+		os.RemoveAll(staleDir)
+	}
+	follower := &scoredb.Follower{LeaderUrl: leaderUrl, Db: &scoredb.MigratableDb{}, Dir: dataDir}
+	follower.OpenDb = func(replicaDir string) (scoredb.Db, error) {
+		return MakeStandardDb(replicaDir, 1, 0, storeValues) // (the shards are the leader's)
+	}
+	fmt.Printf("Replicating %s\n", leaderUrl)
+	go follower.Run(interval)
+	return follower
+}
+
 func SetupDirLoading(databaseDir string) *scoredb.MigratableDb {
-	migratable := scoredb.MigratableDb{Current: nil}
+	migratable := &scoredb.MigratableDb{}
 	baseDir, namePrefix := path.Split(databaseDir)
 	fmt.Printf("Watching for new databases named %s* in %s\n", namePrefix, baseDir)
-	go watchDir(&migratable, baseDir, namePrefix)
-	return &migratable
+	go watchDir(migratable, baseDir, namePrefix)
+	return migratable
 }
 
 func main() {
@@ -105,10 +175,36 @@ func main() {
 	serveNumShards := serveCommand.Int("numshards", 4, "Number of shards")
 	serveReadOnly := serveCommand.Bool("readonly", false, "Only allow GET requests")
 	serveAutoMigrate := serveCommand.Bool("automigrate", false, "When new directories appear matching <datadir>*, atomically swap in the database at that directory. (lexigraphically last)")
+	serveStoreValues := serveCommand.Bool("storevalues", false, "Store field values, so that queries can return them with the \"fields\" parameter")
+	serveCompactInterval := serveCommand.Duration("compactinterval", 0, "If set (for example, \"10m\"), periodically compact the posting lists of each shard in the background")
+	serveRemotes := serveCommand.String("remotes", "", "Comma separated base urls of scoredb servers (each run with -numshards 1) to use as shards, instead of local ones; only ids are stored in <datadir>")
+	serveReplicationLog := serveCommand.Int("replicationlog", 0, "If set, log changes so that followers can replicate this server, keeping this many recent batches for them to catch up with")
+	serveFollow := serveCommand.String("follow", "", "Base url of a leader (run with -replicationlog) to replicate, read only; copies are kept in <datadir>/replica.*")
+	serveFollowInterval := serveCommand.Duration("followinterval", time.Second, "How often a follower checks its leader for changes")
+	serveStream := serveCommand.Bool("servestream", false, "Serve queries under /_stream/, so that another server can use this one as a shard (see -remotes)")
+	serveStreamWrites := serveCommand.Bool("streamwrites", false, "With -servestream, also accept changes under /_stream/; these bypass this server's ids, so only the server using this one as a shard should make them")
+	serveSnapshotDir := serveCommand.String("snapshotdir", "", "If set, POST /_admin/snapshot makes a consistent copy of the database in a new directory here (see \"scoredb snapshot\")")
 
 	loadCommand := flag.NewFlagSet("load", flag.ExitOnError)
 	loadDataDir := loadCommand.String("datadir", "./data", "Storage directory for database")
 	loadNumShards := loadCommand.Int("numshards", 4, "Number of shards (ignored if db already exists)")
+	loadStoreValues := loadCommand.Bool("storevalues", false, "Store field values, so that queries can return them with the \"fields\" parameter")
+
+	compactCommand := flag.NewFlagSet("compact", flag.ExitOnError)
+	compactDataDir := compactCommand.String("datadir", "./data", "Storage directory for database")
+
+	snapshotCommand := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	snapshotUrl := snapshotCommand.String("url", "", "Base url of a running server (started with -snapshotdir) to snapshot")
+	snapshotDataDir := snapshotCommand.String("datadir", "./data", "Storage directory of a database that is not being served, to snapshot (ignored with -url)")
+	snapshotDest := snapshotCommand.String("dest", "", "Directory (which must not exist yet) for the snapshot (ignored with -url)")
+
+	restoreCommand := flag.NewFlagSet("restore", flag.ExitOnError)
+	restoreFrom := restoreCommand.String("from", "", "Snapshot directory to restore")
+	restoreDataDir := restoreCommand.String("datadir", "./data", "Storage directory (which must not exist yet) to restore into")
+
+	fsckCommand := flag.NewFlagSet("fsck", flag.ExitOnError)
+	fsckDataDir := fsckCommand.String("datadir", "./data", "Storage directory for database")
+	fsckRepair := fsckCommand.Bool("repair", false, "Repair problems: truncate damaged posting lists to their last valid entry, and delete documents with no client id")
 
 	benchCommand := flag.NewFlagSet("benchmark", flag.ExitOnError)
 	benchCsvFilename := benchCommand.String("csv", "", "csv filename of census data")
@@ -129,29 +225,57 @@ func main() {
 		fmt.Println("Commands:")
 		fmt.Println(" serve      Run a scoredb server")
 		fmt.Println(" load       Load json lines from stdin")
+		fmt.Println(" compact    Compact the posting lists of an (offline) database")
+		fmt.Println(" fsck       Check (and optionally repair) an (offline) database")
+		fmt.Println(" snapshot   Make a consistent copy of a (running or offline) database")
+		fmt.Println(" restore    Copy a snapshot into place, to be served")
 		fmt.Println(" benchmark  Run performance benchmarks")
 		fmt.Println("For more help, run scoredb <command> -h")
 		os.Exit(1)
 	}
-	var db scoredb.Db
 	var err error
 	switch os.Args[1] {
 	case "serve":
 		serveCommand.Parse(os.Args[2:])
-		if *serveAutoMigrate {
-			db = SetupDirLoading(*serveDataDir)
+		server := &scoredb.ScoreDbServer{ReadOnly: *serveReadOnly, SnapshotDir: *serveSnapshotDir}
+		if *serveFollow != "" {
+			server.Follower = SetupFollower(*serveDataDir, *serveFollow, *serveStoreValues, *serveFollowInterval)
+			server.Db, server.ReadOnly = server.Follower.Db, true
+		} else if *serveAutoMigrate {
+			server.Db = SetupDirLoading(*serveDataDir)
 		} else {
-			db, err = MakeStandardDb(*serveDataDir, *serveNumShards)
+			var baseDb *scoredb.BaseDb
+			if *serveRemotes != "" {
+				baseDb, err = MakeRemoteDb(*serveDataDir, strings.Split(*serveRemotes, ","))
+			} else {
+				baseDb, err = MakeStandardDb(*serveDataDir, *serveNumShards, *serveCompactInterval, *serveStoreValues)
+			}
 			if err != nil {
 				log.Fatalf("Failed to initialize database at %v: %v\n", *serveDataDir, err)
 			}
+			server.Db = baseDb
+			if *serveStream {
+				server.StreamingDb, server.StreamWrites = baseDb.StreamingDb, *serveStreamWrites
+			}
+			if *serveReplicationLog > 0 {
+				server.ReplicationLog, err = scoredb.OpenReplicationLog(*serveDataDir, *serveReplicationLog)
+				if err != nil {
+					log.Fatalf("Failed to open the replication log at %v: %v\n", *serveDataDir, err)
+				}
+				// (changes must go through the log, so the StreamingDb is not served)
+				server.Db, err = scoredb.NewReplicatedDb(baseDb, server.ReplicationLog)
+				if err != nil {
+					log.Fatalf("Failed to apply the replication log at %v: %v\n", *serveDataDir, err)
+				}
+				server.StreamingDb = nil
+			}
 		}
 		addr := fmt.Sprintf("%s:%d", *serveIntf, *servePort)
 		fmt.Printf("Serving on %s\n", addr)
-		log.Fatal(scoredb.ServeHttp(addr, db, *serveReadOnly))
+		log.Fatal(http.ListenAndServe(addr, server))
 	case "load":
 		loadCommand.Parse(os.Args[2:])
-		db, err := MakeStandardDb(*loadDataDir, *loadNumShards)
+		db, err := MakeStandardDb(*loadDataDir, *loadNumShards, 0, *loadStoreValues)
 		if err != nil {
 			log.Fatal(fmt.Sprintf("Failed to initialize database at %v: %v\n", *loadDataDir, err))
 		}
@@ -174,6 +298,92 @@ func main() {
 		if batchIndex > 0 {
 			db.BulkIndex(batch[:batchIndex])
 		}
+	case "compact":
+		compactCommand.Parse(os.Args[2:])
+		for i := 0; scoredb.Exists(path.Join(*compactDataDir, fmt.Sprintf("shard.%d", i))); i++ {
+			shardDir := path.Join(*compactDataDir, fmt.Sprintf("shard.%d", i))
+			fsDb, err := scoredb.NewFsScoreDb(shardDir)
+			if err == nil {
+				err = fsDb.CompactAll()
+			}
+			if err != nil {
+				log.Fatalf("Failed to compact %v: %v\n", shardDir, err)
+			}
+		}
+	case "snapshot":
+		snapshotCommand.Parse(os.Args[2:])
+		if *snapshotUrl != "" {
+			resp, err := http.Post(strings.TrimRight(*snapshotUrl, "/")+"/_admin/snapshot", "application/json", nil)
+			if err != nil {
+				log.Fatalf("Failed to reach %v: %v\n", *snapshotUrl, err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 {
+				log.Fatalf("Failed to snapshot %v (%d): %s\n", *snapshotUrl, resp.StatusCode, strings.TrimSpace(string(body)))
+			}
+			fmt.Println(string(body))
+		} else {
+			if *snapshotDest == "" {
+				log.Fatalf("Either -url or -dest is required\n")
+			}
+			if !scoredb.Exists(path.Join(*snapshotDataDir, "shard.0")) {
+				log.Fatalf("No database found at %v\n", *snapshotDataDir)
+			}
+			db, err := MakeStandardDb(*snapshotDataDir, 1, 0, false)
+			if err == nil {
+				err = db.Snapshot(*snapshotDest)
+			}
+			if err != nil {
+				log.Fatalf("Failed to snapshot %v: %v\n", *snapshotDataDir, err)
+			}
+			fmt.Printf("Snapshot of %s written to %s\n", *snapshotDataDir, *snapshotDest)
+		}
+	case "restore":
+		restoreCommand.Parse(os.Args[2:])
+		err = scoredb.RestoreSnapshot(*restoreFrom, *restoreDataDir)
+		if err != nil {
+			log.Fatalf("Failed to restore %v: %v\n", *restoreFrom, err)
+		}
+		fmt.Printf("Restored %s to %s\n", *restoreFrom, *restoreDataDir)
+	case "fsck":
+		fsckCommand.Parse(os.Args[2:])
+		shardDirs := make([]string, 0)
+		results := make([]*scoredb.FsckResult, 0)
+		problems := make([]scoredb.FsckProblem, 0)
+		for i := 0; scoredb.Exists(path.Join(*fsckDataDir, fmt.Sprintf("shard.%d", i))); i++ {
+			shardDir := path.Join(*fsckDataDir, fmt.Sprintf("shard.%d", i))
+			result, err := scoredb.FsckShard(shardDir, *fsckRepair)
+			if err != nil {
+				log.Fatalf("Failed to check %v: %v\n", shardDir, err)
+			}
+			shardDirs = append(shardDirs, shardDir)
+			results = append(results, result)
+			problems = append(problems, result.Problems...)
+		}
+		if len(shardDirs) == 0 {
+			log.Fatalf("No shards found in %v\n", *fsckDataDir)
+		}
+		idDb, err := scoredb.NewBoltIdDb(path.Join(*fsckDataDir, "iddb"))
+		if err != nil {
+			log.Fatalf("Failed to open id database: %v\n", err)
+		}
+		idProblems, err := scoredb.FsckIdDb(idDb, shardDirs, results, *fsckRepair)
+		if err != nil {
+			log.Fatalf("Failed to check id database: %v\n", err)
+		}
+		problems = append(problems, idProblems...)
+		numUnrepaired := 0
+		for _, problem := range problems {
+			fmt.Println(problem)
+			if !problem.Repaired {
+				numUnrepaired += 1
+			}
+		}
+		fmt.Printf("%d problems found in %d shards\n", len(problems), len(shardDirs))
+		if numUnrepaired > 0 {
+			os.Exit(1)
+		}
 	case "benchmark":
 		outputFd, err := os.Create(*benchCsvOutput)
 		if err != nil {
@@ -183,7 +393,7 @@ func main() {
 		runtime.GOMAXPROCS(runtime.NumCPU())
 		benchCommand.Parse(os.Args[2:])
 		esDb := &scoredb.EsScoreDb{BaseURL: *benchEsUrl, Index: *benchEsIndex}
-		fsDb, err := MakeStandardDb(*benchFsDataDir, 4)
+		fsDb, err := MakeStandardDb(*benchFsDataDir, 4, 0, false)
 		if err != nil {
 			log.Fatal(fmt.Sprintf("Failed to initialize database at %v: %v\n", *benchFsDataDir, err))
 		}
@@ -1,9 +1,15 @@
 package scoredb
 
 import (
+	"container/heap"
+	"context"
 	"fmt"
+	"hash/fnv"
 	"math"
-	"math/rand"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 type ShardedDb struct {
@@ -24,107 +30,360 @@ func ShardIdToExt(idInShard int64, shardNum int) int64 {
 	return (int64(shardNum) << uint(64-reservedShardBits)) | idInShard
 }
 
-func (db ShardedDb) BulkIndex(records []map[string]float32) ([]int64, error) {
+func ShardIdFromExt(extId int64) (idInShard int64, shardNum int) {
+	shift := uint(64 - reservedShardBits)
+	return extId & ((1 << shift) - 1), int(extId >> shift)
+}
+
+// The shard that a record belongs in, by a hash of its client id
+func ShardNumFor(clientId string, numShards int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(clientId))
+	return int(hash.Sum32() % uint32(numShards))
+}
+
+// Each record goes to the shard that its client id hashes to, so that a record always lands in the same shard.
+// Each shard indexes its part of the batch concurrently; if any of them fail, the others' parts are deleted again.
+func (db ShardedDb) BulkIndex(clientIds []string, records []map[string]float32) ([]int64, error) {
 	numShards := len(db.Shards)
-	// TODO do something more complex some day?  Parallelize it like the query side?
-	shardNum := rand.Intn(numShards)
-	results, err := db.Shards[shardNum].BulkIndex(records)
-	if err != nil {
+	positionsByShard := make([][]int, numShards)
+	for idx, clientId := range clientIds {
+		shardNum := ShardNumFor(clientId, numShards)
+		positionsByShard[shardNum] = append(positionsByShard[shardNum], idx)
+	}
+	results := make([]int64, len(records))
+	idsByShard := make([][]int64, numShards)
+	errs := make([]error, numShards)
+	var wg sync.WaitGroup
+	for shardNum, positions := range positionsByShard {
+		if len(positions) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(shardNum int, positions []int) {
+			defer wg.Done()
+			shardClientIds := make([]string, len(positions))
+			shardRecords := make([]map[string]float32, len(positions))
+			for idx, position := range positions {
+				shardClientIds[idx] = clientIds[position]
+				shardRecords[idx] = records[position]
+			}
+			idsByShard[shardNum], errs[shardNum] = db.Shards[shardNum].BulkIndex(shardClientIds, shardRecords)
+		}(shardNum, positions)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		for shardNum, ids := range idsByShard {
+			if errs[shardNum] == nil && len(ids) > 0 {
+				db.Shards[shardNum].Delete(ids) // (best effort; the original error is more interesting)
+			}
+		}
 		return nil, err
 	}
-	for idx, v := range results {
-		results[idx] = ShardIdToExt(v, shardNum)
+	for shardNum, positions := range positionsByShard {
+		for idx, position := range positions {
+			results[position] = ShardIdToExt(idsByShard[shardNum][idx], shardNum)
+		}
 	}
 	return results, nil
 }
 
-func (db ShardedDb) QueryItr(scorer []interface{}) (DocItr, error) {
+func (db ShardedDb) Delete(ids []int64) error {
+	idsByShard := make(map[int][]int64)
+	for _, id := range ids {
+		idInShard, shardNum := ShardIdFromExt(id)
+		idsByShard[shardNum] = append(idsByShard[shardNum], idInShard)
+	}
+	for shardNum, shardIds := range idsByShard {
+		if shardNum >= len(db.Shards) {
+			return fmt.Errorf("Cannot delete ids in shard %d; only %d shards exist", shardNum, len(db.Shards))
+		}
+		err := db.Shards[shardNum].Delete(shardIds)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies each shard to dest/shard.<n> (the layout that the scoredb command uses)
+func (db ShardedDb) Snapshot(dest string) error {
+	err := EnsureDirectory(dest)
+	if err != nil {
+		return err
+	}
+	for idx, shard := range db.Shards {
+		snapshotting, ok := shard.(SnapshottingDb)
+		if !ok {
+			return fmt.Errorf("%T does not support snapshots", shard)
+		}
+		err = snapshotting.Snapshot(path.Join(dest, fmt.Sprintf("shard.%d", idx)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Closes every shard (returning the first error)
+func (db ShardedDb) Close() error {
+	var firstErr error
+	for _, shard := range db.Shards {
+		err := CloseIfCloser(shard)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (db ShardedDb) FieldValues(ids []int64, fields []string) ([]map[string]float32, error) {
+	idsByShard := make(map[int][]int64)
+	positionsByShard := make(map[int][]int)
+	for idx, id := range ids {
+		idInShard, shardNum := ShardIdFromExt(id)
+		if shardNum >= len(db.Shards) {
+			return nil, fmt.Errorf("Cannot get values for ids in shard %d; only %d shards exist", shardNum, len(db.Shards))
+		}
+		idsByShard[shardNum] = append(idsByShard[shardNum], idInShard)
+		positionsByShard[shardNum] = append(positionsByShard[shardNum], idx)
+	}
+	results := make([]map[string]float32, len(ids))
+	for shardNum, shardIds := range idsByShard {
+		values, err := db.Shards[shardNum].FieldValues(shardIds, fields)
+		if err != nil {
+			return nil, err
+		}
+		for idx, position := range positionsByShard[shardNum] {
+			results[position] = values[idx]
+		}
+	}
+	return results, nil
+}
+
+func (db ShardedDb) QueryItr(ctx context.Context, expr *Expr) (DocItr, error) {
 	parts := make([]DocItr, len(db.Shards))
 	for idx, shard := range db.Shards {
-		itr, err := shard.QueryItr(scorer)
+		itr, err := shard.QueryItr(ctx, expr)
 		if err != nil {
+			for _, prev := range parts[:idx] {
+				prev.Close()
+			}
 			return nil, err
 		}
 		parts[idx] = itr
 	}
-	return NewParallelDocItr(parts), nil
+	return NewParallelDocItr(ctx, parts), nil
 }
 
-type CandidateResult struct {
-	DocId     int64
-	Score     float32
-	WorkerNum int
+// Iterators that work ahead of their consumer implement this, so that they can do less work.
+// It must be called before the first call to Next().
+// These iterators also watch the query's context themselves: once it is done, they quickly produce the candidates
+// that they have already found, then stop, with the context's error.
+type TopKDocItr interface {
+	// Only the best k documents (by CandidateIsLess) will be used; 0 means all of them.
+	// With explain, Explain() is also needed for each document.
+	SetTopK(k int, explain bool)
 }
 
-type Bounds struct {
-	min, max float32
+// The number of candidates that a worker sends at once, when it is not keeping its best k
+const PARALLEL_BATCH_SIZE = 256
+
+// Candidates from one worker, in increasing order of doc id
+type CandidateBatch struct {
+	Worker       int
+	Candidates   []DocScore    // doc ids are external ids (see ShardIdToExt)
+	Explanations []Explanation // when explaining, one for each candidate
+	Final        bool          // the worker has finished
+	Err          error         // (only on the final batch)
 }
 
+// Runs an iterator for each shard at once, each in its own worker goroutine.
+// Each worker keeps its own best k candidates, and only sends them once it is done; meanwhile, the workers
+// share the lowest score that can still make it into the results, so that each can prune its iterator
+// with what the others have found.
+// Documents are produced in order of their (external) ids, which is shard by shard; batches from the workers
+// whose turn has not yet come are held until it does.
+// When the context is done, each worker stops and leaves what it has found (see collect()), so that the results
+// found so far are still produced.
 type ParallelDocItr struct {
-	score         float32
-	docId         int64
-	NumAlive      int
-	Bounds        Bounds
-	ResultChannel chan CandidateResult
-	Comms         []chan Bounds
+	score    float32
+	docId    int64
+	min, max float32
+	parts    []DocItr
+	topK     int
+	explain  bool
+	started  bool
+	batches  chan CandidateBatch
+	pending  [][]CandidateBatch // for each worker, the batches received but not yet produced
+	left     []CandidateBatch   // for each worker, the final batch that it could not send (once the context is done)
+	drained  bool               // everything that the workers sent or left is in pending
+	worker   int                // the worker whose candidates are being produced
+	batch    CandidateBatch     // the candidates being produced
+	batchIdx int
+	bound    uint32 // the bits of the shared lower bound on scores; use loadBound() and raiseBound()
+	maxBound uint32 // the bits of the upper bound on scores; use loadMaxBound()
+	done     <-chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc // stops the workers
+	workers  sync.WaitGroup
+	err      error
 }
 
-func RunItr(itr DocItr, myWorkerNum int, resultChannel chan CandidateResult, boundsChannel chan Bounds) {
-	bounds := Bounds{min: float32(math.Inf(-1)), max: float32(math.Inf(1))}
+func NewParallelDocItr(ctx context.Context, parts []DocItr) *ParallelDocItr {
+	ctx, cancel := context.WithCancel(ctx)
+	op := ParallelDocItr{
+		score:    0.0,
+		docId:    -1,
+		min:      PositiveInfinity,
+		max:      NegativeInfinity,
+		parts:    parts,
+		batchIdx: -1,
+		bound:    math.Float32bits(NegativeInfinity),
+		maxBound: math.Float32bits(PositiveInfinity),
+		done:     ctx.Done(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for _, part := range parts {
+		curMin, curMax := part.GetBounds()
+		op.min = Min(op.min, curMin)
+		op.max = Max(op.max, curMax)
+	}
+	return &op
+}
+
+func (op *ParallelDocItr) SetTopK(k int, explain bool) {
+	op.topK, op.explain = k, explain
+}
+
+func (op *ParallelDocItr) loadBound() float32 {
+	return math.Float32frombits(atomic.LoadUint32(&op.bound))
+}
+
+func (op *ParallelDocItr) raiseBound(min float32) {
+	for {
+		old := atomic.LoadUint32(&op.bound)
+		if math.Float32frombits(old) >= min {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&op.bound, old, math.Float32bits(min)) {
+			return
+		}
+	}
+}
+
+func (op *ParallelDocItr) loadMaxBound() float32 {
+	return math.Float32frombits(atomic.LoadUint32(&op.maxBound))
+}
+
+func (op *ParallelDocItr) start() {
+	op.started = true
+	op.batches = make(chan CandidateBatch, len(op.parts))
+	op.pending = make([][]CandidateBatch, len(op.parts))
+	op.left = make([]CandidateBatch, len(op.parts))
+	op.batch = CandidateBatch{Final: true} // (so that the first worker's turn comes next)
+	op.worker = -1
+	for idx, part := range op.parts {
+		op.workers.Add(1)
+		go func(idx int, part DocItr) {
+			defer op.workers.Done()
+			op.runWorker(idx, part)
+		}(idx, part)
+	}
+}
+
+// Sends a batch to the consumer; returns false if the consumer has gone away
+func (op *ParallelDocItr) send(batch CandidateBatch) bool {
+	select {
+	case op.batches <- batch:
+		return true
+	case <-op.done:
+		return false
+	}
+}
+
+// Workers stop early once the done channel is closed, leaving their final batch (with the candidates found so far)
+// in op.left if it cannot be sent; either way, they close their iterator
+func (op *ParallelDocItr) runWorker(workerNum int, itr DocItr) {
+	best := make(BaseDbResultSet, 0, op.topK+1) // (when keeping the best k) a heap with the worst candidate first
+	explanations := make(map[int64]Explanation)
+	batch := CandidateBatch{Worker: workerNum}
+	min, max := NegativeInfinity, PositiveInfinity // the bounds last given to the iterator
 	docId := int64(-1)
 	var score float32
+	stopped := false // (by the context)
+scan:
 	for {
+		select {
+		case <-op.done:
+			stopped = true
+			break scan
+		default:
+		}
+		if newMin, newMax := op.loadBound(), op.loadMaxBound(); newMin > min || newMax < max {
+			min, max = newMin, newMax
+			if !itr.SetBounds(min, max) {
+				break
+			}
+		}
 		if !itr.Next(docId + 1) {
 			break
 		}
 		docId, score = itr.Cur()
-		if score <= bounds.min || score >= bounds.max {
+		if score < op.loadBound() || score > op.loadMaxBound() {
 			continue
 		}
-		resultChannel <- CandidateResult{DocId: docId, Score: score, WorkerNum: myWorkerNum}
-		/*
-			select {
-			case newBounds, ok := <- boundsChannel:
-				if ok {
-					if bounds != newBounds {
-						bounds = newBounds
-						itr.SetBounds(bounds.min, bounds.max)
-					}
+		candidate := DocScore{DocId: ShardIdToExt(docId, workerNum), Score: score}
+		if op.topK == 0 {
+			batch.Candidates = append(batch.Candidates, candidate)
+			if op.explain {
+				batch.Explanations = append(batch.Explanations, Explain(itr))
+			}
+			if len(batch.Candidates) == PARALLEL_BATCH_SIZE {
+				if !op.send(batch) {
+					stopped = true
+					break scan // (the batch goes out with the final one)
 				}
+				batch = CandidateBatch{Worker: workerNum}
 			}
-		*/
-
-		newBounds := <-boundsChannel
-
-		if bounds != newBounds {
-			bounds = newBounds
-			itr.SetBounds(bounds.min, bounds.max)
+			continue
+		}
+		if len(best) == op.topK && !CandidateIsLess(best[0], candidate) {
+			continue
+		}
+		heap.Push(&best, candidate)
+		if op.explain {
+			explanations[candidate.DocId] = Explain(itr)
+		}
+		if len(best) > op.topK {
+			delete(explanations, heap.Pop(&best).(DocScore).DocId)
+		}
+		if len(best) == op.topK {
+			op.raiseBound(best[0].Score)
 		}
-
 	}
 	itr.Close()
-	resultChannel <- CandidateResult{DocId: -1}
-}
-
-func NewParallelDocItr(parts []DocItr) *ParallelDocItr {
-	op := ParallelDocItr{
-		score:         0.0,
-		docId:         -1,
-		NumAlive:      len(parts),
-		Bounds:        Bounds{min: float32(math.Inf(-1)), max: float32(math.Inf(1))},
-		ResultChannel: make(chan CandidateResult),
-		Comms:         make([](chan Bounds), len(parts)),
-	}
-	for idx, part := range parts {
-		part := part
-		curMin, curMax := part.GetBounds()
-		op.Bounds.min = Min(op.Bounds.min, curMin)
-		op.Bounds.max = Max(op.Bounds.max, curMax)
-		boundsChannel := make(chan Bounds)
-		op.Comms[idx] = boundsChannel
-		go RunItr(part, idx, op.ResultChannel, boundsChannel)
+	if op.topK != 0 {
+		sort.Slice(best, func(i, j int) bool { return best[i].DocId < best[j].DocId })
+		batch.Candidates = best
+		if op.explain {
+			for _, candidate := range best {
+				batch.Explanations = append(batch.Explanations, explanations[candidate.DocId])
+			}
+		}
+	}
+	batch.Final = true
+	batch.Err = itr.Err()
+	if stopped && batch.Err == nil {
+		batch.Err = op.ctx.Err() // (so that the consumer knows the candidates are incomplete)
+	}
+	if !op.send(batch) {
+		op.left[workerNum] = batch
 	}
-	return &op
 }
 
 func (op *ParallelDocItr) Name() string {
@@ -132,37 +391,135 @@ func (op *ParallelDocItr) Name() string {
 }
 
 func (op *ParallelDocItr) SetBounds(min, max float32) bool {
-	op.Bounds.min, op.Bounds.max = min, max
-	return true
+	op.min = Max(op.min, min)
+	op.max = Min(op.max, max)
+	op.raiseBound(op.min)
+	atomic.StoreUint32(&op.maxBound, math.Float32bits(op.max)) // (only this goroutine changes it)
+	return op.min <= op.max
 }
 
 func (op *ParallelDocItr) GetBounds() (min, max float32) {
-	return op.Bounds.min, op.Bounds.max
+	return op.min, op.max
 }
 
 func (op *ParallelDocItr) Next(minId int64) bool {
+	if !op.started {
+		op.start()
+	}
 	for {
-		result := <-op.ResultChannel
-		if result.DocId == -1 {
-			op.NumAlive -= 1
-			if op.NumAlive <= 0 {
-				return false
-			}
-		} else {
-			workerNum := result.WorkerNum
-			if result.Score > op.Bounds.min && result.Score < op.Bounds.max {
-				op.docId = ShardIdToExt(result.DocId, workerNum)
-				op.score = result.Score
-				op.Comms[workerNum] <- op.Bounds
+		op.batchIdx++
+		for op.batchIdx < len(op.batch.Candidates) {
+			candidate := op.batch.Candidates[op.batchIdx]
+			if candidate.DocId >= minId && op.min <= candidate.Score && candidate.Score <= op.max {
+				op.docId, op.score = candidate.DocId, candidate.Score
 				return true
-			} else {
-				op.Comms[workerNum] <- op.Bounds
 			}
+			op.batchIdx++
 		}
+		if op.batch.Final {
+			op.worker++
+			if _, shardNum := ShardIdFromExt(minId); shardNum > op.worker {
+				op.worker = shardNum // (the workers in between have nothing at or after minId)
+			}
+			if op.worker >= len(op.parts) {
+				op.worker = len(op.parts)
+				return false
+			}
+		}
+		if !op.receive() {
+			return op.stop()
+		}
+		op.batch, op.pending[op.worker] = op.pending[op.worker][0], op.pending[op.worker][1:]
+		op.batchIdx = -1
 	}
 }
 
-func (op *ParallelDocItr) Close() {} // unsure...
+// Waits until there is a batch from the worker whose turn it is; false if there will be none
+func (op *ParallelDocItr) receive() bool {
+	for len(op.pending[op.worker]) == 0 {
+		if op.drained {
+			return false
+		}
+		select {
+		case batch := <-op.batches:
+			op.hold(batch)
+		case <-op.done:
+			op.collect()
+		}
+	}
+	return true
+}
+
+func (op *ParallelDocItr) hold(batch CandidateBatch) {
+	op.pending[batch.Worker] = append(op.pending[batch.Worker], batch)
+	if batch.Final && op.err == nil {
+		op.err = batch.Err
+	}
+}
+
+// Once the context is done, waits for the workers to stop, then holds every batch that they sent or left behind.
+// Each worker has then ended with a final batch, so the candidates found so far are produced without waiting.
+func (op *ParallelDocItr) collect() {
+	op.workers.Wait()
+	if op.err == nil {
+		op.err = op.ctx.Err()
+	}
+	for empty := false; !empty; {
+		select {
+		case batch := <-op.batches:
+			op.hold(batch)
+		default:
+			empty = true
+		}
+	}
+	for _, batch := range op.left {
+		if batch.Final {
+			op.hold(batch)
+		}
+	}
+	op.drained = true
+}
+
+// Gives up on the workers once nothing more can be produced
+func (op *ParallelDocItr) stop() bool {
+	op.worker = len(op.parts)
+	op.batch = CandidateBatch{Final: true}
+	if op.err == nil {
+		op.err = op.ctx.Err()
+	}
+	return false
+}
+
+// Explanations are made by the workers (see SetTopK())
+func (op *ParallelDocItr) Explain() Explanation {
+	explanation := Explanation{Name: op.Name(), Score: op.score}
+	if op.batchIdx >= 0 && op.batchIdx < len(op.batch.Explanations) {
+		explanation.Children = []Explanation{op.batch.Explanations[op.batchIdx]}
+	}
+	return explanation
+}
+
+// (Only safe to read once the iterator is closed)
+func (op *ParallelDocItr) Children() []DocItr { return op.parts }
+
+// Stops any workers that are still running, and waits for them to close their iterators
+func (op *ParallelDocItr) Close() {
+	op.cancel()
+	if !op.started { // the iterators are not in use by any worker
+		op.started = true
+		for _, part := range op.parts {
+			part.Close()
+		}
+	}
+	op.workers.Wait()
+	op.worker = len(op.parts)
+	op.batch = CandidateBatch{Final: true}
+	op.pending, op.left = nil, nil
+}
+
+func (op *ParallelDocItr) Err() error {
+	return op.err
+}
 
 func (op *ParallelDocItr) Cur() (int64, float32) {
 	return op.docId, op.score
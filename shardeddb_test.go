@@ -1,7 +1,15 @@
 package scoredb
 
 import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestShardedDb(t *testing.T) {
@@ -14,11 +22,409 @@ func TestShardedDb(t *testing.T) {
 	db := BaseDb{
 		StreamingDb: ShardedDb{
 			Shards: []StreamingDb{
-				BaseStreamingDb{NewFsScoreDb(pathmaker("shard_1"))},
-				BaseStreamingDb{NewFsScoreDb(pathmaker("shard_2"))},
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_1"))},
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_2"))},
 			},
 		},
 		IdDb: idDb,
 	}
 	DbBasicsTest(db, t)
 }
+
+func TestShardedDbFieldValues(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	idDb, err := NewBoltIdDb(pathmaker("shard_values_ids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := make([]StreamingDb, 2)
+	for idx := range shards {
+		fsDb := OpenFsScoreDb(t, pathmaker(fmt.Sprintf("shard_values_%d", idx)))
+		fsDb.StoreValues = true
+		shards[idx] = BaseStreamingDb{fsDb}
+	}
+	db := BaseDb{StreamingDb: ShardedDb{Shards: shards}, IdDb: idDb}
+	DbFieldValuesTest(db, t)
+}
+
+func TestShardedDbDefaults(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	idDb, err := NewBoltIdDb(pathmaker("shard_defaults_ids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := BaseDb{
+		StreamingDb: ShardedDb{
+			Shards: []StreamingDb{
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_defaults_1"))},
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_defaults_2"))},
+			},
+		},
+		IdDb: idDb,
+	}
+	DbDefaultsTest(db, t)
+}
+
+func TestShardedDbFilters(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	idDb, err := NewBoltIdDb(pathmaker("shard_filters_ids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := BaseDb{
+		StreamingDb: ShardedDb{
+			Shards: []StreamingDb{
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_filters_1"))},
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_filters_2"))},
+			},
+		},
+		IdDb: idDb,
+	}
+	DbFiltersTest(db, t)
+}
+
+func TestShardedDbExplain(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	idDb, err := NewBoltIdDb(pathmaker("shard_explain_ids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := BaseDb{
+		StreamingDb: ShardedDb{
+			Shards: []StreamingDb{
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_explain_1"))},
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_explain_2"))},
+			},
+		},
+		IdDb: idDb,
+	}
+	DbExplainTest(db, t)
+}
+
+func TestShardedDbCancel(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	idDb, err := NewBoltIdDb(pathmaker("shard_cancel_ids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := BaseDb{
+		StreamingDb: ShardedDb{
+			Shards: []StreamingDb{
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_cancel_1"))},
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_cancel_2"))},
+			},
+		},
+		IdDb: idDb,
+	}
+	DbCancelTest(db, t)
+}
+
+// A shard that records what its iterators produce; with a positive numDocs, they then stall (until the query's
+// context is done) once they have produced that many documents
+type stallingShard struct {
+	StreamingDb
+	numDocs  int
+	produced []float32 // the scores produced
+	stalled  chan bool // closed when an iterator stalls
+	finished chan bool // closed when an iterator runs out of documents
+}
+
+func newStallingShard(numDocs int) *stallingShard {
+	return &stallingShard{
+		StreamingDb: BaseStreamingDb{NewMemoryScoreDb()},
+		numDocs:     numDocs,
+		stalled:     make(chan bool),
+		finished:    make(chan bool),
+	}
+}
+
+func (shard *stallingShard) QueryItr(ctx context.Context, expr *Expr) (DocItr, error) {
+	itr, err := shard.StreamingDb.QueryItr(ctx, expr)
+	if err != nil {
+		return nil, err
+	}
+	return &stallingDocItr{DocItr: itr, shard: shard, ctx: ctx}, nil
+}
+
+type stallingDocItr struct {
+	DocItr
+	shard *stallingShard
+	ctx   context.Context
+}
+
+func (op *stallingDocItr) Next(minId int64) bool {
+	if len(op.shard.produced) == op.shard.numDocs {
+		close(op.shard.stalled)
+		<-op.ctx.Done()
+		return false
+	}
+	if !op.DocItr.Next(minId) {
+		close(op.shard.finished)
+		return false
+	}
+	_, score := op.Cur()
+	op.shard.produced = append(op.shard.produced, score)
+	return true
+}
+
+// (like a RemoteDocItr, an iterator that the context stopped says so)
+func (op *stallingDocItr) Err() error {
+	if len(op.shard.produced) == op.shard.numDocs {
+		return op.ctx.Err()
+	}
+	return op.DocItr.Err()
+}
+
+func TestShardedDbPartialResults(t *testing.T) {
+	slow, fast := newStallingShard(3), newStallingShard(-1)
+	db := BaseDb{StreamingDb: ShardedDb{Shards: []StreamingDb{slow, fast}}, IdDb: NewMemoryIdDb()}
+	for idx := 0; idx < 40; idx++ {
+		id := fmt.Sprintf("r%d", idx)
+		score := float32(idx)
+		if ShardNumFor(id, 2) == 0 { // (the slow shard has the best documents)
+			score += 100
+		}
+		db.Index(id, map[string]float32{"age": score})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-slow.stalled
+		<-fast.finished
+		cancel()
+	}()
+	result, err := db.QueryContext(ctx, Query{Limit: 5, Scorer: []interface{}{"field", "age"}, AllowPartial: true})
+	if err != nil || !result.Partial {
+		t.Fatalf("expected partial results, found: %+v (%v)", result, err)
+	}
+	// the best of what the shards found: everything in the fast one, and the start of the slow one
+	seen := append(append([]float32{}, slow.produced...), fast.produced...)
+	sort.Slice(seen, func(i, j int) bool { return seen[i] > seen[j] })
+	if len(slow.produced) != 3 || len(seen) < 5 || !reflect.DeepEqual(result.Scores, seen[:5]) {
+		t.Fatalf("expected the best of %v, found %+v", seen, result)
+	}
+}
+
+func TestShardedDbRouting(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	shards := make([]StreamingDb, 3)
+	for idx := range shards {
+		fsDb := OpenFsScoreDb(t, pathmaker(fmt.Sprintf("shard_routing_%d", idx)))
+		fsDb.StoreValues = true
+		shards[idx] = BaseStreamingDb{fsDb}
+	}
+	shardedDb := ShardedDb{Shards: shards}
+	clientIds := make([]string, 900)
+	records := make([]map[string]float32, len(clientIds))
+	for idx := range clientIds {
+		clientIds[idx] = fmt.Sprintf("r%d", idx)
+		records[idx] = map[string]float32{"age": float32(idx)}
+	}
+	for round := 0; round < 2; round++ { // indexing the same ids again puts them in the same shards
+		ids, err := shardedDb.BulkIndex(clientIds, records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		perShard := make([]int, len(shards))
+		for idx, id := range ids {
+			_, shardNum := ShardIdFromExt(id)
+			if shardNum != ShardNumFor(clientIds[idx], len(shards)) {
+				t.Fatalf("%s was indexed in shard %d", clientIds[idx], shardNum)
+			}
+			perShard[shardNum]++
+		}
+		for _, count := range perShard {
+			if count < 200 || count > 400 {
+				t.Fatalf("records are unevenly spread among shards: %v", perShard)
+			}
+		}
+		values, err := shardedDb.FieldValues(ids[:3], []string{"age"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(values, records[:3]) {
+			t.Fatalf("expected: %v found: %v", records[:3], values)
+		}
+	}
+}
+
+func TestParallelDocItrTopK(t *testing.T) {
+	shards := make([]StreamingDb, 4)
+	for idx := range shards {
+		shards[idx] = BaseStreamingDb{NewMemoryScoreDb()}
+	}
+	shardedDb := ShardedDb{Shards: shards}
+	sharded := BaseDb{StreamingDb: shardedDb, IdDb: NewMemoryIdDb()}
+	single := BaseDb{StreamingDb: BaseStreamingDb{NewMemoryScoreDb()}, IdDb: NewMemoryIdDb()}
+	records := make([]Record, 2000)
+	for idx := range records {
+		records[idx] = Record{Id: fmt.Sprintf("%d", idx), Values: map[string]float32{"age": float32((idx * 7919) % 2000)}}
+	}
+	for _, db := range []BaseDb{sharded, single} {
+		err := db.BulkIndex(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, query := range []Query{
+		Query{Limit: 10, MinScore: NegativeInfinity, Scorer: []interface{}{"field", "age"}},
+		Query{Offset: 5, Limit: 10, MinScore: NegativeInfinity, Scorer: []interface{}{"scale", -1.0, []interface{}{"field", "age"}}},
+		Query{Limit: 3000, MinScore: 1500, Scorer: []interface{}{"field", "age"}},
+	} {
+		expected, err := single.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := sharded.Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, found) {
+			t.Fatalf("expected: %v found: %v", expected, found)
+		}
+	}
+
+	// without SetTopK(), every document is produced, in order
+	itr, err := shardedDb.QueryItr(context.Background(), Field("age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docIds []int64
+	for itr.Next(0) {
+		docId, _ := itr.Cur()
+		if len(docIds) > 0 && docId <= docIds[len(docIds)-1] {
+			t.Fatalf("document %d was produced after %d", docId, docIds[len(docIds)-1])
+		}
+		docIds = append(docIds, docId)
+	}
+	itr.Close()
+	if itr.Err() != nil || len(docIds) != len(records) {
+		t.Fatalf("expected %d documents, found %d (%v)", len(records), len(docIds), itr.Err())
+	}
+
+	// documents before minId are skipped, and so are scores beyond the bounds
+	itr, err = shardedDb.QueryItr(context.Background(), Field("age"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr.SetBounds(NegativeInfinity, 100)
+	minId := docIds[len(docIds)/2]
+	numFound := 0
+	for docId := minId - 1; itr.Next(docId + 1); {
+		var score float32
+		docId, score = itr.Cur()
+		if docId < minId || score > 100 {
+			t.Fatalf("document %d (with a score of %v) was produced", docId, score)
+		}
+		numFound++
+	}
+	itr.Close()
+	if itr.Err() != nil || numFound == 0 {
+		t.Fatalf("expected documents, found %d (%v)", numFound, itr.Err())
+	}
+}
+
+func TestShardedDbGoroutineLeaks(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	idDb, err := NewBoltIdDb(pathmaker("shard_leak_ids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shardedDb := ShardedDb{
+		Shards: []StreamingDb{
+			BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_leak_1"))},
+			BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_leak_2"))},
+		},
+	}
+	db := BaseDb{StreamingDb: shardedDb, IdDb: idDb}
+	records := make([]Record, 1000)
+	for idx := range records {
+		records[idx] = Record{Id: fmt.Sprintf("%d", idx), Values: map[string]float32{"age": float32(idx % 100)}}
+	}
+	err = db.BulkIndex(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startGoroutines, startOpenFiles := runtime.NumGoroutine(), atomic.LoadInt64(&numOpenFiles)
+	for i := 0; i < 50; i++ {
+		// an iterator that is abandoned after one result
+		itr, err := shardedDb.QueryItr(context.Background(), Field("age"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !itr.Next(0) {
+			t.Fatalf("Expected a result")
+		}
+		itr.Close()
+
+		// queries that stop early
+		_, err = db.Query(Query{Limit: 0, Scorer: []interface{}{"field", "age"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = db.QueryContext(ctx, Query{Limit: 10, Scorer: []interface{}{"field", "age"}})
+		if err != context.Canceled {
+			t.Fatalf("expected the query to be cancelled, found: %v", err)
+		}
+	}
+	if openFiles := atomic.LoadInt64(&numOpenFiles); openFiles != startOpenFiles {
+		t.Fatalf("%d files were left open", openFiles-startOpenFiles)
+	}
+	// Close() waits for the workers to close their iterators, but they may not have quite exited yet
+	for tries := 0; runtime.NumGoroutine() > startGoroutines; tries++ {
+		if tries == 100 {
+			t.Fatalf("%d goroutines were leaked", runtime.NumGoroutine()-startGoroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShardedDbDelete(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	idDb, err := NewBoltIdDb(pathmaker("shard_delete_ids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := BaseDb{
+		StreamingDb: ShardedDb{
+			Shards: []StreamingDb{
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_delete_1"))},
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_delete_2"))},
+			},
+		},
+		IdDb: idDb,
+	}
+	DbDeleteTest(db, t)
+}
+
+func TestShardedDbConcurrency(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	idDb, err := NewBoltIdDb(pathmaker("shard_concurrency_ids"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := BaseDb{
+		StreamingDb: ShardedDb{
+			Shards: []StreamingDb{
+				BaseStreamingDb{OpenFsScoreDb(t, pathmaker("shard_concurrency_1"))},
+				BaseStreamingDb{NewMemoryScoreDb()},
+			},
+		},
+		IdDb:      idDb,
+		WriteLock: &sync.Mutex{},
+	}
+	DbConcurrencyTest(db, t)
+}
@@ -0,0 +1,206 @@
+package scoredb
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Snapshots are consistent, point-in-time copies of a database, made while it is in use.
+// A snapshot has the same layout as the original, so it can be opened (or served) directly, or copied back into
+// place with RestoreSnapshot().
+//
+// Most files are copied. Full posting lists are never written again (new entries go to narrower buckets,
+// compaction writes new files, and fsck replaces the files it repairs), so they are hard linked instead.
+// Restoring copies every file, so that the restored database shares nothing with the snapshot, which may be
+// restored again later.
+
+// Databases that can copy themselves while in use implement this
+type SnapshottingDb interface {
+	Snapshot(dest string) error // dest must not exist yet
+}
+
+// Copies the shard's files to dest, while indexing, deletion, and compaction wait
+func (db *FsScoreDb) Snapshot(dest string) error {
+	db.writeLock.Lock()
+	defer db.writeLock.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return copyTree(db.dataDir, dest, true)
+}
+
+// Copies a snapshot (or any other database that is not in use) to dataDir, which must not exist yet
+func RestoreSnapshot(snapshotDir, dataDir string) error {
+	if !Exists(snapshotDir) {
+		return fmt.Errorf("There is no snapshot at %s", snapshotDir)
+	}
+	return copyTree(snapshotDir, dataDir, false)
+}
+
+// Copies a directory, linking files that will not change (when link is set)
+func copyTree(src, dest string, link bool) error {
+	if Exists(dest) {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	err := filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		destPath := path.Join(dest, relPath)
+		if info.IsDir() {
+			return os.MkdirAll(destPath, 0755)
+		}
+		if strings.HasSuffix(info.Name(), ".tmp") || info.Name() == WAL_FILENAME {
+			return nil // (left behind by a crash; never part of the database)
+		}
+		if link && isFullPostingList(srcPath) && os.Link(srcPath, destPath) == nil {
+			return nil
+		}
+		return copyFile(srcPath, destPath)
+	})
+	if err != nil {
+		os.RemoveAll(dest)
+		return err
+	}
+	return SyncPath(dest)
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return createFile(dest, in)
+}
+
+// Writes (and syncs) a new file with the given contents
+func createFile(dest string, contents io.Reader) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, contents)
+	if err == nil {
+		err = out.Sync()
+	}
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func isFullPostingList(filePath string) bool {
+	name := path.Base(filePath)
+	if _, err := strconv.ParseInt(name, 2, 32); err != nil {
+		return false
+	}
+	fd, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer fd.Close()
+	var header PostingListHeader
+	if binary.Read(fd, binary.LittleEndian, &header) != nil {
+		return false
+	}
+	fileInfo := &FileInfo{header: &header, numVariableBits: uint(32 - len(name))}
+	return header.NumDocs >= MaxDocsForFile(fileInfo)
+}
+
+// Writes the files in a directory to w, as a tar archive (for extractTar())
+func writeTar(w io.Writer, dir string) error {
+	archive := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, filePath)
+		if err != nil || relPath == "." {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = archive.WriteHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		fd, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		_, err = io.Copy(archive, fd)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// Writes the files in a tar archive (from writeTar()) into dest, which must not exist yet
+func extractTar(r io.Reader, dest string) error {
+	if Exists(dest) {
+		return fmt.Errorf("%s already exists", dest)
+	}
+	err := extractTarFiles(r, dest)
+	if err == nil {
+		err = SyncPath(dest)
+	}
+	if err != nil {
+		os.RemoveAll(dest)
+	}
+	return err
+}
+
+func extractTarFiles(r io.Reader, dest string) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Invalid path in archive: %s", header.Name)
+		}
+		destPath := path.Join(dest, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(destPath, 0755)
+		case tar.TypeReg:
+			err = createFile(destPath, archive)
+		default:
+			err = fmt.Errorf("Unexpected entry in archive: %s", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package scoredb
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Opens a database with the layout of BaseDb.Snapshot() over a ShardedDb
+func OpenSnapshotDb(t *testing.T, dir string, numShards int) BaseDb {
+	shards := make([]StreamingDb, numShards)
+	for idx := range shards {
+		shards[idx] = BaseStreamingDb{OpenFsScoreDb(t, path.Join(dir, fmt.Sprintf("shard.%d", idx)))}
+	}
+	idDb, err := NewBoltIdDb(path.Join(dir, "iddb"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return BaseDb{StreamingDb: ShardedDb{Shards: shards}, IdDb: idDb, WriteLock: &sync.Mutex{}}
+}
+
+func TestSnapshot(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	dataDir := pathmaker("snapshot_db")
+	db := OpenSnapshotDb(t, dataDir, 2)
+	records := make([]Record, 80000) // (enough to fill a bucket on each shard)
+	for idx := range records {
+		records[idx] = Record{Id: fmt.Sprintf("r%d", idx), Values: map[string]float32{"age": 1.0 + float32(idx)/100000}}
+	}
+	err := db.BulkIndex(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := Query{Limit: 5, Scorer: []interface{}{"field", "age"}}
+	expected, err := db.Query(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotDir := pathmaker("snapshot_copy")
+	err = db.Snapshot(snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Snapshot(snapshotDir) == nil {
+		t.Fatal("expected an error when the snapshot directory already exists")
+	}
+	numLinked := 0
+	filepath.Walk(snapshotDir, func(snapshotPath string, info os.FileInfo, err error) error {
+		relPath, _ := filepath.Rel(snapshotDir, snapshotPath)
+		original, statErr := os.Stat(path.Join(dataDir, relPath))
+		if err == nil && statErr == nil && !info.IsDir() && os.SameFile(info, original) {
+			numLinked++
+		}
+		return nil
+	})
+	if numLinked == 0 {
+		t.Fatal("expected full posting lists to be linked rather than copied")
+	}
+
+	// changes after the snapshot do not reach it
+	db.Index("r1", map[string]float32{"age": 3.0})
+	db.Delete("r79999")
+	db.Index("r80000", map[string]float32{"age": 2.5})
+
+	restoredDir := pathmaker("snapshot_restored")
+	err = RestoreSnapshot(snapshotDir, restoredDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filepath.Walk(restoredDir, func(restoredPath string, info os.FileInfo, err error) error {
+		relPath, _ := filepath.Rel(restoredDir, restoredPath)
+		snapshotted, statErr := os.Stat(path.Join(snapshotDir, relPath))
+		if err == nil && statErr == nil && !info.IsDir() && os.SameFile(info, snapshotted) {
+			t.Fatalf("expected %s to be copied rather than linked on restore", relPath)
+		}
+		return nil
+	})
+	for _, dir := range []string{snapshotDir, restoredDir} {
+		found, err := OpenSnapshotDb(t, dir, 2).Query(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expected, found) {
+			t.Fatalf("%s: expected: %v found: %v", dir, expected, found)
+		}
+	}
+	found, err := db.Query(Query{Limit: 3, Scorer: []interface{}{"field", "age"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found.Ids, []string{"r1", "r80000", "r79998"}) {
+		t.Fatalf("expected: [r1 r80000 r79998] found: %v", found.Ids)
+	}
+}
+
+func TestSnapshotWhileIndexing(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	db := OpenSnapshotDb(t, pathmaker("snapshot_busy_db"), 2)
+	batchSize := 10
+	stop := make(chan bool)
+	done := make(chan error)
+	go func() {
+		for batchNum := 0; ; batchNum++ {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			batch := make([]Record, batchSize)
+			for idx := range batch {
+				batch[idx] = Record{Id: fmt.Sprintf("r%d.%d", batchNum, idx), Values: map[string]float32{"age": float32(idx)}}
+			}
+			err := db.BulkIndex(batch)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	for snapshotNum := 0; snapshotNum < 3; snapshotNum++ {
+		snapshotDir := pathmaker(fmt.Sprintf("snapshot_busy_%d", snapshotNum))
+		err := db.Snapshot(snapshotDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := OpenSnapshotDb(t, snapshotDir, 2).Query(Query{Limit: 100000, MinScore: NegativeInfinity, Scorer: []interface{}{"field", "age"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Ids)%batchSize != 0 {
+			t.Fatalf("snapshot %d has part of a batch: %d records", snapshotNum, len(result.Ids))
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractTarStaysInDest(t *testing.T) {
+	pathmaker := RmAllTestData()
+	defer RmAllTestData()
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	archive.WriteHeader(&tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0644, Size: 1})
+	archive.Write([]byte("x"))
+	archive.Close()
+	dest := pathmaker("extract_escape")
+	if extractTar(&buf, dest) == nil {
+		t.Fatal("expected a path outside of the destination to be refused")
+	}
+	if Exists(dest) || Exists(path.Join(path.Dir(dest), "escaped")) {
+		t.Fatal("expected nothing to be left behind")
+	}
+}
@@ -44,6 +44,13 @@ func NewSumDocItr(itrs []DocItr) *SumDocItr {
 }
 
 func (op *SumDocItr) Name() string { return "SumDocItr" }
+func (op *SumDocItr) Children() []DocItr {
+	children := make([]DocItr, len(op.parts))
+	for idx, part := range op.parts {
+		children[idx] = part.docItr
+	}
+	return children
+}
 func (op *SumDocItr) Cur() (int64, float32) {
 	return op.docId, op.score
 }
@@ -53,6 +60,14 @@ func (op *SumDocItr) Close() {
 		part.docItr.Close()
 	}
 }
+func (op *SumDocItr) Err() error {
+	for _, part := range op.parts {
+		if err := part.docItr.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 func (op *SumDocItr) Next(minId int64) bool {
 	min, max := op.min, op.max
 	keepGoing := true
@@ -0,0 +1,89 @@
+package scoredb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+)
+
+// The (optional) forward store of a field's values: a flat file of little-endian float32 values, indexed by doc id.
+// Documents without a value for the field are stored as NaN.
+
+var VALUES_FILENAME = "values"
+var missingValue = math.Float32bits(float32(math.NaN()))
+
+type ValueWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	nextId int64 // the doc id of the next value in the file
+}
+
+func OpenValueWriter(path string) (*ValueWriter, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	size, err := file.Seek(0, 2)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &ValueWriter{file: file, writer: bufio.NewWriter(file), nextId: size / 4}, nil
+}
+
+// Values must be written in increasing doc id order
+func (valueWriter *ValueWriter) Write(docId int64, value float32) error {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], missingValue)
+	for ; valueWriter.nextId < docId; valueWriter.nextId++ {
+		_, err := valueWriter.writer.Write(buf[:])
+		if err != nil {
+			return err
+		}
+	}
+	binary.LittleEndian.PutUint32(buf[:], math.Float32bits(value))
+	_, err := valueWriter.writer.Write(buf[:])
+	if err != nil {
+		return err
+	}
+	valueWriter.nextId = docId + 1
+	return nil
+}
+
+func (valueWriter *ValueWriter) Close() error {
+	err := valueWriter.writer.Flush()
+	if err != nil {
+		valueWriter.file.Close()
+		return err
+	}
+	return valueWriter.file.Close()
+}
+
+// Reads the values of the given documents; the value is NaN for documents that have none
+func ReadValues(path string, docIds []int64) ([]float32, error) {
+	values := make([]float32, len(docIds))
+	for idx := range values {
+		values[idx] = math.Float32frombits(missingValue)
+	}
+	if !Exists(path) {
+		return values, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var buf [4]byte
+	for idx, docId := range docIds {
+		_, err = file.ReadAt(buf[:], docId*4)
+		if err == io.EOF {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		values[idx] = math.Float32frombits(binary.LittleEndian.Uint32(buf[:]))
+	}
+	return values, nil
+}
@@ -0,0 +1,188 @@
+package scoredb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+)
+
+// A write-ahead log that makes each FsScoreDb.BulkIndex() batch atomic.
+//
+// Before a batch first modifies a file, the parts of the file that the batch may overwrite (for a posting list,
+// its header and the trailing bit-writer footer) are appended to the log, along with the file's original size.
+// Anything else that the batch writes is appended to the end of the file.
+// The batch commits when every modified file has been synced to disk; then the log is removed.
+// If a log is found when the database is opened, its batch never committed: every file it mentions is
+// restored to its original state (and files that the batch created are removed).
+type WriteAheadLog struct {
+	dataDir string
+	file    *os.File
+	logged  map[string]bool
+}
+
+var WAL_FILENAME = ".wal"
+var FOOTER_SIZE = int64(16) // the bit writer's trailing (partial word, bits used) pair
+
+type walEntryHeader struct {
+	Checksum uint32 // of everything following this field
+	Existed  uint8
+	_        uint8
+	PathLen  uint16
+	OrigSize int64
+}
+
+func OpenWriteAheadLog(dataDir string) (*WriteAheadLog, error) {
+	file, err := os.Create(path.Join(dataDir, WAL_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	return &WriteAheadLog{dataDir: dataDir, file: file, logged: make(map[string]bool)}, nil
+}
+
+// Records the current state of a file (given relative to the data directory) so that it can be restored later.
+// This must be called before the file is modified (or created).
+func (wal *WriteAheadLog) LogFile(relPath string) error {
+	if wal.logged[relPath] {
+		return nil
+	}
+	header := walEntryHeader{PathLen: uint16(len(relPath))}
+	saved := make([]byte, HEADER_SIZE+FOOTER_SIZE)
+	stat, err := os.Stat(path.Join(wal.dataDir, relPath))
+	if err == nil {
+		header.Existed = 1
+		header.OrigSize = stat.Size()
+		fd, err := os.Open(path.Join(wal.dataDir, relPath))
+		if err != nil {
+			return err
+		}
+		if header.OrigSize >= HEADER_SIZE {
+			_, err = fd.ReadAt(saved[:HEADER_SIZE], 0)
+		}
+		if err == nil && header.OrigSize >= HEADER_SIZE+FOOTER_SIZE {
+			_, err = fd.ReadAt(saved[HEADER_SIZE:], header.OrigSize-FOOTER_SIZE)
+		}
+		fd.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.LittleEndian, header)
+	body.WriteString(relPath)
+	body.Write(saved)
+	entry := body.Bytes()
+	binary.LittleEndian.PutUint32(entry, crc32.ChecksumIEEE(entry[4:]))
+	_, err = wal.file.Write(entry)
+	if err != nil {
+		return err
+	}
+	err = wal.file.Sync()
+	if err != nil {
+		return err
+	}
+	wal.logged[relPath] = true
+	return nil
+}
+
+// Syncs every logged file, and then removes the log, making the batch permanent
+func (wal *WriteAheadLog) Commit() error {
+	for relPath := range wal.logged {
+		err := SyncPath(path.Join(wal.dataDir, relPath))
+		if err != nil {
+			return err
+		}
+	}
+	err := wal.file.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(wal.file.Name())
+	if err != nil {
+		return err
+	}
+	return SyncPath(wal.dataDir)
+}
+
+// Undoes the changes of an uncommitted batch, if there is one
+func RecoverWriteAheadLog(dataDir string) error {
+	walPath := path.Join(dataDir, WAL_FILENAME)
+	if !Exists(walPath) {
+		return nil
+	}
+	fd, err := os.Open(walPath)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(fd)
+	headerSize := binary.Size(walEntryHeader{})
+	for {
+		entryStart := make([]byte, headerSize)
+		_, err = io.ReadFull(reader, entryStart)
+		if err != nil { // end of the log (possibly a partial entry, written just before a crash)
+			break
+		}
+		var header walEntryHeader
+		binary.Read(bytes.NewReader(entryStart), binary.LittleEndian, &header)
+		rest := make([]byte, int64(header.PathLen)+HEADER_SIZE+FOOTER_SIZE)
+		_, err = io.ReadFull(reader, rest)
+		if err != nil {
+			break
+		}
+		checksum := crc32.Update(crc32.ChecksumIEEE(entryStart[4:]), crc32.IEEETable, rest)
+		if checksum != header.Checksum { // a torn write; the file it describes was never modified
+			break
+		}
+		err = restoreFile(dataDir, header, rest)
+		if err != nil {
+			fd.Close()
+			return err
+		}
+	}
+	fd.Close()
+	err = os.Remove(walPath)
+	if err != nil {
+		return err
+	}
+	return SyncPath(dataDir)
+}
+
+func restoreFile(dataDir string, header walEntryHeader, rest []byte) error {
+	filePath := path.Join(dataDir, string(rest[:header.PathLen]))
+	saved := rest[header.PathLen:]
+	if header.Existed == 0 {
+		err := os.Remove(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	fd, err := os.OpenFile(filePath, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	err = fd.Truncate(header.OrigSize)
+	if err != nil {
+		return err
+	}
+	if header.OrigSize >= HEADER_SIZE {
+		_, err = fd.WriteAt(saved[:HEADER_SIZE], 0)
+		if err != nil {
+			return err
+		}
+	}
+	if header.OrigSize >= HEADER_SIZE+FOOTER_SIZE {
+		_, err = fd.WriteAt(saved[HEADER_SIZE:], header.OrigSize-FOOTER_SIZE)
+		if err != nil {
+			return err
+		}
+	}
+	return fd.Sync()
+}
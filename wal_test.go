@@ -0,0 +1,122 @@
+package scoredb
+
+import (
+	"os"
+	"testing"
+)
+
+// Writes a batch all the way to disk, but crashes before it commits
+func writeUncommittedBatch(t *testing.T, fsDb *FsScoreDb, records []map[string]float32) {
+	wal, err := OpenWriteAheadLog(fsDb.dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsDb.wal = wal
+	_, err = fsDb.writeRecords(records)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = CloseWriters(fsDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.file.Close()
+	fsDb.wal = nil
+}
+
+func TestWalRecovery(t *testing.T) {
+	testdir := RmAllTestData()("wal.1")
+	defer RmAllTestData()
+	fsDb := OpenFsScoreDb(t, testdir)
+	db := BaseDb{StreamingDb: BaseStreamingDb{fsDb}, IdDb: NewMemoryIdDb()}
+	err := db.BulkIndex([]Record{
+		Record{Id: "r1", Values: map[string]float32{"x": 1.0}},
+		Record{Id: "r2", Values: map[string]float32{"x": 2.0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Exists(testdir + "/" + WAL_FILENAME) {
+		t.Fatalf("Write-ahead log was not removed after commit")
+	}
+	sizes := make(map[string]int64)
+	for _, fileInfo := range fsDb.fields["x"].files {
+		stat, err := os.Stat(fileInfo.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[fileInfo.path] = stat.Size()
+	}
+
+	// modifies the existing bucket, creates a new one, and creates a new field
+	writeUncommittedBatch(t, fsDb, []map[string]float32{
+		map[string]float32{"x": 3.0},
+		map[string]float32{"x": 1000.0, "y": 1.0},
+	})
+
+	reloadedDb := OpenFsScoreDb(t, testdir)
+	reloaded := BaseDb{StreamingDb: BaseStreamingDb{reloadedDb}, IdDb: db.IdDb}
+	CallAndCheck(reloaded, t, []string{"r2", "r1"}, 3, []interface{}{"field", "x"})
+	CallAndCheck(reloaded, t, []string{}, 3, []interface{}{"field", "y"})
+	if len(reloadedDb.fields["x"].files) != len(sizes) {
+		t.Fatalf("Bucket created by uncommitted batch was not removed")
+	}
+	for _, fileInfo := range reloadedDb.fields["x"].files {
+		stat, err := os.Stat(fileInfo.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() != sizes[fileInfo.path] {
+			t.Fatalf("Expected size %v for %v after recovery; found %v", sizes[fileInfo.path], fileInfo.path, stat.Size())
+		}
+	}
+
+	// the recovered database remains writable, and does not reuse the ids of the abandoned batch's docs
+	err = reloaded.Index("r3", map[string]float32{"x": 3.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CallAndCheck(reloaded, t, []string{"r3", "r2", "r1"}, 3, []interface{}{"field", "x"})
+}
+
+func TestWalRollback(t *testing.T) {
+	testdir := RmAllTestData()("wal.2")
+	defer RmAllTestData()
+	fsDb := OpenFsScoreDb(t, testdir)
+	db := BaseDb{StreamingDb: BaseStreamingDb{fsDb}, IdDb: NewMemoryIdDb()}
+	err := db.Index("r1", map[string]float32{"x": 1.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a batch that fails partway through is rolled back in place, while a query is reading the field
+	fieldFiles := fsDb.fields["x"]
+	release := fieldFiles.Acquire()
+	wal, err := OpenWriteAheadLog(testdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsDb.wal = wal
+	_, err = fsDb.writeRecords([]map[string]float32{map[string]float32{"x": 2.0, "y": 1.0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fsDb.rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsDb.wal = nil
+	if fsDb.fields["x"] != fieldFiles || fieldFiles.readers != 1 {
+		t.Fatalf("Rollback replaced the files of a field that a query was reading")
+	}
+	release()
+	CallAndCheck(db, t, []string{"r1"}, 3, []interface{}{"field", "x"})
+
+	err = db.Index("r2", map[string]float32{"x": 2.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	CallAndCheck(db, t, []string{"r2", "r1"}, 3, []interface{}{"field", "x"})
+	reloaded := BaseDb{StreamingDb: BaseStreamingDb{OpenFsScoreDb(t, testdir)}, IdDb: db.IdDb}
+	CallAndCheck(reloaded, t, []string{"r2", "r1"}, 3, []interface{}{"field", "x"})
+}